@@ -18,6 +18,7 @@ import (
 	"github.com/jhoonb/archivex"
 	"github.com/mattn/go-shellwords"
 	"github.com/swasd/dpm/provision"
+	"github.com/swasd/dpm/render"
 	"github.com/swasd/dpm/repo"
 )
 
@@ -26,19 +27,46 @@ type Package struct {
 }
 
 type Spec struct {
-	Name         string
-	Version      string
-	Provision    string
-	Composition  string
-	Title        string
-	Description  string
-	Dirs         []string
-	Dependencies map[string]string // in `"package": version=number` format
+	Name        string `schema:"required,pattern=^[a-z0-9]+([-_.][a-z0-9]+)*$"`
+	Version     string `schema:"required,pattern=^[0-9]+(\\.[0-9A-Za-z]+)*$"`
+	Provision   string `schema:"required"`
+	Composition string `schema:"required"`
+	// CompositionType is one of CompositionTypes, docker-compose if not set.
+	CompositionType string      `yaml:"composition-type,omitempty" schema:"enum=@composition-types"`
+	Kubernetes      *Kubernetes `yaml:",omitempty"`
+	Title           string
+	Description     string
+	Dirs            []string
+	Dependencies    map[string]Dependency
+	Parameters      map[string]Parameter
+	Hooks           Hooks
+	Healthcheck     *HealthCheck
+	Tests           []Test `yaml:",omitempty"`
+}
+
+// Dependency is a package required by the package.
+type Dependency struct {
+	Version string `schema:"required,pattern=^[0-9]+(\\.[0-9A-Za-z]+)*$"`
 }
 
 type Root struct {
-	SpecVersion string `yaml:"specVersion"`
-	Spec        *Spec
+	SpecVersion string `yaml:"specVersion" schema:"required,enum=@versions"`
+	Spec        *Spec  `schema:"required"`
+}
+
+// addDir adds the files of the directory name, relative to dir,
+// keeping their paths under dir.
+func addDir(tarfile *archivex.TarFile, dir string, name string) error {
+	return filepath.Walk(filepath.Join(dir, name), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return tarfile.AddFileWithName(path, filepath.ToSlash(rel))
+	})
 }
 
 func BuildPackage(dir string) (*Package, error) {
@@ -49,18 +77,36 @@ func BuildPackage(dir string) (*Package, error) {
 	tarfile.Writer = tar.NewWriter(buf)
 
 	specContent, err := ioutil.ReadFile(filepath.Join(dir, "SPEC.yml"))
-	root := Root{}
-	err = yaml.Unmarshal(specContent, &root)
 	if err != nil {
 		return nil, err
 	}
-	spec := root.Spec
+	spec, err := ParseSpec(specContent)
+	if err != nil {
+		return nil, err
+	}
 
-	tarfile.AddFileWithName(filepath.Join(dir, "SPEC.yml"), "SPEC.yml")
-	tarfile.AddFileWithName(filepath.Join(dir, spec.Provision), spec.Provision)
-	tarfile.AddFileWithName(filepath.Join(dir, spec.Composition), spec.Composition)
+	err = tarfile.AddFileWithName(filepath.Join(dir, "SPEC.yml"), "SPEC.yml")
+	if err != nil {
+		return nil, err
+	}
+	err = tarfile.AddFileWithName(filepath.Join(dir, spec.Provision), spec.Provision)
+	if err != nil {
+		return nil, err
+	}
+	// kubernetes compositions may be a directory of manifests
+	if info, err := os.Stat(filepath.Join(dir, spec.Composition)); err == nil && info.IsDir() {
+		err = addDir(tarfile, dir, spec.Composition)
+	} else {
+		err = tarfile.AddFileWithName(filepath.Join(dir, spec.Composition), spec.Composition)
+	}
+	if err != nil {
+		return nil, err
+	}
 	for _, d := range spec.Dirs {
-		tarfile.AddAll(filepath.Join(dir, d), true)
+		err = addDir(tarfile, dir, d)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	hashes := []string{}
@@ -68,13 +114,8 @@ func BuildPackage(dir string) (*Package, error) {
 	// resolve dependencies on build
 	// to gaurantee that the package will have
 	// the same behaviour everytime we deploy it
-	for name, attributes := range spec.Dependencies {
-		attrs, err := parse(attributes)
-		if err != nil {
-			return nil, err
-		}
-
-		entry, err := repo.Get(name, attrs["version"])
+	for name, dependency := range spec.Dependencies {
+		entry, err := repo.Get(name, dependency.Version)
 		if err != nil {
 			return nil, err
 		}
@@ -104,21 +145,39 @@ func BuildPackage(dir string) (*Package, error) {
 	if err != nil {
 		return nil, err
 	}
-	tarfile.Add("DEPS", depsContent)
+	err = tarfile.Add("DEPS", depsContent)
+	if err != nil {
+		return nil, err
+	}
 
+	name := func(hash string) string {
+		if hash == "this" {
+			return spec.Name + ":" + spec.Version
+		}
+		return Describe(hash)
+	}
+	if err := danglingError(graph, name); err != nil {
+		return nil, err
+	}
 	order, cyclic := toposort(graph)
 	if len(cyclic) != 0 {
-		return nil, fmt.Errorf("Dependency cyclic detected")
+		return nil, cycleError(cyclic, name)
 	}
 
 	for _, h := range order {
 		if h == "this" {
 			continue
 		}
-		tarfile.AddAll(filepath.Join(home, ".dpm", "workspace", h), true)
+		err = tarfile.AddAll(filepath.Join(home, ".dpm", "workspace", h), true)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	tarfile.Close()
+	err = tarfile.Close()
+	if err != nil {
+		return nil, err
+	}
 	return &Package{buf.Bytes()}, nil
 }
 
@@ -137,17 +196,7 @@ func ReadSpec(hash string) (*Spec, error) {
 		return nil, err
 	}
 
-	root := Root{}
-	err = yaml.Unmarshal(specContent, &root)
-	if err != nil {
-		return nil, err
-	}
-
-	if root.SpecVersion != "0.1.0" {
-		return nil, fmt.Errorf("Spec version '%s' is not supported.", root.SpecVersion)
-	}
-
-	return root.Spec, nil
+	return ParseSpec(specContent)
 }
 
 func (p *Package) Save() error {
@@ -181,7 +230,7 @@ func (p *Package) Spec() (*Spec, error) {
 	br := bytes.NewReader(p.content)
 	tr := tar.NewReader(br)
 	hdr, err := tr.Next()
-	if hdr.Name != "SPEC.yml" {
+	if err != nil || hdr.Name != "SPEC.yml" {
 		return nil, fmt.Errorf("File format incorrect")
 	}
 	specContent := make([]byte, hdr.Size)
@@ -189,17 +238,10 @@ func (p *Package) Spec() (*Spec, error) {
 	if int64(n) != hdr.Size {
 		return nil, fmt.Errorf("Size not match")
 	}
-	root := Root{}
-	err = yaml.Unmarshal(specContent, &root)
 	if err != nil {
 		return nil, err
 	}
-
-	if root.SpecVersion != "0.1.0" {
-		return nil, fmt.Errorf("Spec version '%s' is not supported.", root.SpecVersion)
-	}
-
-	return root.Spec, nil
+	return ParseSpec(specContent)
 }
 
 type DepGraph map[string][]string
@@ -240,16 +282,89 @@ func (p *Package) Deps() (DepGraph, error) {
 	return graph, nil
 }
 
+// Reverse returns the graph with all edges reversed,
+// mapping each package to packages depending on it.
+func (g DepGraph) Reverse() DepGraph {
+	result := make(DepGraph)
+	for k, v := range g {
+		if _, exist := result[k]; !exist {
+			result[k] = []string{}
+		}
+		for _, d := range v {
+			result[d] = append(result[d], k)
+		}
+	}
+	for k, v := range result {
+		result[k] = removeDuplicates(v)
+	}
+	return result
+}
+
 func (p *Package) Order() ([]string, error) {
 	graph, err := p.Deps()
 	if err != nil {
 		return nil, err
 	}
-	// skip cyclic check because it already prevents when building the package
-	order, _ := toposort(graph)
+	root := p.Sha256()
+	name := func(hash string) string {
+		if hash == root {
+			if spec, err := p.Spec(); err == nil {
+				return spec.Name + ":" + spec.Version
+			}
+		}
+		return Describe(hash)
+	}
+	// a package built by dpm never has a cycle or a missing dependency,
+	// but DEPS may have been crafted or corrupted
+	if err := danglingError(graph, name); err != nil {
+		return nil, err
+	}
+	order, cyclic := toposort(graph)
+	if len(cyclic) != 0 {
+		return nil, cycleError(cyclic, name)
+	}
 	return order, nil
 }
 
+// Describe returns name:version of the package of the hash
+// extracted in the workspace, or the short hash if not found.
+func Describe(hash string) string {
+	spec, err := ReadSpec(hash)
+	if err == nil {
+		return spec.Name + ":" + spec.Version
+	}
+	return ShortHash(hash)
+}
+
+// ShortHash returns the first 8 characters of the hash,
+// the whole of a shorter one.
+func ShortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[0:8]
+	}
+	return hash
+}
+
+// cycleError reports the cycle found by toposort as a path of packages.
+func cycleError(cyclic []string, name func(string) string) error {
+	path := []string{}
+	// toposort collects the cycle backwards
+	for i := len(cyclic) - 1; i >= 0; i-- {
+		path = append(path, name(cyclic[i]))
+	}
+	path = append(path, path[0])
+	return fmt.Errorf("Dependency cycle detected: %s", strings.Join(path, " -> "))
+}
+
+// danglingError reports a dependency of the graph missing from it.
+func danglingError(g DepGraph, name func(string) string) error {
+	from, to, found := dangling(g)
+	if !found {
+		return nil
+	}
+	return fmt.Errorf("Dependency %s of %s is missing from DEPS", name(to), name(from))
+}
+
 func (p *Package) platforms() (string, error) {
 	result := make(map[string]bool)
 	pp, err := p.provision()
@@ -257,37 +372,8 @@ func (p *Package) platforms() (string, error) {
 		return "", err
 	}
 	for _, m := range pp.Machines() {
-		switch m.Driver() {
-		case "amazonec2":
-			result["aws"] = true
-		case "azure":
-			result["az"] = true
-		case "exoscale":
-			result["ex"] = true
-		case "google":
-			result["gce"] = true
-		case "generic":
-			result["ge"] = true
-		case "hyperv":
-			result["hv"] = true
-		case "openstack":
-			result["os"] = true
-		case "rackspace":
-			result["rs"] = true
-		case "softlayer":
-			result["sl"] = true
-		case "virtualbox":
-			result["vbox"] = true
-		case "vmwarevcloudair":
-			result["vca"] = true
-		case "vmwarefusion":
-			result["vf"] = true
-		case "vmwarevsphere":
-			result["vs"] = true
-		case "digitalocean":
-			result["do"] = true
-		case "none":
-			result["none"] = true
+		if platform, exist := provision.Drivers[m.Driver()]; exist {
+			result[platform] = true
 		}
 	}
 	keys := []string{}
@@ -323,6 +409,12 @@ func (p *Package) provision() (*provision.Spec, error) {
 	if int64(n) != hdr.Size {
 		return nil, fmt.Errorf("Size not match")
 	}
+	if render.IsTemplate(prov) {
+		provisionContent, err = provision.RenderTemplate(prov, provisionContent, spec.DefaultParameters())
+		if err != nil {
+			return nil, err
+		}
+	}
 	return provision.Read(provisionContent)
 }
 
@@ -1,13 +1,34 @@
 package build
 
 import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/dpmtest"
 )
 
+// seededHome returns a home with the packages built from the directories
+// in its index, as pack1 and pack2 the test package depends on.
+func seededHome(t *testing.T, dirs ...string) *dpmtest.Home {
+	h := dpmtest.NewHome(t)
+	for _, dir := range dirs {
+		p, err := BuildPackage(dir)
+		assert.NoError(t, err)
+		spec, err := p.Spec()
+		assert.NoError(t, err)
+		h.AddPackage(spec.Name, spec.Version, p.content)
+	}
+	return h
+}
+
 func TestBuild(t *testing.T) {
+	defer seededHome(t, "./_pack1", "./_pack2").Close()
 	p, err := BuildPackage("./_base")
 	assert.NoError(t, err)
 	assert.NotNil(t, p)
@@ -21,6 +42,7 @@ func TestBuild(t *testing.T) {
 }
 
 func TestSave(t *testing.T) {
+	defer seededHome(t, "./_pack1", "./_pack2").Close()
 	p, err := BuildPackage("./_base")
 	assert.NoError(t, err)
 	err = p.SaveToDir("./_base")
@@ -32,6 +54,7 @@ func TestSave(t *testing.T) {
 }
 
 func TestExtract(t *testing.T) {
+	defer seededHome(t, "./_pack1", "./_pack2").Close()
 	p, err := BuildPackage("./_base")
 	assert.NoError(t, err)
 	err = p.SaveToFile("./_base/dir.dpm")
@@ -65,7 +88,43 @@ func TestExtract(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestExtractManifestsDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dpm-build")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"SPEC.yml": `---
+specVersion: 0.1.0
+spec:
+  name: manifests
+  version: 0.1.0
+  provision: provision.yml
+  composition: deploy/k8s
+  compositionType: kubernetes
+`,
+		"provision.yml":                  "none: {driver: none}",
+		"deploy/k8s/app.yml":             "kind: Deployment",
+		"deploy/k8s/network/ingress.yml": "kind: Ingress",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	p, err := BuildPackage(dir)
+	assert.NoError(t, err)
+	extracted := filepath.Join(dir, "extracted")
+	assert.NoError(t, p.Extract(extracted))
+	for _, name := range []string{"deploy/k8s/app.yml", "deploy/k8s/network/ingress.yml"} {
+		content, err := ioutil.ReadFile(filepath.Join(extracted, filepath.FromSlash(name)))
+		assert.NoError(t, err)
+		assert.Equal(t, string(content), files[name])
+	}
+}
+
 func TestSpecInfo(t *testing.T) {
+	defer seededHome(t, "./_pack1", "./_pack2").Close()
 	p, err := BuildPackage("./_base")
 	assert.NoError(t, err)
 	err = p.SaveToFile("./_base/dir.dpm")
@@ -84,14 +143,15 @@ func TestSpecInfo(t *testing.T) {
 	assert.Equal(t, spec.Version, "0.1.0.dev")
 	assert.Equal(t, spec.Description, "This is a test package.\n")
 	assert.Equal(t, spec.Dirs, []string{"web", "back"})
-	assert.Equal(t, spec.Dependencies["pack1"], "version=1.0")
-	assert.Equal(t, spec.Dependencies["pack2"], "version=2.0")
+	assert.Equal(t, spec.Dependencies["pack1"].Version, "1.0")
+	assert.Equal(t, spec.Dependencies["pack2"].Version, "2.0")
 
 	err = os.Remove("./_base/dir.dpm")
 	assert.NoError(t, err)
 }
 
 func TestGetDeps(t *testing.T) {
+	defer seededHome(t, "./_pack1", "./_pack2").Close()
 	p, err := BuildPackage("./_base")
 	assert.NoError(t, err)
 	err = p.SaveToFile("./_base/dir.dpm")
@@ -107,6 +167,31 @@ func TestGetDeps(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestBuildWithDependencies(t *testing.T) {
+	h := seededHome(t, "./_pack1", "./_pack2")
+	defer h.Close()
+	base, err := BuildPackage("./_base")
+	assert.NoError(t, err)
+	h.AddPackage("test", "0.1.0.dev", base.content)
+
+	p, err := BuildPackage("./_app")
+	assert.NoError(t, err)
+	order, err := p.Order()
+	assert.NoError(t, err)
+	assert.Equal(t, len(order), 4)
+	assert.Equal(t, order[2:], []string{base.Sha256(), p.Sha256()})
+
+	// dependencies get extracted to the workspace on build
+	_, err = os.Stat(filepath.Join(h.Dir, ".dpm", "workspace", base.Sha256(), "web", "Dockerfile"))
+	assert.NoError(t, err)
+
+	_, err = BuildPackage("./_pack1")
+	assert.NoError(t, err)
+	h.Close()
+	_, err = BuildPackage("./_app")
+	assert.Error(t, err)
+}
+
 func TestParseAttributes(t *testing.T) {
 	m, err := parse("version=1.0.1 instances=1 x=\"x y\" ")
 	assert.NoError(t, err)
@@ -128,3 +213,49 @@ func TestMergeDepGraph(t *testing.T) {
 	assert.Equal(t, out["a"], []string{"b", "c", "d"})
 	assert.Equal(t, out["b"], []string{"a", "b", "c", "d"})
 }
+
+func TestReverseDepGraph(t *testing.T) {
+	g := make(DepGraph)
+	g["app"] = []string{"base", "consul"}
+	g["base"] = []string{"consul"}
+	g["consul"] = []string{}
+
+	r := g.Reverse()
+	assert.Equal(t, r["consul"], []string{"app", "base"})
+	assert.Equal(t, r["base"], []string{"app"})
+	assert.Equal(t, r["app"], []string{})
+}
+
+func TestOrderRejectsCycle(t *testing.T) {
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"SPEC.yml", "specVersion: 0.1.0\nspec:\n  name: crafted\n  version: 1.0\n"},
+		{"DEPS", "this: [a]\na: [b]\nb: [a]\n"},
+	}
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, f := range files {
+		err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))})
+		assert.NoError(t, err)
+		_, err = tw.Write([]byte(f.content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+
+	p := &Package{buf.Bytes()}
+	order, err := p.Order()
+	assert.Nil(t, order)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Dependency cycle detected:")
+	// the walk may enter the cycle at either package
+	assert.True(t, strings.HasSuffix(err.Error(), "a -> b -> a") ||
+		strings.HasSuffix(err.Error(), "b -> a -> b"))
+}
+
+func TestShortHash(t *testing.T) {
+	assert.Equal(t, ShortHash("0123456789abcdef"), "01234567")
+	assert.Equal(t, ShortHash("abc"), "abc")
+	assert.Equal(t, Describe("abc"), "abc")
+}
@@ -0,0 +1,27 @@
+package build
+
+// Composition types, telling how the composition of a package is deployed.
+const (
+	// ComposeType compositions are compose files brought up
+	// on the exported machine. It is the default.
+	ComposeType = "docker-compose"
+	// KubernetesType compositions are Kubernetes manifests, a file or a
+	// directory of them, or a compose file converted to manifests,
+	// applied to a cluster.
+	KubernetesType = "kubernetes"
+	// ContainerdType compositions are lists of services run
+	// with containerd on the exported machine.
+	ContainerdType = "containerd"
+)
+
+var CompositionTypes = []string{ComposeType, KubernetesType, ContainerdType}
+
+// Kubernetes tells which cluster of the kubeconfig a kubernetes composition
+// is applied to. The kubeconfig is $KUBECONFIG, or ~/.kube/config.
+type Kubernetes struct {
+	// Context of the kubeconfig, its current context if not set.
+	Context string `yaml:"context,omitempty"`
+	// Namespace of objects not setting theirs, the namespace
+	// of the context if not set, or default.
+	Namespace string `yaml:"namespace,omitempty"`
+}
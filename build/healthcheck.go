@@ -0,0 +1,64 @@
+package build
+
+import (
+	"fmt"
+	"time"
+)
+
+// HealthCheck tells when the package is ready to serve its dependents.
+// Exactly one of HTTP, TCP, Command and Service is set.
+type HealthCheck struct {
+	// HTTP is a URL answering GET with a 2xx or 3xx status when ready.
+	HTTP string `yaml:"http,omitempty"`
+	// TCP is a host:port accepting connections when ready.
+	TCP string `yaml:"tcp,omitempty"`
+	// Command is run with sh in the package workspace, exiting 0 when ready.
+	Command string `yaml:"command,omitempty"`
+	// Service is a compose service, ready when its containers are
+	// healthy, or running if they have no health check.
+	Service string `yaml:"service,omitempty"`
+
+	// Timeout to wait for, 2m if not set.
+	Timeout string `yaml:"timeout,omitempty"`
+	// Interval between checks, 5s if not set.
+	Interval string `yaml:"interval,omitempty"`
+}
+
+const (
+	DefaultHealthTimeout  = 2 * time.Minute
+	DefaultHealthInterval = 5 * time.Second
+)
+
+// Validate checks that exactly one kind of check is set and durations are valid.
+func (h *HealthCheck) Validate() error {
+	n := 0
+	for _, s := range []string{h.HTTP, h.TCP, h.Command, h.Service} {
+		if s != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("healthcheck must have exactly one of http, tcp, command and service")
+	}
+	_, _, err := h.Durations()
+	return err
+}
+
+// Durations returns the timeout and interval of the check.
+func (h *HealthCheck) Durations() (time.Duration, time.Duration, error) {
+	timeout, interval := DefaultHealthTimeout, DefaultHealthInterval
+	var err error
+	if h.Timeout != "" {
+		timeout, err = time.ParseDuration(h.Timeout)
+		if err != nil || timeout <= 0 {
+			return 0, 0, fmt.Errorf("healthcheck timeout '%s' is not a valid duration", h.Timeout)
+		}
+	}
+	if h.Interval != "" {
+		interval, err = time.ParseDuration(h.Interval)
+		if err != nil || interval <= 0 {
+			return 0, 0, fmt.Errorf("healthcheck interval '%s' is not a valid duration", h.Interval)
+		}
+	}
+	return timeout, interval, nil
+}
@@ -0,0 +1,48 @@
+package build
+
+import (
+	"fmt"
+	"time"
+)
+
+// Hook is a command run by dpm at a point of the package lifecycle.
+type Hook struct {
+	Command string `schema:"required"`
+	// Timeout is a duration like 30s or 5m, 5m if not set.
+	Timeout string
+	// OnFailure tells whether a failing hook aborts the operation, the default,
+	// or only prints a warning.
+	OnFailure string `yaml:"on-failure,omitempty" schema:"enum=@hook-failures"`
+}
+
+// Hooks are commands of the package, run in its workspace.
+type Hooks struct {
+	PreInstall  []Hook `yaml:"pre-install,omitempty"`
+	PostInstall []Hook `yaml:"post-install,omitempty"`
+	PreRemove   []Hook `yaml:"pre-remove,omitempty"`
+	PostRemove  []Hook `yaml:"post-remove,omitempty"`
+	PostUpgrade []Hook `yaml:"post-upgrade,omitempty"`
+}
+
+const (
+	Abort = "abort"
+	Warn  = "warn"
+)
+
+// HookFailures are the values of on-failure.
+var HookFailures = []string{Abort, Warn}
+
+// DefaultHookTimeout is the timeout of a hook not setting one.
+const DefaultHookTimeout = 5 * time.Minute
+
+// Duration returns the timeout of the hook.
+func (h Hook) Duration() (time.Duration, error) {
+	if h.Timeout == "" {
+		return DefaultHookTimeout, nil
+	}
+	d, err := time.ParseDuration(h.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("timeout '%s' of hook '%s' is not a valid duration", h.Timeout, h.Command)
+	}
+	return d, nil
+}
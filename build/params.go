@@ -0,0 +1,136 @@
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Parameter is a value of the package supplied at install time.
+// A parameter without a type is a string.
+type Parameter struct {
+	Type        string `schema:"enum=@parameter-types"`
+	Default     string
+	Description string
+	Required    bool
+	// Secret values are kept encrypted in the installation state.
+	Secret bool `yaml:",omitempty"`
+}
+
+// ParameterTypes are the types a parameter can have.
+var ParameterTypes = []string{"boolean", "number", "string"}
+
+// Check tells if the value is valid for the type of the parameter.
+func (p Parameter) Check(value string) error {
+	switch p.Type {
+	case "", "string":
+		return nil
+	case "number":
+		_, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a number", value)
+		}
+	case "boolean":
+		_, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a boolean", value)
+		}
+	default:
+		return fmt.Errorf("unknown type '%s'", p.Type)
+	}
+	return nil
+}
+
+// ParamEnv returns the environment variable name of a parameter,
+// upper cased with characters other than letters and digits turned into '_'.
+// So parameter node-count is available as ${NODE_COUNT} in the composition.
+func ParamEnv(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// CheckParamEnvs tells if two parameters of the package have the same
+// environment variable, as node-count and node_count do, one hiding the other.
+func (s *Spec) CheckParamEnvs() error {
+	names := []string{}
+	for name := range s.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	envs := map[string]string{}
+	for _, name := range names {
+		env := ParamEnv(name)
+		if other, exist := envs[env]; exist {
+			return fmt.Errorf("parameters %s and %s are both passed as %s", other, name, env)
+		}
+		envs[env] = name
+	}
+	return nil
+}
+
+// ResolveParameters checks the values supplied for parameters of the package
+// and fills in defaults. Missing required parameters are all reported at once.
+func (s *Spec) ResolveParameters(values map[string]string) (map[string]string, error) {
+	err := s.CheckParamEnvs()
+	if err != nil {
+		return nil, fmt.Errorf("Package %s: %s", s.Name, err)
+	}
+	for name := range values {
+		if _, exist := s.Parameters[name]; !exist {
+			return nil, fmt.Errorf("Package %s has no parameter '%s'", s.Name, name)
+		}
+	}
+
+	names := []string{}
+	for name := range s.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := map[string]string{}
+	missing := []string{}
+	for _, name := range names {
+		p := s.Parameters[name]
+		value, exist := values[name]
+		if !exist {
+			if p.Required {
+				missing = append(missing, name)
+				continue
+			}
+			value = p.Default
+			if value == "" {
+				result[name] = value
+				continue
+			}
+		}
+		err := p.Check(value)
+		if err != nil {
+			return nil, fmt.Errorf("Parameter %s of package %s: %s", name, s.Name, err)
+		}
+		result[name] = value
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Package %s requires parameters: %s", s.Name, strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+// DefaultParameters returns the default values of all parameters,
+// used where no values are supplied, as when building the package.
+func (s *Spec) DefaultParameters() map[string]string {
+	result := map[string]string{}
+	for name, p := range s.Parameters {
+		result[name] = p.Default
+	}
+	return result
+}
@@ -0,0 +1,58 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveParameters(t *testing.T) {
+	spec := &Spec{
+		Name: "test",
+		Parameters: map[string]Parameter{
+			"region": {Default: "nyc3"},
+			"nodes":  {Type: "number", Default: "3"},
+			"token":  {Required: true},
+			"secure": {Type: "boolean", Required: true},
+			"label":  {},
+		},
+	}
+
+	_, err := spec.ResolveParameters(map[string]string{})
+	assert.EqualError(t, err, "Package test requires parameters: secure, token")
+
+	_, err = spec.ResolveParameters(map[string]string{"token": "t", "secure": "yes"})
+	assert.EqualError(t, err, "Parameter secure of package test: 'yes' is not a boolean")
+
+	_, err = spec.ResolveParameters(map[string]string{"token": "t", "secure": "true", "zone": "a"})
+	assert.EqualError(t, err, "Package test has no parameter 'zone'")
+
+	params, err := spec.ResolveParameters(map[string]string{"token": "t", "secure": "true", "nodes": "5"})
+	assert.NoError(t, err)
+	assert.Equal(t, params, map[string]string{
+		"region": "nyc3",
+		"nodes":  "5",
+		"token":  "t",
+		"secure": "true",
+		"label":  "",
+	})
+}
+
+func TestCheckParamEnvs(t *testing.T) {
+	assert.Equal(t, ParamEnv("node-count"), "NODE_COUNT")
+
+	spec := &Spec{
+		Name: "test",
+		Parameters: map[string]Parameter{
+			"node_count": {},
+			"node-count": {},
+			"size":       {},
+		},
+	}
+	assert.EqualError(t, spec.CheckParamEnvs(), "parameters node-count and node_count are both passed as NODE_COUNT")
+	_, err := spec.ResolveParameters(nil)
+	assert.EqualError(t, err, "Package test: parameters node-count and node_count are both passed as NODE_COUNT")
+
+	delete(spec.Parameters, "node_count")
+	assert.NoError(t, spec.CheckParamEnvs())
+}
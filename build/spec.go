@@ -0,0 +1,148 @@
+package build
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SpecVersion is the newest version of SPEC.yml format.
+const SpecVersion = "0.2.0"
+
+// migration upgrades SPEC.yml content to the next version.
+type migration struct {
+	to    string
+	apply func(content []byte) ([]byte, error)
+}
+
+// migrations are keyed by the version they upgrade from.
+var migrations = map[string]migration{
+	"0.1.0": {"0.2.0", migrate010},
+}
+
+// MigrateSpec upgrades SPEC.yml content of any supported version
+// to the newest version. It returns the migrated content
+// and the version migrated from.
+func MigrateSpec(content []byte) ([]byte, string, error) {
+	// a string keeps the version as written, 0.10 is not 0.1
+	header := struct {
+		SpecVersion string `yaml:"specVersion"`
+	}{}
+	err := yaml.Unmarshal(content, &header)
+	if err != nil {
+		return nil, "", err
+	}
+	if header.SpecVersion == "" {
+		return nil, "", fmt.Errorf("SPEC.yml has no specVersion")
+	}
+
+	version := header.SpecVersion
+	from := version
+	for version != SpecVersion {
+		m, exist := migrations[version]
+		if !exist {
+			return nil, from, fmt.Errorf("Spec version '%s' is not supported.", from)
+		}
+		content, err = m.apply(content)
+		if err != nil {
+			return nil, from, fmt.Errorf("Cannot migrate spec from version %s to %s: %s", version, m.to, err)
+		}
+		version = m.to
+	}
+	return content, from, nil
+}
+
+// ParseSpec reads SPEC.yml content of any supported version
+// into the current model.
+func ParseSpec(content []byte) (*Spec, error) {
+	migrated, _, err := MigrateSpec(content)
+	if err != nil {
+		return nil, err
+	}
+
+	root := Root{}
+	err = yaml.Unmarshal(migrated, &root)
+	if err != nil {
+		return nil, err
+	}
+	if root.Spec == nil {
+		return nil, fmt.Errorf("SPEC.yml has no spec section")
+	}
+	return root.Spec, nil
+}
+
+// spec010 is the spec section of SPEC.yml 0.1.0. Fields are strings,
+// so values are kept as written: version 1.0 is not the number 1.
+type spec010 struct {
+	Name         string            `yaml:",omitempty"`
+	Version      string            `yaml:",omitempty"`
+	Provision    string            `yaml:",omitempty"`
+	Composition  string            `yaml:",omitempty"`
+	Title        string            `yaml:",omitempty"`
+	Description  string            `yaml:",omitempty"`
+	Dirs         []string          `yaml:",omitempty"`
+	Dependencies map[string]string `yaml:",omitempty"` // in `"package": version=number` format
+}
+
+// spec020 is spec010 with dependencies as mappings.
+type spec020 struct {
+	Name         string                       `yaml:",omitempty"`
+	Version      string                       `yaml:",omitempty"`
+	Provision    string                       `yaml:",omitempty"`
+	Composition  string                       `yaml:",omitempty"`
+	Title        string                       `yaml:",omitempty"`
+	Description  string                       `yaml:",omitempty"`
+	Dirs         []string                     `yaml:",omitempty"`
+	Dependencies map[string]map[string]string `yaml:",omitempty"`
+}
+
+// migrate010 turns dependencies from attribute strings,
+// as in `consul: version=1.0`, into mappings. Attributes
+// other than version are dropped, as Dependency has no other field.
+func migrate010(content []byte) ([]byte, error) {
+	old := struct {
+		Spec *spec010
+	}{}
+	err := yaml.Unmarshal(content, &old)
+	if err != nil {
+		return nil, err
+	}
+
+	migrated := struct {
+		SpecVersion string   `yaml:"specVersion"`
+		Spec        *spec020 `yaml:",omitempty"`
+	}{SpecVersion: "0.2.0"}
+	if s := old.Spec; s != nil {
+		migrated.Spec = &spec020{
+			Name:        s.Name,
+			Version:     s.Version,
+			Provision:   s.Provision,
+			Composition: s.Composition,
+			Title:       s.Title,
+			Description: s.Description,
+			Dirs:        s.Dirs,
+		}
+		for name, attributes := range s.Dependencies {
+			attrs, err := parse(attributes)
+			if err != nil {
+				return nil, err
+			}
+
+			// other attributes, like platform, were never used
+			dependency := map[string]string{}
+			if version, exist := attrs["version"]; exist {
+				dependency["version"] = version
+			}
+			if migrated.Spec.Dependencies == nil {
+				migrated.Spec.Dependencies = map[string]map[string]string{}
+			}
+			migrated.Spec.Dependencies[name] = dependency
+		}
+	}
+
+	out, err := yaml.Marshal(migrated)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("---\n"), out...), nil
+}
@@ -0,0 +1,116 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateSpec010(t *testing.T) {
+	content := []byte(`---
+specVersion: 0.1.0
+spec:
+  name: test
+  version: 0.1.0
+  dependencies:
+    pack1: version=1.0
+    pack2: version=2.0 platform=do
+`)
+	migrated, from, err := MigrateSpec(content)
+	assert.NoError(t, err)
+	assert.Equal(t, from, "0.1.0")
+	assert.Equal(t, string(migrated), `---
+specVersion: 0.2.0
+spec:
+  name: test
+  version: 0.1.0
+  dependencies:
+    pack1:
+      version: "1.0"
+    pack2:
+      version: "2.0"
+`)
+
+	spec, err := ParseSpec(content)
+	assert.NoError(t, err)
+	assert.Equal(t, spec.Dependencies["pack2"].Version, "2.0")
+}
+
+func TestMigrateSpec010Attributes(t *testing.T) {
+	migrated, _, err := MigrateSpec([]byte(`---
+specVersion: 0.1.0
+spec:
+  name: test
+  version: 0.1.0
+  dependencies:
+    pack1: platform=do version=1.0 instances=2
+`))
+	assert.NoError(t, err)
+	// only versions are kept, as Dependency has no other field
+	assert.Equal(t, string(migrated), `---
+specVersion: 0.2.0
+spec:
+  name: test
+  version: 0.1.0
+  dependencies:
+    pack1:
+      version: "1.0"
+`)
+
+	// a dependency with no version is still loaded, lint reports it
+	spec, err := ParseSpec([]byte(`---
+specVersion: 0.1.0
+spec:
+  dependencies:
+    pack1: platform=do
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, spec.Dependencies["pack1"].Version, "")
+}
+
+func TestMigrateSpec010Scalars(t *testing.T) {
+	content := []byte(`---
+specVersion: 0.1.0
+spec:
+  name: test
+  version: 1.0
+  title: yes
+  description: 1e3
+`)
+	migrated, _, err := MigrateSpec(content)
+	assert.NoError(t, err)
+	// values are kept as written, not as the numbers or booleans they look like
+	assert.Equal(t, string(migrated), `---
+specVersion: 0.2.0
+spec:
+  name: test
+  version: "1.0"
+  title: "yes"
+  description: "1e3"
+`)
+
+	spec, err := ParseSpec(content)
+	assert.NoError(t, err)
+	assert.Equal(t, spec.Version, "1.0")
+	assert.Equal(t, spec.Title, "yes")
+	assert.Equal(t, spec.Description, "1e3")
+}
+
+func TestMigrateSpecCurrent(t *testing.T) {
+	content := []byte("specVersion: 0.2.0\nspec:\n  name: test\n")
+	migrated, from, err := MigrateSpec(content)
+	assert.NoError(t, err)
+	assert.Equal(t, from, SpecVersion)
+	assert.Equal(t, migrated, content)
+}
+
+func TestMigrateSpecUnsupported(t *testing.T) {
+	_, _, err := MigrateSpec([]byte("specVersion: 0.0.1\nspec: {}\n"))
+	assert.EqualError(t, err, "Spec version '0.0.1' is not supported.")
+
+	_, _, err = MigrateSpec([]byte("spec:\n  name: test\n"))
+	assert.EqualError(t, err, "SPEC.yml has no specVersion")
+
+	_, err = ParseSpec([]byte("specVersion: 0.2.0\n"))
+	assert.EqualError(t, err, "SPEC.yml has no spec section")
+}
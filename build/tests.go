@@ -0,0 +1,40 @@
+package build
+
+import (
+	"fmt"
+	"time"
+)
+
+// Test is a command checking the installed package, run by dpm test
+// in the package workspace with the environment of its hooks.
+// It passes when it exits 0.
+type Test struct {
+	// Name of the test in reports, its command if not set.
+	Name    string `yaml:",omitempty"`
+	Command string `schema:"required"`
+	// Timeout is a duration like 30s or 5m, 1m if not set.
+	Timeout string `yaml:",omitempty"`
+}
+
+// DefaultTestTimeout is the timeout of a test not setting one.
+const DefaultTestTimeout = time.Minute
+
+// Title returns the name of the test, or its command.
+func (t Test) Title() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.Command
+}
+
+// Duration returns the timeout of the test.
+func (t Test) Duration() (time.Duration, error) {
+	if t.Timeout == "" {
+		return DefaultTestTimeout, nil
+	}
+	d, err := time.ParseDuration(t.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("timeout '%s' of test '%s' is not a valid duration", t.Timeout, t.Title())
+	}
+	return d, nil
+}
@@ -1,5 +1,26 @@
 package build
 
+import "sort"
+
+// dangling returns a package of the graph depending on a package
+// which is not in the graph, and that dependency, if any.
+// The graph must not have such dependencies to be sorted.
+func dangling(g DepGraph) (string, string, bool) {
+	nodes := []string{}
+	for n := range g {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+	for _, n := range nodes {
+		for _, m := range g[n] {
+			if _, exist := g[m]; !exist {
+				return n, m, true
+			}
+		}
+	}
+	return "", "", false
+}
+
 func toposort(g DepGraph) (order, cyclic []string) {
 	L := make([]string, len(g))
 	i := 0
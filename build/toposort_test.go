@@ -1,8 +1,12 @@
 package build
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestToposort(t *testing.T) {
@@ -20,3 +24,48 @@ func TestToposort(t *testing.T) {
 func TestToposortDependencies(t *testing.T) {
 
 }
+
+func TestToposortCycle(t *testing.T) {
+	g := make(DepGraph)
+	g["x"] = []string{"a"}
+	g["a"] = []string{"b"}
+	g["b"] = []string{"c"}
+	g["c"] = []string{"a"}
+	order, cyclic := toposort(g)
+	assert.Nil(t, order)
+	assert.Equal(t, len(cyclic), 3)
+
+	err := cycleError([]string{"c", "b", "a"}, func(n string) string {
+		return n + ":1.0"
+	})
+	assert.EqualError(t, err, "Dependency cycle detected: a:1.0 -> b:1.0 -> c:1.0 -> a:1.0")
+
+	err = cycleError([]string{"a"}, func(n string) string { return n })
+	assert.EqualError(t, err, "Dependency cycle detected: a -> a")
+}
+
+func TestToposortDangling(t *testing.T) {
+	g := make(DepGraph)
+	g["this"] = []string{"abc"}
+	_, _, found := dangling(g)
+	assert.True(t, found)
+	err := danglingError(g, func(n string) string { return n })
+	assert.EqualError(t, err, "Dependency abc of this is missing from DEPS")
+
+	g["abc"] = []string{}
+	_, _, found = dangling(g)
+	assert.False(t, found)
+
+	// a crafted package is rejected on load
+	content := "this: [abc]\n"
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "DEPS", Mode: 0644, Size: int64(len(content))}))
+	_, err = tw.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+
+	order, err := (&Package{buf.Bytes()}).Order()
+	assert.Nil(t, order)
+	assert.EqualError(t, err, "Dependency abc of "+(&Package{buf.Bytes()}).Sha256()[0:8]+" is missing from DEPS")
+}
@@ -0,0 +1,145 @@
+package composition
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/provision"
+)
+
+// dockerCompose composes the project with the docker-compose command.
+type dockerCompose struct {
+	s *Spec
+}
+
+func (s *Spec) command(ctx context.Context, args ...string) (*exec.Cmd, error) {
+	env, err := s.env()
+	if err != nil {
+		return nil, err
+	}
+
+	args = append([]string{
+		"-p", s.projectName,
+		"-f", s.compositionFile}, args...)
+	cmd := exec.CommandContext(ctx, "docker-compose", args...)
+	cmd.Env = env
+	cmd.Dir = s.dir()
+	return cmd, nil
+}
+
+// attach runs docker-compose with the terminal attached.
+func (s *Spec) attach(ctx context.Context, args ...string) error {
+	cmd, err := s.command(ctx, args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (d *dockerCompose) Up(ctx context.Context) error {
+	return d.s.attach(ctx, "up", "-d")
+}
+
+func (d *dockerCompose) Down(ctx context.Context) error {
+	return d.s.attach(ctx, "down")
+}
+
+func (d *dockerCompose) Running(ctx context.Context) (bool, error) {
+	cmd, err := d.s.command(ctx, "ps", "-q")
+	if err != nil {
+		return false, err
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) != "", nil
+}
+
+func (d *dockerCompose) States(ctx context.Context) (map[string][]string, error) {
+	result := map[string][]string{}
+	cmd, err := d.s.command(ctx, "ps", "-q")
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	ids := strings.Fields(string(out))
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	args := append([]string{"inspect", "-f",
+		`{{index .Config.Labels "com.docker.compose.service"}} ` +
+			`{{if .State.Health}}{{.State.Health.Status}}{{else}}{{.State.Status}}{{end}}`}, ids...)
+	inspect := exec.CommandContext(ctx, "docker", args...)
+	inspect.Env = cmd.Env
+	out, err = inspect.Output()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			result[fields[0]] = append(result[fields[0]], fields[1])
+		}
+	}
+	return result, nil
+}
+
+// requireCompose fails if docker-compose is not installed, or the
+// composition is not a compose file, for commands with no native implementation.
+func (s *Spec) requireCompose() error {
+	switch s.compositionType {
+	case build.KubernetesType:
+		return fmt.Errorf("Package %s is deployed to Kubernetes, use kubectl instead", s.projectName)
+	case build.ContainerdType:
+		return fmt.Errorf("Package %s runs on containerd, use ctr on machine %s instead", s.projectName, s.host)
+	}
+	if s.mode == provision.SwarmMode {
+		return fmt.Errorf("Package %s is deployed as a stack, its containers run across the swarm", s.projectName)
+	}
+	if _, err := exec.LookPath("docker-compose"); err != nil {
+		return fmt.Errorf("docker-compose is required, it is not found in PATH")
+	}
+	return nil
+}
+
+// Logs prints logs of the services, or all services if none given.
+func (s *Spec) Logs(ctx context.Context, follow bool, services ...string) error {
+	if s.mode == provision.SwarmMode && (s.compositionType == "" || s.compositionType == build.ComposeType) {
+		return newStack(s).Logs(ctx, follow, services...)
+	}
+	if err := s.requireCompose(); err != nil {
+		return err
+	}
+	args := []string{"logs"}
+	if follow {
+		args = append(args, "-f")
+	}
+	return s.attach(ctx, append(args, services...)...)
+}
+
+// Exec runs the command in the running container of the service.
+// A TTY is allocated only when dpm runs in a terminal.
+func (s *Spec) Exec(ctx context.Context, service string, command []string) error {
+	if err := s.requireCompose(); err != nil {
+		return err
+	}
+	args := []string{"exec"}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		args = append(args, "-T")
+	}
+	args = append(args, service)
+	return s.attach(ctx, append(args, command...)...)
+}
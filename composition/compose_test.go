@@ -0,0 +1,75 @@
+package composition
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/dpmtest"
+	"github.com/swasd/dpm/provision"
+)
+
+func TestComposeUp(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+	h.FakeCompose()
+	os.Setenv("DPM_COMPOSER", ComposeBackend)
+	defer os.Unsetenv("DPM_COMPOSER")
+
+	err := exec.Command("docker-machine", "-s", filepath.Join(h.Dir, ".dpm"), "create", "--driver", "none", "--url", "tcp://10.0.0.1:2376", "master").Run()
+	assert.NoError(t, err)
+	dir := filepath.Join(h.Dir, ".dpm", "workspace", "abc")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "composition.yml"), []byte("web:\n  image: nginx\n"), 0644))
+
+	s, err := NewProject(provision.ExportedMachine{Name: "master", Mode: provision.Standalone}, "abc",
+		&build.Spec{Name: "web", Composition: "composition.yml"})
+	assert.NoError(t, err)
+	env, err := s.env()
+	assert.NoError(t, err)
+	assert.Contains(t, env, "DOCKER_HOST=tcp://10.0.0.1:2376")
+
+	ctx := context.Background()
+	running, err := s.Running(ctx)
+	assert.NoError(t, err)
+	assert.False(t, running)
+	assert.NoError(t, s.Up(ctx))
+	running, err = s.Running(ctx)
+	assert.NoError(t, err)
+	assert.True(t, running)
+	assert.NoError(t, s.Down(ctx))
+
+	assert.Equal(t, h.Calls("docker-compose"), []string{
+		"-p web -f composition.yml ps -q",
+		"-p web -f composition.yml up -d",
+		"-p web -f composition.yml ps -q",
+		"-p web -f composition.yml down",
+	})
+}
+
+func TestComposeUnknownMachine(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+	h.FakeCompose()
+	os.Setenv("DPM_COMPOSER", ComposeBackend)
+	defer os.Unsetenv("DPM_COMPOSER")
+	// dpm's own Docker must not be used instead
+	os.Setenv("DOCKER_HOST", "tcp://127.0.0.1:2375")
+	defer os.Unsetenv("DOCKER_HOST")
+
+	dir := filepath.Join(h.Dir, ".dpm", "workspace", "1234")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "composition.yml"), []byte("web:\n  image: nginx\n"), 0644))
+
+	s := &Spec{host: "master", hash: "1234", projectName: "web", compositionFile: "composition.yml"}
+	err := s.Up(context.Background())
+	assert.EqualError(t, err, "Cannot get the environment of machine master: exit status 1\nHost does not exist: \"master\"\n")
+	assert.Empty(t, h.Calls("docker-compose"))
+}
@@ -1,6 +1,9 @@
 package composition
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -10,25 +13,75 @@ import (
 	"github.com/swasd/dpm/provision"
 )
 
+// Composer brings a compose project up and down on the exported machine.
+type Composer interface {
+	Up(ctx context.Context) error
+	// Down stops and removes containers and networks of the project.
+	Down(ctx context.Context) error
+	// Running tells if the project has any running containers.
+	Running(ctx context.Context) (bool, error)
+	// States returns, by service, the health of containers of the project,
+	// or their state if they have no health check.
+	States(ctx context.Context) (map[string][]string, error)
+}
+
+// Backends implementing Composer for compose files, chosen with the DPM_COMPOSER
+// variable. Without it, docker-compose is used if installed, otherwise the native
+// backend. Compose files of swarm-mode clusters are deployed as stacks. Kubernetes
+// and containerd compositions have a backend of their own.
+const (
+	ComposeBackend = "docker-compose"
+	NativeBackend  = "native"
+)
+
 type Spec struct {
 	host            string
 	mode            provision.ExportedMode
 	hash            string
 	projectName     string
 	compositionFile string
+	compositionType string
+	kubernetes      build.Kubernetes
+
+	// Params are values of the package parameters, passed to
+	// docker-compose as environment variables, see build.ParamEnv.
+	Params map[string]string
 }
 
 func NewProject(em provision.ExportedMachine, hash string, s *build.Spec) (*Spec, error) {
-	return &Spec{em.Name, em.Mode, hash, s.Name, s.Composition}, nil
+	spec := &Spec{
+		host:            em.Name,
+		mode:            em.Mode,
+		hash:            hash,
+		projectName:     s.Name,
+		compositionFile: s.Composition,
+		compositionType: s.CompositionType,
+	}
+	if s.Kubernetes != nil {
+		spec.kubernetes = *s.Kubernetes
+	}
+	return spec, nil
 }
 
 func (s *Spec) GetHostEnv() ([]string, error) {
+	h, err := provision.LoadHost(s.host)
+	if err != nil {
+		return nil, err
+	}
+	if h != nil {
+		return h.Env(), nil
+	}
+
+	// without the machine, there is no Docker to talk to,
+	// dpm's own DOCKER_HOST or the local one would be a guess
 	result := []string{}
 	cmd := exec.Command("docker-machine",
 		"-s", dpmHome(), "env", "--shell", "sh", s.host)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
 	out, err := cmd.Output()
 	if err != nil {
-		return []string{}, nil
+		return nil, fmt.Errorf("Cannot get the environment of machine %s: %s\n%s", s.host, err, stderr)
 	}
 
 	lines := strings.Split(string(out), "\n")
@@ -48,34 +101,150 @@ func dpmHome() string {
 	return filepath.Join(home, ".dpm")
 }
 
-func (s *Spec) Up() error {
-	home := os.Getenv("HOME")
-	dir := filepath.Join(home, ".dpm", "workspace", s.hash)
+func (s *Spec) dir() string {
+	return filepath.Join(dpmHome(), "workspace", s.hash)
+}
 
-	info, err := os.Stat(filepath.Join(dir, s.compositionFile))
+// env returns the environment of commands and of the compose file
+// interpolation: dpm's own, the host env and parameters.
+func (s *Spec) env() ([]string, error) {
+	hostEnv, err := s.GetHostEnv()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	env := []string{}
+	for _, e := range os.Environ() {
+		// the machine tells which Docker to talk to
+		if !strings.HasPrefix(e, "DOCKER_") {
+			env = append(env, e)
+		}
+	}
+	env = append(env, hostEnv...)
+	return append(env, s.paramEnvs()...), nil
+}
+
+// paramsEnv returns dpm's own environment and parameters, for backends
+// that do not talk to the Docker Engine of the machine.
+func (s *Spec) paramsEnv() []string {
+	return append(os.Environ(), s.paramEnvs()...)
+}
+
+func (s *Spec) paramEnvs() []string {
+	env := []string{}
+	for k, v := range s.Params {
+		env = append(env, build.ParamEnv(k)+"="+v)
+	}
+	return env
+}
+
+// composer returns the backend composing the project.
+func (s *Spec) composer() (Composer, error) {
+	switch s.compositionType {
+	case "", build.ComposeType:
+		if s.mode == provision.SwarmMode {
+			return newStack(s), nil
+		}
+	case build.KubernetesType:
+		return newKubernetes(s)
+	case build.ContainerdType:
+		return newContainerd(s)
+	default:
+		return nil, fmt.Errorf("Unknown composition type '%s'", s.compositionType)
+	}
+
+	backend := os.Getenv("DPM_COMPOSER")
+	if backend == "" {
+		backend = ComposeBackend
+		if _, err := exec.LookPath("docker-compose"); err != nil {
+			backend = NativeBackend
+		}
+	}
+
+	switch backend {
+	case ComposeBackend:
+		return &dockerCompose{s}, nil
+	case NativeBackend:
+		return newNative(s)
 	}
+	return nil, fmt.Errorf("Unknown composer backend '%s'", backend)
+}
 
-	if info.Size() == int64(0) {
+func (s *Spec) Up(ctx context.Context) error {
+	empty, err := s.empty()
+	if err != nil {
+		return err
+	}
+	if empty {
 		// peacefully skip
 		return nil
 	}
 
-	env, err := s.GetHostEnv()
+	c, err := s.composer()
 	if err != nil {
 		return err
 	}
+	return c.Up(ctx)
+}
+
+// Down stops and removes containers and networks of the project.
+func (s *Spec) Down(ctx context.Context) error {
+	empty, err := s.empty()
+	if err != nil || empty {
+		return err
+	}
+
+	c, err := s.composer()
+	if err != nil {
+		return err
+	}
+	return c.Down(ctx)
+}
+
+// Running tells if the project has any running containers.
+func (s *Spec) Running(ctx context.Context) (bool, error) {
+	empty, err := s.empty()
+	if err != nil || empty {
+		return false, err
+	}
 
-	cmd := exec.Command("docker-compose",
-		"-p", s.projectName,
-		"-f", s.compositionFile,
-		"up", "-d")
-	cmd.Env = env
-	cmd.Dir = dir
-	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
+	c, err := s.composer()
+	if err != nil {
+		return false, err
+	}
+	return c.Running(ctx)
+}
+
+// States returns, by service, the health of containers of the project,
+// or their state if they have no health check.
+func (s *Spec) States(ctx context.Context) (map[string][]string, error) {
+	empty, err := s.empty()
+	if err != nil || empty {
+		return map[string][]string{}, err
+	}
 
-	return cmd.Run()
+	c, err := s.composer()
+	if err != nil {
+		return nil, err
+	}
+	return c.States(ctx)
+}
+
+// ServiceStates returns the health of containers of the service,
+// or their state if they have no health check.
+func (s *Spec) ServiceStates(ctx context.Context, service string) ([]string, error) {
+	states, err := s.States(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return states[service], nil
+}
+
+// empty tells if the composition file has nothing to compose.
+// A directory of manifests is never empty.
+func (s *Spec) empty() (bool, error) {
+	info, err := os.Stat(filepath.Join(s.dir(), s.compositionFile))
+	if err != nil {
+		return false, err
+	}
+	return !info.IsDir() && info.Size() == int64(0), nil
 }
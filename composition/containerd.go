@@ -0,0 +1,391 @@
+package composition
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/swasd/dpm/provision"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ContainerdNamespace is the containerd namespace of containers run by dpm.
+const ContainerdNamespace = "dpm"
+
+// Labels of containers run on containerd.
+const (
+	containerdProjectLabel = "dpm.project"
+	containerdServiceLabel = "dpm.service"
+	containerdConfigLabel  = "dpm.config-hash"
+)
+
+// ContainerdFile is the composition of a containerd package,
+// a list of services run with the host network.
+type ContainerdFile struct {
+	Services map[string]*ContainerdService
+}
+
+type ContainerdService struct {
+	Image   string
+	Command []string
+	Env     map[string]string
+	// Mounts are bind mounts, /host/path:/container/path[:ro]
+	Mounts []string
+	// Ports the service listens on. Containers use the host network,
+	// so a published port must be the container port.
+	Ports []string
+}
+
+// ParseContainerdFile reads a containerd composition, interpolating
+// variables with the environment given as KEY=VALUE entries.
+func ParseContainerdFile(content []byte, env []string) (*ContainerdFile, error) {
+	f := &ContainerdFile{}
+	err := yaml.Unmarshal(interpolate(content, env), f)
+	if err != nil {
+		return nil, err
+	}
+	for name, s := range f.Services {
+		if s == nil || s.Image == "" {
+			return nil, fmt.Errorf("services.%s.image is required", name)
+		}
+		for _, p := range s.Ports {
+			port, binding, err := parsePort(p)
+			if err != nil {
+				return nil, fmt.Errorf("services.%s.ports: %s", name, err)
+			}
+			if binding != nil && binding.HostPort+"/"+strings.SplitN(port, "/", 2)[1] != port {
+				return nil, fmt.Errorf("services.%s.ports: %s cannot be mapped, containerd services use the host network", name, p)
+			}
+		}
+		for _, m := range s.Mounts {
+			parts := strings.Split(m, ":")
+			if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "ro" && parts[2] != "rw") {
+				return nil, fmt.Errorf("services.%s.mounts: invalid mount %s", name, m)
+			}
+		}
+	}
+	return f, nil
+}
+
+// containerd runs the services with ctr, the containerd client,
+// on the exported machine.
+//
+// The containerd gRPC client is not used: it needs a far newer Go than
+// the go1.7 dpm is built with, and grpc, protobuf and ttrpc among the
+// dependencies. All ctr calls go through the ctr field, which a client
+// would replace.
+type containerd struct {
+	s       *Spec
+	project string
+	// ctr runs ctr with the arguments and returns its output
+	ctr func(ctx context.Context, args ...string) (string, error)
+}
+
+func newContainerd(s *Spec) (Composer, error) {
+	c := &containerd{s: s, project: projectName(s.projectName)}
+	c.ctr = c.ssh
+	return c, nil
+}
+
+// ssh runs ctr on the machine through docker-machine ssh,
+// or directly on existing hosts. sudo must not ask for a password,
+// there is no terminal to answer it.
+func (c *containerd) ssh(ctx context.Context, args ...string) (string, error) {
+	command := []string{"sudo", "-n", "ctr", "-n", ContainerdNamespace}
+	for _, arg := range args {
+		command = append(command, "'"+strings.Replace(arg, "'", `'\''`, -1)+"'")
+	}
+	h, err := provision.LoadHost(c.s.host)
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.CommandContext(ctx, "docker-machine", "-s", dpmHome(), "ssh", c.s.host, strings.Join(command, " "))
+	if h != nil {
+		cmd = h.Command(ctx, strings.Join(command, " "))
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ctr %s on %s failed: %s\n%s", args[0], c.s.host, err, out)
+	}
+	return string(out), nil
+}
+
+func (c *containerd) file() (*ContainerdFile, error) {
+	content, err := ioutil.ReadFile(filepath.Join(c.s.dir(), c.s.compositionFile))
+	if err != nil {
+		return nil, err
+	}
+	f, err := ParseContainerdFile(content, c.s.paramsEnv())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", c.s.compositionFile, err)
+	}
+	return f, nil
+}
+
+func (c *containerd) id(service string) string {
+	return c.project + "_" + service
+}
+
+// normalizeImage returns the fully qualified reference containerd needs,
+// as docker completes it: nginx is docker.io/library/nginx:latest.
+func normalizeImage(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	switch {
+	case len(parts) == 1:
+		image = "docker.io/library/" + image
+	case !strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost":
+		image = "docker.io/" + image
+	}
+	if !strings.Contains(image, "@") && strings.LastIndex(image, ":") < strings.LastIndex(image, "/") {
+		image += ":latest"
+	}
+	return image
+}
+
+// runArgs returns arguments of ctr run for the service,
+// and the hash of its configuration, labelling the container.
+func (c *containerd) runArgs(name string, s *ContainerdService) ([]string, string) {
+	image := normalizeImage(s.Image)
+	args := []string{"run", "-d", "--net-host"}
+
+	keys := []string{}
+	for k := range s.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--env", k+"="+s.Env[k])
+	}
+	for _, m := range s.Mounts {
+		parts := strings.Split(m, ":")
+		options := "rbind:rw"
+		if len(parts) == 3 {
+			options = "rbind:" + parts[2]
+		}
+		source := parts[0]
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(c.s.dir(), source)
+		}
+		args = append(args, "--mount", "type=bind,src="+source+",dst="+parts[1]+",options="+options)
+	}
+
+	content, _ := json.Marshal(append(append(args, image), s.Command...))
+	hash := fmt.Sprintf("%x", sha256.Sum256(content))
+	args = append(args,
+		"--label", containerdProjectLabel+"="+c.project,
+		"--label", containerdServiceLabel+"="+name,
+		"--label", containerdConfigLabel+"="+hash)
+	args = append(args, image, c.id(name))
+	return append(args, s.Command...), hash
+}
+
+// requirements checks ctr can run on the machine,
+// before anything is changed there.
+func (c *containerd) requirements(ctx context.Context) error {
+	_, err := c.ctr(ctx, "version")
+	if err != nil {
+		return fmt.Errorf("containerd compositions need ctr and passwordless sudo on machine %s: %s", c.s.host, err)
+	}
+	return nil
+}
+
+// tasks returns the status of tasks by container id, lower cased.
+// Columns are found by the header of ctr's table, TASK PID STATUS.
+func (c *containerd) tasks(ctx context.Context) (map[string]string, error) {
+	out, err := c.ctr(ctx, "tasks", "ls")
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	id, status := -1, -1
+	for i, column := range strings.Fields(lines[0]) {
+		switch column {
+		case "TASK":
+			id = i
+		case "STATUS":
+			status = i
+		}
+	}
+	if id < 0 || status < 0 {
+		return nil, fmt.Errorf("Cannot read tasks of %s, unexpected ctr output: %s", c.s.host, lines[0])
+	}
+	result := map[string]string{}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) <= id || len(fields) <= status {
+			continue
+		}
+		result[fields[id]] = strings.ToLower(fields[status])
+	}
+	return result, nil
+}
+
+// labels returns labels of the container, nil if it does not exist.
+func (c *containerd) labels(ctx context.Context, id string) (map[string]string, error) {
+	out, err := c.ctr(ctx, "containers", "ls", "-q")
+	if err != nil {
+		return nil, err
+	}
+	exist := false
+	for _, line := range strings.Fields(out) {
+		exist = exist || line == id
+	}
+	if !exist {
+		return nil, nil
+	}
+
+	out, err = c.ctr(ctx, "containers", "info", id)
+	if err != nil {
+		return nil, err
+	}
+	info := struct{ Labels map[string]string }{}
+	err = json.Unmarshal([]byte(out), &info)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read info of container %s: %s", id, err)
+	}
+	if info.Labels == nil {
+		info.Labels = map[string]string{}
+	}
+	return info.Labels, nil
+}
+
+// remove kills the task of the container, if any, and deletes the container.
+func (c *containerd) remove(ctx context.Context, id string, tasks map[string]string) error {
+	if _, exist := tasks[id]; exist {
+		_, err := c.ctr(ctx, "tasks", "delete", "-f", id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := c.ctr(ctx, "containers", "delete", id)
+	return err
+}
+
+// Up pulls images and runs a task for each service. Containers running
+// with the same configuration are kept, others are re-created.
+func (c *containerd) Up(ctx context.Context) error {
+	f, err := c.file()
+	if err != nil {
+		return err
+	}
+	err = c.requirements(ctx)
+	if err != nil {
+		return err
+	}
+	tasks, err := c.tasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range f.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := f.Services[name]
+		id := c.id(name)
+		args, hash := c.runArgs(name, s)
+
+		labels, err := c.labels(ctx, id)
+		if err != nil {
+			return err
+		}
+		if labels != nil {
+			if labels[containerdConfigLabel] == hash && tasks[id] == "running" {
+				fmt.Printf("%s is up-to-date\n", id)
+				continue
+			}
+			fmt.Printf("Recreating %s\n", id)
+			err = c.remove(ctx, id, tasks)
+			if err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("Pulling %s\n", s.Image)
+		_, err = c.ctr(ctx, "images", "pull", normalizeImage(s.Image))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Starting %s\n", id)
+		_, err = c.ctr(ctx, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// containers returns ids of containers of the project.
+func (c *containerd) containers(ctx context.Context) ([]string, error) {
+	out, err := c.ctr(ctx, "containers", "ls", "-q", "labels."+containerdProjectLabel+"=="+c.project)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// Down kills tasks and deletes containers of the project.
+func (c *containerd) Down(ctx context.Context) error {
+	ids, err := c.containers(ctx)
+	if err != nil {
+		return err
+	}
+	tasks, err := c.tasks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		fmt.Printf("Removing %s\n", id)
+		err = c.remove(ctx, id, tasks)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *containerd) Running(ctx context.Context) (bool, error) {
+	states, err := c.States(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range states {
+		if len(s) > 0 && s[0] == "running" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// States returns the status of the task of each service,
+// created for containers without one.
+func (c *containerd) States(ctx context.Context) (map[string][]string, error) {
+	ids, err := c.containers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := c.tasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string][]string{}
+	for _, id := range ids {
+		state, exist := tasks[id]
+		if !exist {
+			state = "created"
+		}
+		service := strings.TrimPrefix(id, c.project+"_")
+		result[service] = append(result[service], state)
+	}
+	return result, nil
+}
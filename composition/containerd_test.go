@@ -0,0 +1,186 @@
+package composition
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/provision"
+)
+
+// fakeCtr answers ctr commands from in-memory containers and tasks.
+type fakeCtr struct {
+	labels map[string]map[string]string
+	tasks  map[string]string
+	calls  []string
+	// unusable fails ctr version, as when ctr or passwordless sudo is missing
+	unusable error
+}
+
+func (f *fakeCtr) run(ctx context.Context, args ...string) (string, error) {
+	f.calls = append(f.calls, strings.Join(args, " "))
+	if args[0] == "version" {
+		return "", f.unusable
+	}
+	switch strings.Join(args[:2], " ") {
+	case "tasks ls":
+		out := "TASK PID STATUS\n"
+		for id, status := range f.tasks {
+			out += fmt.Sprintf("%s 42 %s\n", id, status)
+		}
+		return out, nil
+	case "tasks delete":
+		delete(f.tasks, args[3])
+	case "containers ls":
+		out := ""
+		for id := range f.labels {
+			out += id + "\n"
+		}
+		return out, nil
+	case "containers info":
+		out := `{"Labels": {`
+		for k, v := range f.labels[args[2]] {
+			out += fmt.Sprintf(`"%s": "%s"`, k, v)
+		}
+		return out + "}}", nil
+	case "containers delete":
+		delete(f.labels, args[2])
+	case "images pull":
+	case "run -d":
+		id, labels := "", map[string]string{}
+		for i, arg := range args {
+			if arg == "--label" && strings.HasPrefix(args[i+1], containerdConfigLabel) {
+				parts := strings.SplitN(args[i+1], "=", 2)
+				labels[parts[0]] = parts[1]
+			}
+			if strings.Contains(arg, ".io/") {
+				id = args[i+1]
+			}
+		}
+		f.labels[id] = labels
+		f.tasks[id] = "RUNNING"
+	default:
+		return "", fmt.Errorf("unexpected ctr %s", args)
+	}
+	return "", nil
+}
+
+func TestContainerd(t *testing.T) {
+	home, err := ioutil.TempDir("", "dpm-containerd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", oldHome)
+
+	dir := filepath.Join(home, ".dpm", "workspace", "1234")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "services.yml"), []byte(`
+services:
+  web:
+    image: nginx
+    command: [nginx, -g, daemon off;]
+    env:
+      SIZE: ${SIZE}
+    mounts:
+    - ./html:/usr/share/nginx/html:ro
+    ports: ["80"]
+`), 0644))
+
+	s, err := NewProject(provision.ExportedMachine{Name: "node"}, "1234", &build.Spec{
+		Name:            "web",
+		Composition:     "services.yml",
+		CompositionType: build.ContainerdType,
+	})
+	assert.NoError(t, err)
+	s.Params = map[string]string{"size": "large"}
+
+	composer, err := s.composer()
+	assert.NoError(t, err)
+	c := composer.(*containerd)
+	fake := &fakeCtr{labels: map[string]map[string]string{}, tasks: map[string]string{}}
+	c.ctr = fake.run
+
+	ctx := context.Background()
+	assert.NoError(t, c.Up(ctx))
+	run := fake.calls[len(fake.calls)-1]
+	assert.True(t, strings.HasPrefix(run, "run -d --net-host --env SIZE=large --mount type=bind,src="+
+		filepath.Join(dir, "html")+",dst=/usr/share/nginx/html,options=rbind:ro --label dpm.project=web"))
+	assert.True(t, strings.HasSuffix(run, "docker.io/library/nginx:latest web_web nginx -g daemon off;"))
+
+	states, err := c.States(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, states, map[string][]string{"web": {"running"}})
+
+	// unchanged and running, nothing to do
+	fake.calls = nil
+	assert.NoError(t, c.Up(ctx))
+	for _, call := range fake.calls {
+		assert.False(t, strings.HasPrefix(call, "run"))
+	}
+
+	// a changed parameter re-creates the container
+	s.Params["size"] = "small"
+	fake.calls = nil
+	assert.NoError(t, c.Up(ctx))
+	assert.Contains(t, fake.calls, "tasks delete -f web_web")
+	assert.Contains(t, fake.calls, "containers delete web_web")
+
+	assert.NoError(t, c.Down(ctx))
+	assert.Empty(t, fake.labels)
+	running, err := c.Running(ctx)
+	assert.NoError(t, err)
+	assert.False(t, running)
+
+	// nothing is run when ctr cannot be used
+	fake.unusable = fmt.Errorf("sudo: a password is required")
+	fake.calls = nil
+	assert.EqualError(t, c.Up(ctx), "containerd compositions need ctr and passwordless sudo on machine node: sudo: a password is required")
+	assert.Equal(t, fake.calls, []string{"version"})
+}
+
+func TestContainerdTasks(t *testing.T) {
+	c := &containerd{s: &Spec{host: "node"}}
+	c.ctr = func(ctx context.Context, args ...string) (string, error) {
+		return "TASK      PID    STATUS    EXTRA\nweb_web   42     RUNNING   x\nweb_db    0      STOPPED   y\n", nil
+	}
+	tasks, err := c.tasks(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, tasks, map[string]string{"web_web": "running", "web_db": "stopped"})
+
+	c.ctr = func(ctx context.Context, args ...string) (string, error) {
+		return "ID STATE\n", nil
+	}
+	_, err = c.tasks(context.Background())
+	assert.EqualError(t, err, "Cannot read tasks of node, unexpected ctr output: ID STATE")
+}
+
+func TestParseContainerdFile(t *testing.T) {
+	_, err := ParseContainerdFile([]byte(`
+services:
+  web:
+    image: nginx
+    ports: ["8080:80"]
+`), nil)
+	assert.EqualError(t, err, "services.web.ports: 8080:80 cannot be mapped, containerd services use the host network")
+
+	_, err = ParseContainerdFile([]byte(`
+services:
+  web:
+    command: [nginx]
+`), nil)
+	assert.EqualError(t, err, "services.web.image is required")
+}
+
+func TestNormalizeImage(t *testing.T) {
+	assert.Equal(t, normalizeImage("nginx"), "docker.io/library/nginx:latest")
+	assert.Equal(t, normalizeImage("swasd/consul:0.6"), "docker.io/swasd/consul:0.6")
+	assert.Equal(t, normalizeImage("localhost:5000/app"), "localhost:5000/app:latest")
+	assert.Equal(t, normalizeImage("quay.io/coreos/etcd@sha256:abc"), "quay.io/coreos/etcd@sha256:abc")
+}
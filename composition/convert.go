@@ -0,0 +1,136 @@
+package composition
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Convert converts services of the compose file to Kubernetes objects:
+// a Deployment of one replica for each service, and a Service for those
+// with ports, on the published port if any. Services reach each other
+// by name as they do on a compose network. Volumes have no equivalent
+// and are rejected, as well as network modes.
+func Convert(f *File, project string) ([]object, error) {
+	names := []string{}
+	for name := range f.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := []object{}
+	for _, name := range names {
+		s := f.Services[name]
+		switch {
+		case len(s.Volumes) > 0:
+			return nil, fmt.Errorf("services.%s.volumes cannot be converted to Kubernetes, use manifests instead", name)
+		case s.NetworkMode != "":
+			return nil, fmt.Errorf("services.%s.network_mode cannot be converted to Kubernetes, use manifests instead", name)
+		}
+
+		objectName := strings.Replace(strings.ToLower(name), "_", "-", -1)
+		labels := map[string]interface{}{
+			"app.kubernetes.io/name":     objectName,
+			"app.kubernetes.io/instance": project,
+		}
+
+		container := map[string]interface{}{
+			"name":  objectName,
+			"image": s.Image,
+		}
+		// entrypoint and command of compose are command and args of Kubernetes
+		if len(s.Entrypoint) > 0 {
+			container["command"] = s.Entrypoint
+		}
+		if len(s.Command) > 0 {
+			container["args"] = s.Command
+		}
+		if len(s.Environment) > 0 {
+			env := []interface{}{}
+			for _, e := range s.Environment {
+				// ParseFile has given pass-through variables their value
+				parts := strings.SplitN(e, "=", 2)
+				if len(parts) != 2 {
+					return nil, fmt.Errorf("services.%s.environment: %s has no value", name, e)
+				}
+				env = append(env, map[string]interface{}{"name": parts[0], "value": parts[1]})
+			}
+			container["env"] = env
+		}
+
+		containerPorts := []interface{}{}
+		servicePorts := []interface{}{}
+		for _, p := range s.Ports {
+			port, binding, err := parsePort(p)
+			if err != nil {
+				return nil, fmt.Errorf("services.%s.ports: %s", name, err)
+			}
+			parts := strings.SplitN(port, "/", 2)
+			target, err := strconv.Atoi(parts[0])
+			if err != nil {
+				return nil, fmt.Errorf("services.%s.ports: invalid port %s", name, p)
+			}
+			published := target
+			if binding != nil && binding.HostPort != "" {
+				published, err = strconv.Atoi(binding.HostPort)
+				if err != nil {
+					return nil, fmt.Errorf("services.%s.ports: invalid port %s", name, p)
+				}
+			}
+			protocol := strings.ToUpper(parts[1])
+			containerPorts = append(containerPorts, map[string]interface{}{
+				"containerPort": target,
+				"protocol":      protocol,
+			})
+			servicePorts = append(servicePorts, map[string]interface{}{
+				"name":       fmt.Sprintf("%s-%d", strings.ToLower(protocol), published),
+				"port":       published,
+				"targetPort": target,
+				"protocol":   protocol,
+			})
+		}
+		if len(containerPorts) > 0 {
+			container["ports"] = containerPorts
+		}
+
+		podSpec := map[string]interface{}{"containers": []interface{}{container}}
+		if s.Hostname != "" {
+			podSpec["hostname"] = s.Hostname
+		}
+		podMetadata := map[string]interface{}{"labels": labels}
+		if len(s.Labels) > 0 {
+			annotations := map[string]interface{}{}
+			for k, v := range s.Labels {
+				annotations[k] = v
+			}
+			podMetadata["annotations"] = annotations
+		}
+
+		result = append(result, object{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": objectName},
+			"spec": map[string]interface{}{
+				"replicas": 1,
+				"selector": map[string]interface{}{"matchLabels": labels},
+				"template": map[string]interface{}{
+					"metadata": podMetadata,
+					"spec":     podSpec,
+				},
+			},
+		})
+		if len(servicePorts) > 0 {
+			result = append(result, object{
+				"apiVersion": "v1",
+				"kind":       "Service",
+				"metadata":   map[string]interface{}{"name": objectName},
+				"spec": map[string]interface{}{
+					"selector": labels,
+					"ports":    servicePorts,
+				},
+			})
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,280 @@
+package composition
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// apiClient is a client of a JSON HTTP API,
+// the Docker Engine API or the Kubernetes API.
+type apiClient struct {
+	name   string
+	client *http.Client
+	base   string
+	// header is sent with every request, for authentication
+	header http.Header
+}
+
+// apiError is an error answered by the API.
+type apiError struct {
+	api     string
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s (%d)", e.api, e.message, e.status)
+}
+
+func notFound(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && e.status == http.StatusNotFound
+}
+
+// newEngine returns a client of the engine designated by DOCKER_HOST,
+// DOCKER_TLS_VERIFY and DOCKER_CERT_PATH of the environment,
+// as given by docker-machine env.
+func newEngine(env []string) (*apiClient, error) {
+	vars := map[string]string{}
+	for _, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 {
+			vars[parts[0]] = parts[1]
+		}
+	}
+	host := vars["DOCKER_HOST"]
+	if host == "" {
+		host = defaultDockerHost
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DOCKER_HOST '%s': %s", host, err)
+	}
+
+	transport := &http.Transport{}
+	e := &apiClient{name: "Docker Engine API", client: &http.Client{Transport: transport}, header: http.Header{}}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		e.base = "http://docker"
+	case "tcp", "http", "https":
+		scheme := "http"
+		certPath := vars["DOCKER_CERT_PATH"]
+		verify := vars["DOCKER_TLS_VERIFY"] != "" && vars["DOCKER_TLS_VERIFY"] != "0"
+		if u.Scheme == "https" || verify || certPath != "" {
+			scheme = "https"
+			transport.TLSClientConfig, err = tlsConfig(certPath, verify)
+			if err != nil {
+				return nil, err
+			}
+		}
+		e.base = scheme + "://" + u.Host
+	case "ssh":
+		// as the docker CLI does, through docker on the host
+		args := []string{}
+		host := u.Host
+		if h, port, err := net.SplitHostPort(u.Host); err == nil {
+			host = h
+			args = append(args, "-p", port)
+		}
+		if u.User != nil {
+			args = append(args, "-l", u.User.Username())
+		}
+		args = append(args, "--", host, "docker", "system", "dial-stdio")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialCommand(exec.Command("ssh", args...))
+		}
+		e.base = "http://docker"
+	default:
+		return nil, fmt.Errorf("Unsupported DOCKER_HOST '%s'", host)
+	}
+	return e, nil
+}
+
+// commandConn is a connection to the standard input and output of a command.
+type commandConn struct {
+	io.Reader
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// dialCommand starts the command and returns a connection to it.
+func dialCommand(cmd *exec.Cmd) (net.Conn, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &commandConn{stdout, stdin, cmd}, nil
+}
+
+func (c *commandConn) Close() error {
+	c.WriteCloser.Close()
+	c.cmd.Process.Kill()
+	// the command is killed, its exit status does not matter
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr                { return commandAddr{} }
+func (c *commandConn) RemoteAddr() net.Addr               { return commandAddr{} }
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type commandAddr struct{}
+
+func (commandAddr) Network() string { return "command" }
+func (commandAddr) String() string  { return "command" }
+
+// tlsConfig loads ca.pem, cert.pem and key.pem of the cert path.
+func tlsConfig(certPath string, verify bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: !verify}
+	if certPath == "" {
+		return config, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(certPath, "cert.pem"),
+		filepath.Join(certPath, "key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{cert}
+
+	if verify {
+		ca, err := ioutil.ReadFile(filepath.Join(certPath, "ca.pem"))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificate found in %s", filepath.Join(certPath, "ca.pem"))
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// request sends the request and returns the response if successful.
+// The body, if any, is sent as JSON, of the content type.
+func (e *apiClient) request(ctx context.Context, method, path string, query url.Values, contentType string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(content)
+	}
+
+	u := e.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range e.header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		content, _ := ioutil.ReadAll(resp.Body)
+		message := struct{ Message string }{}
+		if json.Unmarshal(content, &message) != nil || message.Message == "" {
+			message.Message = strings.TrimSpace(string(content))
+		}
+		return nil, &apiError{e.name, resp.StatusCode, message.Message}
+	}
+	return resp, nil
+}
+
+// call sends the request and decodes the JSON response into out, unless nil.
+func (e *apiClient) call(ctx context.Context, method, path string, query url.Values, body interface{}, out interface{}) error {
+	resp, err := e.request(ctx, method, path, query, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// pull pulls the image, following the progress messages until done.
+func (e *apiClient) pull(ctx context.Context, image string) error {
+	query := url.Values{"fromImage": {image}}
+	if !strings.Contains(image, "@") {
+		name, tag := image, "latest"
+		if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+			name, tag = image[:i], image[i+1:]
+		}
+		query = url.Values{"fromImage": {name}, "tag": {tag}}
+	}
+
+	resp, err := e.request(ctx, "POST", "/images/create", query, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		message := struct{ Error string }{}
+		err := decoder.Decode(&message)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if message.Error != "" {
+			return fmt.Errorf("Cannot pull image %s: %s", image, message.Error)
+		}
+	}
+}
+
+// filters returns the filters query parameter of list endpoints.
+func filters(key, value string) url.Values {
+	content, _ := json.Marshal(map[string][]string{key: {value}})
+	return url.Values{"filters": {string(content)}}
+}
@@ -0,0 +1,346 @@
+package composition
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// File is a compose file, of version 1 or 2, as far as
+// the native backend understands it.
+type File struct {
+	Version  string
+	Services map[string]*Service
+	Networks map[string]*Network
+	Volumes  map[string]*Volume
+}
+
+type Service struct {
+	Name          string
+	Image         string
+	ContainerName string
+	Hostname      string
+	Restart       string
+	NetworkMode   string
+	Command       []string
+	Entrypoint    []string
+	Environment   []string
+	Ports         []string
+	Volumes       []string
+	Networks      []string
+	Links         []string
+	DependsOn     []string
+	Labels        map[string]string
+}
+
+type Network struct {
+	Driver   string
+	External bool
+}
+
+type Volume struct {
+	Driver   string
+	External bool
+}
+
+// interpolate replaces ${VAR}, ${VAR:-default} and $VAR in the content
+// with the environment given as KEY=VALUE entries. $$ is a literal $.
+func interpolate(content []byte, env []string) []byte {
+	vars := map[string]string{}
+	for _, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 {
+			vars[parts[0]] = parts[1]
+		}
+	}
+	return []byte(os.Expand(string(content), func(key string) string {
+		if key == "$" {
+			return "$"
+		}
+		if parts := strings.SplitN(key, ":-", 2); len(parts) == 2 {
+			if vars[parts[0]] == "" {
+				return parts[1]
+			}
+			return vars[parts[0]]
+		}
+		return vars[key]
+	}))
+}
+
+// ParseFile reads a compose file, interpolating variables
+// with the environment given as KEY=VALUE entries.
+func ParseFile(content []byte, env []string) (*File, error) {
+	content = interpolate(content, env)
+	raw := map[string]interface{}{}
+	err := yaml.Unmarshal(content, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{
+		Services: map[string]*Service{},
+		Networks: map[string]*Network{},
+		Volumes:  map[string]*Volume{},
+	}
+	services := raw
+	if v, exist := raw["version"]; exist {
+		f.Version = fmt.Sprint(v)
+		if !strings.HasPrefix(f.Version, "2") {
+			return nil, fmt.Errorf("compose file version %s is not supported, use 1 or 2", f.Version)
+		}
+		services, err = mapping(raw["services"], "services")
+		if err != nil {
+			return nil, err
+		}
+		networks, err := mapping(raw["networks"], "networks")
+		if err != nil {
+			return nil, err
+		}
+		for name, v := range networks {
+			n := &Network{}
+			err = resource(v, "networks."+name, &n.Driver, &n.External)
+			if err != nil {
+				return nil, err
+			}
+			f.Networks[name] = n
+		}
+		volumes, err := mapping(raw["volumes"], "volumes")
+		if err != nil {
+			return nil, err
+		}
+		for name, v := range volumes {
+			vol := &Volume{}
+			err = resource(v, "volumes."+name, &vol.Driver, &vol.External)
+			if err != nil {
+				return nil, err
+			}
+			f.Volumes[name] = vol
+		}
+	}
+
+	for name, v := range services {
+		s, err := parseService(name, v)
+		if err != nil {
+			return nil, err
+		}
+		s.Environment = passThrough(s.Environment, env)
+		f.Services[name] = s
+	}
+	return f, nil
+}
+
+// passThrough gives variables of the environment listed without a value,
+// as `- FOO`, their value in env. Those not set in env are left out,
+// as compose does.
+func passThrough(environment []string, env []string) []string {
+	values := map[string]string{}
+	for _, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+	result := []string{}
+	for _, e := range environment {
+		if !strings.Contains(e, "=") {
+			value, exist := values[e]
+			if !exist {
+				continue
+			}
+			e += "=" + value
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+func mapping(v interface{}, path string) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+	if v == nil {
+		return result, nil
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a mapping", path)
+	}
+	for k, vv := range m {
+		result[fmt.Sprint(k)] = vv
+	}
+	return result, nil
+}
+
+func resource(v interface{}, path string, driver *string, external *bool) error {
+	m, err := mapping(v, path)
+	if err != nil {
+		return err
+	}
+	for k, vv := range m {
+		switch k {
+		case "driver":
+			*driver = fmt.Sprint(vv)
+		case "external":
+			*external = vv == true
+		default:
+			return fmt.Errorf("%s.%s is not supported by the native composer", path, k)
+		}
+	}
+	return nil
+}
+
+// stringList returns a string or a list of strings as a list.
+// A string is split on spaces, as commands are.
+func stringList(v interface{}, path string, split bool) ([]string, error) {
+	switch val := v.(type) {
+	case string:
+		if split {
+			return strings.Fields(val), nil
+		}
+		return []string{val}, nil
+	case []interface{}:
+		result := []string{}
+		for _, item := range val {
+			if _, ok := item.(map[interface{}]interface{}); ok {
+				return nil, fmt.Errorf("%s must be a list of strings", path)
+			}
+			result = append(result, fmt.Sprint(item))
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("%s must be a string or a list", path)
+}
+
+// keyValues returns a mapping or a list of KEY=VALUE as a list.
+func keyValues(v interface{}, path string) ([]string, error) {
+	if m, ok := v.(map[interface{}]interface{}); ok {
+		result := []string{}
+		for k, vv := range m {
+			value := ""
+			if vv != nil {
+				value = fmt.Sprint(vv)
+			}
+			result = append(result, fmt.Sprint(k)+"="+value)
+		}
+		sort.Strings(result)
+		return result, nil
+	}
+	return stringList(v, path, false)
+}
+
+func parseService(name string, v interface{}) (*Service, error) {
+	path := "services." + name
+	m, err := mapping(v, path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Service{Name: name, Labels: map[string]string{}}
+	for k, vv := range m {
+		p := path + "." + k
+		switch k {
+		case "image":
+			s.Image = fmt.Sprint(vv)
+		case "container_name":
+			s.ContainerName = fmt.Sprint(vv)
+		case "hostname":
+			s.Hostname = fmt.Sprint(vv)
+		case "restart":
+			s.Restart = fmt.Sprint(vv)
+		case "net", "network_mode":
+			s.NetworkMode = fmt.Sprint(vv)
+		case "command":
+			s.Command, err = stringList(vv, p, true)
+		case "entrypoint":
+			s.Entrypoint, err = stringList(vv, p, true)
+		case "environment":
+			s.Environment, err = keyValues(vv, p)
+		case "ports":
+			s.Ports, err = stringList(vv, p, false)
+		case "volumes":
+			s.Volumes, err = stringList(vv, p, false)
+		case "networks":
+			if nm, ok := vv.(map[interface{}]interface{}); ok {
+				for n := range nm {
+					s.Networks = append(s.Networks, fmt.Sprint(n))
+				}
+				sort.Strings(s.Networks)
+			} else {
+				s.Networks, err = stringList(vv, p, false)
+			}
+		case "links":
+			s.Links, err = stringList(vv, p, false)
+		case "depends_on":
+			s.DependsOn, err = stringList(vv, p, false)
+		case "labels":
+			var labels []string
+			labels, err = keyValues(vv, p)
+			for _, l := range labels {
+				parts := strings.SplitN(l, "=", 2)
+				s.Labels[parts[0]] = parts[len(parts)-1]
+			}
+		default:
+			return nil, fmt.Errorf("%s is not supported by the native composer, install docker-compose to use it", p)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Image == "" {
+		return nil, fmt.Errorf("%s.image is required by the native composer", path)
+	}
+	return s, nil
+}
+
+// Order returns services so that each comes after those it depends on or links to.
+func (f *File) Order() ([]*Service, error) {
+	names := []string{}
+	for name := range f.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := []*Service{}
+	state := map[string]int{} // 1 visiting, 2 done
+	var visit func(name string, from string) error
+	visit = func(name string, from string) error {
+		s, exist := f.Services[name]
+		if !exist {
+			return fmt.Errorf("service %s refers to unknown service %s", from, name)
+		}
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("services %s and %s depend on each other", from, name)
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, d := range s.dependencies() {
+			if err := visit(d, name); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		result = append(result, s)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, name); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (s *Service) dependencies() []string {
+	result := append([]string{}, s.DependsOn...)
+	for _, l := range s.Links {
+		result = append(result, strings.SplitN(l, ":", 2)[0])
+	}
+	if strings.HasPrefix(s.NetworkMode, "service:") {
+		result = append(result, strings.TrimPrefix(s.NetworkMode, "service:"))
+	}
+	return result
+}
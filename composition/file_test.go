@@ -0,0 +1,114 @@
+package composition
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFileV1(t *testing.T) {
+	f, err := ParseFile([]byte(`
+web:
+  image: nginx:${TAG}
+  command: nginx -g "daemon off;"
+  links:
+  - db:database
+  ports:
+  - "8080:80"
+  environment:
+    MODE: ${MODE:-dev}
+    PRICE: $$5
+db:
+  image: postgres
+  environment:
+  - TAG
+  - PASSWORD
+  - USER=admin
+`), []string{"TAG=1.11"})
+	assert.NoError(t, err)
+	assert.Equal(t, f.Version, "")
+	web := f.Services["web"]
+	assert.Equal(t, web.Image, "nginx:1.11")
+	assert.Equal(t, web.Command, []string{"nginx", "-g", `"daemon`, `off;"`})
+	assert.Equal(t, web.Environment, []string{"MODE=dev", "PRICE=$5"})
+	assert.Equal(t, web.Ports, []string{"8080:80"})
+	// passed through from the environment, if set
+	assert.Equal(t, f.Services["db"].Environment, []string{"TAG=1.11", "USER=admin"})
+
+	order, err := f.Order()
+	assert.NoError(t, err)
+	assert.Equal(t, order[0].Name, "db")
+	assert.Equal(t, order[1].Name, "web")
+}
+
+func TestParseFileV2(t *testing.T) {
+	f, err := ParseFile([]byte(`
+version: "2"
+services:
+  web:
+    image: nginx
+    depends_on: [api]
+    networks:
+      front:
+      back:
+  api:
+    image: api
+    command: [serve, --port, "80"]
+    networks: [back]
+    volumes:
+    - data:/data
+networks:
+  front:
+  back:
+    external: true
+volumes:
+  data:
+    driver: local
+`), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, f.Version, "2")
+	assert.Equal(t, f.Services["web"].Networks, []string{"back", "front"})
+	assert.Equal(t, f.Services["api"].Command, []string{"serve", "--port", "80"})
+	assert.True(t, f.Networks["back"].External)
+	assert.Equal(t, f.Volumes["data"].Driver, "local")
+}
+
+func TestParseFileUnsupported(t *testing.T) {
+	_, err := ParseFile([]byte(`
+web:
+  build: .
+`), nil)
+	assert.EqualError(t, err, "services.web.build is not supported by the native composer, install docker-compose to use it")
+
+	_, err = ParseFile([]byte(`version: "3"`), nil)
+	assert.EqualError(t, err, "compose file version 3 is not supported, use 1 or 2")
+}
+
+func TestOrderCycle(t *testing.T) {
+	f, err := ParseFile([]byte(`
+a:
+  image: a
+  links: [b]
+b:
+  image: b
+  links: [a]
+`), nil)
+	assert.NoError(t, err)
+	_, err = f.Order()
+	assert.EqualError(t, err, "services b and a depend on each other")
+}
+
+func TestParsePort(t *testing.T) {
+	port, binding, err := parsePort("80")
+	assert.NoError(t, err)
+	assert.Equal(t, port, "80/tcp")
+	assert.Nil(t, binding)
+
+	port, binding, err = parsePort("127.0.0.1:5353:53/udp")
+	assert.NoError(t, err)
+	assert.Equal(t, port, "53/udp")
+	assert.Equal(t, *binding, portBinding{"127.0.0.1", "5353"})
+
+	_, _, err = parsePort("8000-8010:80")
+	assert.Error(t, err)
+}
@@ -0,0 +1,179 @@
+package composition
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// kubeconfig is the part of a kubeconfig file needed to reach a cluster.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string
+		Cluster kubeCluster
+	}
+	Users []struct {
+		Name string
+		User kubeUser
+	}
+	Contexts []struct {
+		Name    string
+		Context kubeContext
+	}
+}
+
+type kubeCluster struct {
+	Server                   string
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+}
+
+type kubeUser struct {
+	Token                 string
+	TokenFile             string `yaml:"tokenFile"`
+	ClientCertificate     string `yaml:"client-certificate"`
+	ClientCertificateData string `yaml:"client-certificate-data"`
+	ClientKey             string `yaml:"client-key"`
+	ClientKeyData         string `yaml:"client-key-data"`
+	Username              string
+	Password              string
+}
+
+type kubeContext struct {
+	Cluster   string
+	User      string
+	Namespace string
+}
+
+// kubeconfigPath returns the first file of $KUBECONFIG, or ~/.kube/config.
+func kubeconfigPath() string {
+	for _, path := range filepath.SplitList(os.Getenv("KUBECONFIG")) {
+		if path != "" {
+			return path
+		}
+	}
+	return filepath.Join(os.Getenv("HOME"), ".kube", "config")
+}
+
+// newKubeClient returns a client of the cluster of the context,
+// the current one if empty, and the namespace of the context.
+func newKubeClient(path string, context string) (*apiClient, string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	config := kubeconfig{}
+	err = yaml.Unmarshal(content, &config)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %s", path, err)
+	}
+
+	if context == "" {
+		context = config.CurrentContext
+	}
+	if context == "" {
+		return nil, "", fmt.Errorf("%s has no current context", path)
+	}
+	var ctx *kubeContext
+	for i := range config.Contexts {
+		if config.Contexts[i].Name == context {
+			ctx = &config.Contexts[i].Context
+		}
+	}
+	if ctx == nil {
+		return nil, "", fmt.Errorf("%s has no context %s", path, context)
+	}
+	var cluster *kubeCluster
+	for i := range config.Clusters {
+		if config.Clusters[i].Name == ctx.Cluster {
+			cluster = &config.Clusters[i].Cluster
+		}
+	}
+	if cluster == nil {
+		return nil, "", fmt.Errorf("%s has no cluster %s", path, ctx.Cluster)
+	}
+	user := &kubeUser{}
+	for i := range config.Users {
+		if config.Users[i].Name == ctx.User {
+			user = &config.Users[i].User
+		}
+	}
+
+	// relative paths are relative to the kubeconfig
+	dir := filepath.Dir(path)
+	read := func(file, data string) ([]byte, error) {
+		if data != "" {
+			return base64.StdEncoding.DecodeString(data)
+		}
+		if file == "" {
+			return nil, nil
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		return ioutil.ReadFile(file)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cluster.InsecureSkipTLSVerify}
+	ca, err := read(cluster.CertificateAuthority, cluster.CertificateAuthorityData)
+	if err != nil {
+		return nil, "", err
+	}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, "", fmt.Errorf("No certificate found in the authority of cluster %s", ctx.Cluster)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	cert, err := read(user.ClientCertificate, user.ClientCertificateData)
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := read(user.ClientKey, user.ClientKeyData)
+	if err != nil {
+		return nil, "", err
+	}
+	if cert != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, "", err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	header := http.Header{}
+	token := user.Token
+	if token == "" && user.TokenFile != "" {
+		content, err := read(user.TokenFile, "")
+		if err != nil {
+			return nil, "", err
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	switch {
+	case token != "":
+		header.Set("Authorization", "Bearer "+token)
+	case user.Username != "":
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username + ":" + user.Password))
+		header.Set("Authorization", "Basic "+auth)
+	}
+
+	client := &apiClient{
+		name:   "Kubernetes API",
+		client: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		base:   strings.TrimRight(cluster.Server, "/"),
+		header: header,
+	}
+	return client, ctx.Namespace, nil
+}
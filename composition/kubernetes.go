@@ -0,0 +1,421 @@
+package composition
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Labels set on objects applied by dpm.
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	partOfLabel    = "app.kubernetes.io/part-of"
+)
+
+// object is a Kubernetes object, as decoded from JSON.
+type object map[string]interface{}
+
+func (o object) get(path ...string) interface{} {
+	var v interface{} = map[string]interface{}(o)
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func (o object) str(path ...string) string {
+	s, _ := o.get(path...).(string)
+	return s
+}
+
+func (o object) number(path ...string) int {
+	f, _ := o.get(path...).(float64)
+	return int(f)
+}
+
+func (o object) String() string {
+	return o.str("kind") + " " + o.str("metadata", "name")
+}
+
+// kubernetes composes the project by applying manifests to a cluster.
+type kubernetes struct {
+	s         *Spec
+	client    *apiClient
+	namespace string
+	// resources are the discovered resources by API version.
+	resources map[string][]apiResource
+}
+
+// apiResource is a resource served by the API, as listed by discovery.
+type apiResource struct {
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Namespaced bool   `json:"namespaced"`
+}
+
+func newKubernetes(s *Spec) (Composer, error) {
+	target := s.kubernetes
+	path := kubeconfigPath()
+	client, namespace, err := newKubeClient(path, target.Context)
+	if err != nil {
+		return nil, err
+	}
+	if target.Namespace != "" {
+		namespace = target.Namespace
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	return &kubernetes{s, client, namespace, map[string][]apiResource{}}, nil
+}
+
+// objects returns the objects of the composition in the order to apply them,
+// namespaces and custom resource definitions first.
+// The composition is a directory of manifests, a manifest file
+// or a compose file converted to manifests.
+func (k *kubernetes) objects() ([]object, error) {
+	path := filepath.Join(k.s.dir(), k.s.compositionFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files = []string{}
+		err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			switch filepath.Ext(file) {
+			case ".yml", ".yaml", ".json":
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := []object{}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		objects, err := parseManifests(content)
+		if err != nil {
+			rel, _ := filepath.Rel(path, file)
+			if !info.IsDir() {
+				rel = filepath.Base(file)
+			}
+			return nil, fmt.Errorf("%s: %s", filepath.ToSlash(rel), err)
+		}
+		if objects == nil && !info.IsDir() {
+			// not manifests, but a compose file
+			f, err := ParseFile(content, k.s.paramsEnv())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", k.s.compositionFile, err)
+			}
+			objects, err = Convert(f, projectName(k.s.projectName))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", k.s.compositionFile, err)
+			}
+		}
+		result = append(result, objects...)
+	}
+
+	sort.Stable(byApplyOrder(result))
+	return result, nil
+}
+
+type byApplyOrder []object
+
+func (b byApplyOrder) Len() int      { return len(b) }
+func (b byApplyOrder) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byApplyOrder) Less(i, j int) bool {
+	rank := func(o object) int {
+		switch o.str("kind") {
+		case "Namespace":
+			return 0
+		case "CustomResourceDefinition":
+			return 1
+		}
+		return 2
+	}
+	return rank(b[i]) < rank(b[j])
+}
+
+// parseManifests parses YAML or JSON documents of Kubernetes objects.
+// It returns nil if the documents are not Kubernetes objects.
+func parseManifests(content []byte) ([]object, error) {
+	result := []object{}
+	documents := [][]byte{}
+	document := []byte{}
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("---")) {
+			documents = append(documents, document)
+			document = []byte{}
+			continue
+		}
+		document = append(document, line...)
+	}
+	documents = append(documents, document)
+
+	for _, d := range documents {
+		var v interface{}
+		err := yaml.Unmarshal(d, &v)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		o, ok := jsonValue(v).(map[string]interface{})
+		if !ok || o["kind"] == nil || o["apiVersion"] == nil {
+			return nil, nil
+		}
+		if o["kind"] == "List" {
+			items, _ := o["items"].([]interface{})
+			for _, item := range items {
+				if m, ok := item.(map[string]interface{}); ok {
+					result = append(result, object(m))
+				}
+			}
+			continue
+		}
+		result = append(result, object(o))
+	}
+	return result, nil
+}
+
+// jsonValue turns a YAML value into one that can be encoded to JSON.
+func jsonValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, vv := range val {
+			m[fmt.Sprint(k)] = jsonValue(vv)
+		}
+		return m
+	case []interface{}:
+		for i := range val {
+			val[i] = jsonValue(val[i])
+		}
+	}
+	return v
+}
+
+// collection returns the path of the API group version serving apiVersion.
+func collection(apiVersion string) string {
+	if strings.Contains(apiVersion, "/") {
+		return "/apis/" + apiVersion
+	}
+	return "/api/" + apiVersion
+}
+
+// resource returns the resource of kind in apiVersion, as discovered from
+// the API. Discovery is done again when the kind is not found, as its
+// custom resource definition may just have been created.
+func (k *kubernetes) resource(ctx context.Context, apiVersion, kind string) (apiResource, error) {
+	for refreshed := false; ; refreshed = true {
+		resources, cached := k.resources[apiVersion]
+		if !cached || refreshed {
+			list := struct {
+				Resources []apiResource `json:"resources"`
+			}{}
+			err := k.client.call(ctx, "GET", collection(apiVersion), nil, nil, &list)
+			if err != nil && !notFound(err) {
+				return apiResource{}, fmt.Errorf("Cannot discover resources of %s: %s", apiVersion, err)
+			}
+			resources = []apiResource{}
+			for _, r := range list.Resources {
+				// subresources, like deployments/scale
+				if !strings.Contains(r.Name, "/") {
+					resources = append(resources, r)
+				}
+			}
+			k.resources[apiVersion] = resources
+		}
+		for _, r := range resources {
+			if r.Kind == kind {
+				return r, nil
+			}
+		}
+		if !cached || refreshed {
+			return apiResource{}, fmt.Errorf("%s does not serve %s", apiVersion, kind)
+		}
+	}
+}
+
+// paths returns the collection path of the object and its own path.
+func (k *kubernetes) paths(ctx context.Context, o object) (string, string, error) {
+	apiVersion, kind, name := o.str("apiVersion"), o.str("kind"), o.str("metadata", "name")
+	if apiVersion == "" || kind == "" || name == "" {
+		return "", "", fmt.Errorf("object %s must have apiVersion, kind and metadata.name", o)
+	}
+	r, err := k.resource(ctx, apiVersion, kind)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %s", o, err)
+	}
+
+	path := collection(apiVersion)
+	if r.Namespaced {
+		namespace := o.str("metadata", "namespace")
+		if namespace == "" {
+			namespace = k.namespace
+		}
+		path += "/namespaces/" + namespace
+	}
+	path += "/" + r.Name
+	return path, path + "/" + name, nil
+}
+
+// patch merges the object into the one at path.
+func (e *apiClient) patch(ctx context.Context, path string, o object) error {
+	resp, err := e.request(ctx, "PATCH", path, nil, "application/merge-patch+json", o)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Up creates objects missing in the cluster
+// and merges the manifests into existing ones.
+func (k *kubernetes) Up(ctx context.Context) error {
+	objects, err := k.objects()
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objects {
+		collection, path, err := k.paths(ctx, o)
+		if err != nil {
+			return err
+		}
+		metadata := o["metadata"].(map[string]interface{})
+		labels, _ := metadata["labels"].(map[string]interface{})
+		if labels == nil {
+			labels = map[string]interface{}{}
+			metadata["labels"] = labels
+		}
+		labels[managedByLabel] = "dpm"
+		labels[partOfLabel] = projectName(k.s.projectName)
+
+		err = k.client.call(ctx, "GET", path, nil, nil, nil)
+		switch {
+		case notFound(err):
+			fmt.Printf("Creating %s\n", o)
+			err = k.client.call(ctx, "POST", collection, nil, o, nil)
+		case err == nil:
+			fmt.Printf("Updating %s\n", o)
+			err = k.client.patch(ctx, path, o)
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot apply %s: %s", o, err)
+		}
+	}
+	return nil
+}
+
+// Down deletes objects of the manifests, in the reverse order.
+func (k *kubernetes) Down(ctx context.Context) error {
+	objects, err := k.objects()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"propagationPolicy": {"Background"}}
+	for i := len(objects) - 1; i >= 0; i-- {
+		o := objects[i]
+		_, path, err := k.paths(ctx, o)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Deleting %s\n", o)
+		err = k.client.call(ctx, "DELETE", path, query, nil, nil)
+		if err != nil && !notFound(err) {
+			return fmt.Errorf("Cannot delete %s: %s", o, err)
+		}
+	}
+	return nil
+}
+
+func (k *kubernetes) Running(ctx context.Context) (bool, error) {
+	states, err := k.States(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range states {
+		for _, state := range s {
+			if state == "running" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// States returns, by workload, running for each ready replica and
+// starting for the others. Pods are in the state of their phase.
+func (k *kubernetes) States(ctx context.Context) (map[string][]string, error) {
+	objects, err := k.objects()
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string][]string{}
+	for _, o := range objects {
+		kind := o.str("kind")
+		switch kind {
+		case "Deployment", "StatefulSet", "ReplicaSet", "DaemonSet", "Pod":
+		default:
+			continue
+		}
+
+		_, path, err := k.paths(ctx, o)
+		if err != nil {
+			return nil, err
+		}
+		current := object{}
+		err = k.client.call(ctx, "GET", path, nil, nil, &current)
+		if notFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := o.str("metadata", "name")
+		if kind == "Pod" {
+			result[name] = append(result[name], strings.ToLower(current.str("status", "phase")))
+			continue
+		}
+
+		desired, ready := current.number("spec", "replicas"), current.number("status", "readyReplicas")
+		if kind == "DaemonSet" {
+			desired, ready = current.number("status", "desiredNumberScheduled"), current.number("status", "numberReady")
+		}
+		for i := 0; i < desired; i++ {
+			state := "starting"
+			if i < ready {
+				state = "running"
+			}
+			result[name] = append(result[name], state)
+		}
+	}
+	return result, nil
+}
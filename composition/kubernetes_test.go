@@ -0,0 +1,306 @@
+package composition
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/provision"
+)
+
+// discovery lists the resources served by fakeCluster, by API version path.
+var discovery = map[string][]apiResource{
+	"/api/v1": {
+		{"namespaces", "Namespace", false},
+		{"services", "Service", true},
+		{"endpoints", "Endpoints", true},
+		{"pods", "Pod", true},
+		{"pods/log", "Pod", true},
+	},
+	"/apis/apps/v1": {
+		{"deployments", "Deployment", true},
+		{"deployments/scale", "Scale", true},
+	},
+	"/apis/networking.k8s.io/v1": {
+		{"ingresses", "Ingress", true},
+		{"networkpolicies", "NetworkPolicy", true},
+		{"ingressclasses", "IngressClass", false},
+	},
+}
+
+// fakeCluster is an in-memory Kubernetes API server, storing objects by path.
+type fakeCluster struct {
+	sync.Mutex
+	objects map[string]object
+	calls   []string
+	auth    string
+}
+
+func (c *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.Lock()
+	defer c.Unlock()
+	c.calls = append(c.calls, r.Method+" "+r.URL.Path)
+	c.auth = r.Header.Get("Authorization")
+
+	o := object{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&o)
+	}
+	switch r.Method {
+	case "GET":
+		if resources, exist := discovery[r.URL.Path]; exist {
+			json.NewEncoder(w).Encode(map[string]interface{}{"resources": resources})
+			return
+		}
+		current, exist := c.objects[r.URL.Path]
+		if !exist {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"kind":"Status","message":"%s not found"}`, r.URL.Path)
+			return
+		}
+		json.NewEncoder(w).Encode(current)
+	case "POST":
+		c.objects[r.URL.Path+"/"+o.str("metadata", "name")] = o
+	case "PATCH":
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		current := c.objects[r.URL.Path]
+		for k, v := range o {
+			current[k] = v
+		}
+	case "DELETE":
+		delete(c.objects, r.URL.Path)
+	}
+}
+
+func setupKubernetes(t *testing.T, files map[string]string, composition string) (*Spec, *fakeCluster, func()) {
+	home, err := ioutil.TempDir("", "dpm-kubernetes")
+	assert.NoError(t, err)
+	dir := filepath.Join(home, ".dpm", "workspace", "1234")
+	for name, content := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	cluster := &fakeCluster{objects: map[string]object{}}
+	server := httptest.NewServer(cluster)
+	kubeconfig := filepath.Join(home, "kubeconfig")
+	assert.NoError(t, ioutil.WriteFile(kubeconfig, []byte(`
+apiVersion: v1
+kind: Config
+current-context: test
+contexts:
+- name: test
+  context:
+    cluster: fake
+    user: admin
+    namespace: apps
+clusters:
+- name: fake
+  cluster:
+    server: `+server.URL+`
+users:
+- name: admin
+  user:
+    token: s3cr3t
+`), 0644))
+
+	oldHome, oldConfig := os.Getenv("HOME"), os.Getenv("KUBECONFIG")
+	os.Setenv("HOME", home)
+	os.Setenv("KUBECONFIG", kubeconfig)
+
+	s, err := NewProject(provision.ExportedMachine{Name: "none"}, "1234", &build.Spec{
+		Name:            "web-app",
+		Composition:     composition,
+		CompositionType: build.KubernetesType,
+	})
+	assert.NoError(t, err)
+	return s, cluster, func() {
+		server.Close()
+		os.Setenv("HOME", oldHome)
+		os.Setenv("KUBECONFIG", oldConfig)
+		os.RemoveAll(home)
+	}
+}
+
+func TestKubernetesManifests(t *testing.T) {
+	s, cluster, teardown := setupKubernetes(t, map[string]string{
+		"k8s/app.yml": `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 2
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+`,
+		"k8s/namespace.json": `{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "apps"}}`,
+		"k8s/README.md":      "not a manifest",
+	}, "k8s")
+	defer teardown()
+
+	ctx := context.Background()
+	assert.NoError(t, s.Up(ctx))
+	assert.Equal(t, cluster.auth, "Bearer s3cr3t")
+	assert.Equal(t, cluster.calls, []string{
+		"GET /api/v1",
+		"GET /api/v1/namespaces/apps",
+		"POST /api/v1/namespaces",
+		"GET /apis/apps/v1",
+		"GET /apis/apps/v1/namespaces/apps/deployments/web",
+		"POST /apis/apps/v1/namespaces/apps/deployments",
+		"GET /api/v1/namespaces/apps/services/web",
+		"POST /api/v1/namespaces/apps/services",
+	})
+	deployment := cluster.objects["/apis/apps/v1/namespaces/apps/deployments/web"]
+	assert.Equal(t, deployment.str("metadata", "labels", partOfLabel), "webapp")
+	assert.Equal(t, deployment.str("metadata", "labels", managedByLabel), "dpm")
+
+	// one replica of two is ready
+	deployment["status"] = map[string]interface{}{"readyReplicas": 1}
+	states, err := s.States(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, states, map[string][]string{"web": {"running", "starting"}})
+	running, err := s.Running(ctx)
+	assert.NoError(t, err)
+	assert.True(t, running)
+
+	// existing objects are patched
+	cluster.calls = nil
+	assert.NoError(t, s.Up(ctx))
+	assert.Contains(t, cluster.calls, "PATCH /apis/apps/v1/namespaces/apps/deployments/web")
+
+	cluster.calls = nil
+	assert.NoError(t, s.Down(ctx))
+	assert.Equal(t, cluster.calls, []string{
+		"GET /api/v1",
+		"DELETE /api/v1/namespaces/apps/services/web",
+		"GET /apis/apps/v1",
+		"DELETE /apis/apps/v1/namespaces/apps/deployments/web",
+		"DELETE /api/v1/namespaces/apps",
+	})
+	assert.Empty(t, cluster.objects)
+	assert.NoError(t, s.Down(ctx))
+}
+
+func TestKubernetesComposeFile(t *testing.T) {
+	s, cluster, teardown := setupKubernetes(t, map[string]string{
+		"composition.yml": `
+version: "2"
+services:
+  web:
+    image: nginx
+    ports: ["8080:80"]
+    environment:
+    - SIZE
+`,
+	}, "composition.yml")
+	defer teardown()
+	s.Params = map[string]string{"size": "large"}
+	s.kubernetes.Namespace = "web"
+
+	assert.NoError(t, s.Up(context.Background()))
+	deployment := cluster.objects["/apis/apps/v1/namespaces/web/deployments/web"]
+	assert.NotNil(t, deployment)
+	containers := deployment.get("spec", "template", "spec", "containers").([]interface{})
+	assert.Equal(t, object(containers[0].(map[string]interface{})).get("env"),
+		[]interface{}{map[string]interface{}{"name": "SIZE", "value": "large"}})
+	service := cluster.objects["/api/v1/namespaces/web/services/web"]
+	assert.Equal(t, service.get("spec", "ports"), []interface{}{map[string]interface{}{
+		"name": "tcp-8080", "port": float64(8080), "targetPort": float64(80), "protocol": "TCP",
+	}})
+}
+
+func TestConvertEnvironmentWithoutValue(t *testing.T) {
+	_, err := Convert(&File{Services: map[string]*Service{
+		"web": {Name: "web", Image: "nginx", Environment: []string{"SIZE"}},
+	}}, "web")
+	assert.EqualError(t, err, "services.web.environment: SIZE has no value")
+}
+
+func TestKubernetesErrors(t *testing.T) {
+	s, _, teardown := setupKubernetes(t, map[string]string{
+		"composition.yml": `
+web:
+  image: nginx
+  volumes:
+  - /data:/data
+`,
+	}, "composition.yml")
+	defer teardown()
+
+	err := s.Up(context.Background())
+	assert.EqualError(t, err, "composition.yml: services.web.volumes cannot be converted to Kubernetes, use manifests instead")
+	err = s.Logs(context.Background(), false)
+	assert.EqualError(t, err, "Package web-app is deployed to Kubernetes, use kubectl instead")
+
+	s.kubernetes.Context = "prod"
+	err = s.Up(context.Background())
+	assert.True(t, strings.HasSuffix(err.Error(), "kubeconfig has no context prod"))
+}
+
+func TestKubernetesDiscovery(t *testing.T) {
+	s, cluster, teardown := setupKubernetes(t, map[string]string{
+		"k8s/network/ingress.yml": `
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: web
+---
+apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: web
+---
+apiVersion: networking.k8s.io/v1
+kind: IngressClass
+metadata:
+  name: public
+`,
+	}, "k8s")
+	defer teardown()
+
+	ctx := context.Background()
+	assert.NoError(t, s.Up(ctx))
+	assert.Equal(t, cluster.calls, []string{
+		"GET /apis/networking.k8s.io/v1",
+		"GET /apis/networking.k8s.io/v1/namespaces/apps/ingresses/web",
+		"POST /apis/networking.k8s.io/v1/namespaces/apps/ingresses",
+		"GET /apis/networking.k8s.io/v1/namespaces/apps/networkpolicies/web",
+		"POST /apis/networking.k8s.io/v1/namespaces/apps/networkpolicies",
+		"GET /apis/networking.k8s.io/v1/ingressclasses/public",
+		"POST /apis/networking.k8s.io/v1/ingressclasses",
+	})
+}
+
+func TestKubernetesUnknownKind(t *testing.T) {
+	s, cluster, teardown := setupKubernetes(t, map[string]string{
+		"k8s/backup.yml": `
+apiVersion: example.com/v1
+kind: Backup
+metadata:
+  name: nightly
+`,
+	}, "k8s")
+	defer teardown()
+
+	err := s.Up(context.Background())
+	assert.EqualError(t, err, "Backup nightly: example.com/v1 does not serve Backup")
+	assert.Equal(t, cluster.calls, []string{"GET /apis/example.com/v1"})
+}
@@ -0,0 +1,504 @@
+package composition
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Labels of containers, networks and volumes, the same as docker-compose
+// sets so that either backend can manage a project the other created.
+const (
+	projectLabel    = "com.docker.compose.project"
+	serviceLabel    = "com.docker.compose.service"
+	numberLabel     = "com.docker.compose.container-number"
+	oneoffLabel     = "com.docker.compose.oneoff"
+	configHashLabel = "com.docker.compose.config-hash"
+)
+
+// native composes the project with the Docker Engine API,
+// for hosts without docker-compose.
+type native struct {
+	s       *Spec
+	env     []string
+	engine  *apiClient
+	project string
+}
+
+func newNative(s *Spec) (Composer, error) {
+	env, err := s.env()
+	if err != nil {
+		return nil, err
+	}
+	e, err := newEngine(env)
+	if err != nil {
+		return nil, err
+	}
+	return &native{s, env, e, projectName(s.projectName)}, nil
+}
+
+// projectName normalizes the name the way docker-compose does,
+// keeping lower cased letters and digits only.
+func projectName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		}
+		return -1
+	}, name)
+}
+
+func (n *native) file() (*File, error) {
+	content, err := ioutil.ReadFile(filepath.Join(n.s.dir(), n.s.compositionFile))
+	if err != nil {
+		return nil, err
+	}
+	f, err := ParseFile(content, n.env)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", n.s.compositionFile, err)
+	}
+	return f, nil
+}
+
+func (n *native) name(resource string) string {
+	return n.project + "_" + resource
+}
+
+func (n *native) containerName(s *Service) string {
+	if s.ContainerName != "" {
+		return s.ContainerName
+	}
+	return n.name(s.Name) + "_1"
+}
+
+// networkName returns the engine name of a network of the file.
+func (n *native) networkName(f *File, network string) string {
+	if net, exist := f.Networks[network]; exist && net.External {
+		return network
+	}
+	return n.name(network)
+}
+
+func (n *native) labels() map[string]string {
+	return map[string]string{projectLabel: n.project}
+}
+
+func (n *native) Up(ctx context.Context) error {
+	f, err := n.file()
+	if err != nil {
+		return err
+	}
+	services, err := f.Order()
+	if err != nil {
+		return fmt.Errorf("%s: %s", n.s.compositionFile, err)
+	}
+
+	if f.Version != "" {
+		networks := map[string]bool{}
+		for _, s := range services {
+			for _, network := range s.networks() {
+				if _, exist := f.Networks[network]; !exist && network != "default" {
+					return fmt.Errorf("%s: service %s uses undeclared network %s", n.s.compositionFile, s.Name, network)
+				}
+				networks[network] = true
+			}
+		}
+		for network := range networks {
+			err = n.ensureNetwork(ctx, f, network)
+			if err != nil {
+				return err
+			}
+		}
+		for volume, v := range f.Volumes {
+			if v.External {
+				continue
+			}
+			err = n.ensureVolume(ctx, n.name(volume), v.Driver)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, s := range services {
+		err = n.ensureImage(ctx, s.Image)
+		if err != nil {
+			return err
+		}
+		err = n.ensureContainer(ctx, f, s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *native) ensureNetwork(ctx context.Context, f *File, network string) error {
+	name := n.networkName(f, network)
+	err := n.engine.call(ctx, "GET", "/networks/"+name, nil, nil, nil)
+	if !notFound(err) {
+		return err
+	}
+	if net, exist := f.Networks[network]; exist && net.External {
+		return fmt.Errorf("External network %s is not found", name)
+	}
+
+	driver := ""
+	if net, exist := f.Networks[network]; exist {
+		driver = net.Driver
+	}
+	fmt.Printf("Creating network %s\n", name)
+	return n.engine.call(ctx, "POST", "/networks/create", nil, map[string]interface{}{
+		"Name":           name,
+		"Driver":         driver,
+		"CheckDuplicate": true,
+		"Labels":         n.labels(),
+	}, nil)
+}
+
+func (n *native) ensureVolume(ctx context.Context, name string, driver string) error {
+	err := n.engine.call(ctx, "GET", "/volumes/"+name, nil, nil, nil)
+	if !notFound(err) {
+		return err
+	}
+	fmt.Printf("Creating volume %s\n", name)
+	return n.engine.call(ctx, "POST", "/volumes/create", nil, map[string]interface{}{
+		"Name":   name,
+		"Driver": driver,
+		"Labels": n.labels(),
+	}, nil)
+}
+
+func (n *native) ensureImage(ctx context.Context, image string) error {
+	err := n.engine.call(ctx, "GET", "/images/"+image+"/json", nil, nil, nil)
+	if !notFound(err) {
+		return err
+	}
+	fmt.Printf("Pulling %s\n", image)
+	return n.engine.pull(ctx, image)
+}
+
+// ensureContainer creates and starts the container of the service.
+// A container created with a different configuration is re-created.
+func (n *native) ensureContainer(ctx context.Context, f *File, s *Service) error {
+	name := n.containerName(s)
+	config, err := n.containerConfig(f, s)
+	if err != nil {
+		return err
+	}
+
+	existing := struct {
+		ID     string
+		Config struct{ Labels map[string]string }
+		State  struct{ Running bool }
+	}{}
+	err = n.engine.call(ctx, "GET", "/containers/"+name+"/json", nil, nil, &existing)
+	switch {
+	case notFound(err):
+	case err != nil:
+		return err
+	case existing.Config.Labels[configHashLabel] == config.Labels[configHashLabel]:
+		if existing.State.Running {
+			fmt.Printf("%s is up-to-date\n", name)
+			return nil
+		}
+		fmt.Printf("Starting %s\n", name)
+		return n.engine.call(ctx, "POST", "/containers/"+existing.ID+"/start", nil, nil, nil)
+	default:
+		fmt.Printf("Recreating %s\n", name)
+		err = n.remove(ctx, existing.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Creating %s\n", name)
+	created := struct{ ID string }{}
+	err = n.engine.call(ctx, "POST", "/containers/create", url.Values{"name": {name}}, config, &created)
+	if err != nil {
+		return err
+	}
+
+	networks := s.networks()
+	if f.Version != "" && len(networks) > 1 {
+		for _, network := range networks[1:] {
+			err = n.engine.call(ctx, "POST", "/networks/"+n.networkName(f, network)+"/connect", nil, map[string]interface{}{
+				"Container":      created.ID,
+				"EndpointConfig": map[string]interface{}{"Aliases": []string{s.Name}},
+			}, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return n.engine.call(ctx, "POST", "/containers/"+created.ID+"/start", nil, nil, nil)
+}
+
+type portBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string
+}
+
+type restartPolicy struct {
+	Name              string
+	MaximumRetryCount int
+}
+
+type hostConfig struct {
+	Binds         []string                 `json:",omitempty"`
+	PortBindings  map[string][]portBinding `json:",omitempty"`
+	RestartPolicy restartPolicy
+	NetworkMode   string   `json:",omitempty"`
+	Links         []string `json:",omitempty"`
+}
+
+type containerConfig struct {
+	Image            string
+	Hostname         string              `json:",omitempty"`
+	Cmd              []string            `json:",omitempty"`
+	Entrypoint       []string            `json:",omitempty"`
+	Env              []string            `json:",omitempty"`
+	ExposedPorts     map[string]struct{} `json:",omitempty"`
+	Volumes          map[string]struct{} `json:",omitempty"`
+	Labels           map[string]string
+	HostConfig       hostConfig
+	NetworkingConfig struct {
+		EndpointsConfig map[string]interface{} `json:",omitempty"`
+	}
+}
+
+func (n *native) containerConfig(f *File, s *Service) (*containerConfig, error) {
+	c := &containerConfig{
+		Image:        s.Image,
+		Hostname:     s.Hostname,
+		Cmd:          s.Command,
+		Entrypoint:   s.Entrypoint,
+		Env:          s.Environment,
+		ExposedPorts: map[string]struct{}{},
+		Volumes:      map[string]struct{}{},
+		Labels:       map[string]string{},
+	}
+	for k, v := range s.Labels {
+		c.Labels[k] = v
+	}
+
+	c.HostConfig.PortBindings = map[string][]portBinding{}
+	for _, p := range s.Ports {
+		port, binding, err := parsePort(p)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %s", s.Name, err)
+		}
+		c.ExposedPorts[port] = struct{}{}
+		if binding != nil {
+			c.HostConfig.PortBindings[port] = append(c.HostConfig.PortBindings[port], *binding)
+		}
+	}
+
+	for _, v := range s.Volumes {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) == 1 {
+			// anonymous volume
+			c.Volumes[v] = struct{}{}
+			continue
+		}
+		source := parts[0]
+		switch {
+		case strings.HasPrefix(source, "~"):
+			source = filepath.Join(os.Getenv("HOME"), source[1:])
+		case strings.HasPrefix(source, "."):
+			source = filepath.Join(n.s.dir(), source)
+		case !filepath.IsAbs(source):
+			if vol, exist := f.Volumes[source]; !exist || !vol.External {
+				source = n.name(source)
+			}
+		}
+		c.HostConfig.Binds = append(c.HostConfig.Binds, source+":"+parts[1])
+	}
+
+	if s.Restart != "" && s.Restart != "no" {
+		parts := strings.SplitN(s.Restart, ":", 2)
+		c.HostConfig.RestartPolicy.Name = parts[0]
+		if len(parts) == 2 {
+			fmt.Sscanf(parts[1], "%d", &c.HostConfig.RestartPolicy.MaximumRetryCount)
+		}
+	}
+
+	links := []string{}
+	for _, l := range s.Links {
+		parts := strings.SplitN(l, ":", 2)
+		alias := parts[len(parts)-1]
+		links = append(links, n.containerName(f.Services[parts[0]])+":"+alias)
+	}
+
+	switch {
+	case strings.HasPrefix(s.NetworkMode, "service:"):
+		c.HostConfig.NetworkMode = "container:" + n.containerName(f.Services[strings.TrimPrefix(s.NetworkMode, "service:")])
+	case s.NetworkMode != "":
+		c.HostConfig.NetworkMode = s.NetworkMode
+	case f.Version == "":
+		// version 1 services are on the default bridge, and linked
+		c.HostConfig.Links = links
+	default:
+		primary := n.networkName(f, s.networks()[0])
+		c.HostConfig.NetworkMode = primary
+		c.NetworkingConfig.EndpointsConfig = map[string]interface{}{
+			primary: map[string]interface{}{
+				"Aliases": []string{s.Name},
+				"Links":   links,
+			},
+		}
+	}
+
+	content, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	c.Labels[configHashLabel] = fmt.Sprintf("%x", sha256.Sum256(content))
+	c.Labels[projectLabel] = n.project
+	c.Labels[serviceLabel] = s.Name
+	c.Labels[numberLabel] = "1"
+	c.Labels[oneoffLabel] = "False"
+	return c, nil
+}
+
+// parsePort parses [[ip:]host:]container[/protocol] into the container port,
+// as the engine keys it, and its binding on the host if published.
+func parsePort(spec string) (string, *portBinding, error) {
+	protocol := "tcp"
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		spec, protocol = spec[:i], spec[i+1:]
+	}
+	if strings.Contains(spec, "-") {
+		return "", nil, fmt.Errorf("port ranges such as %s are not supported by the native composer", spec)
+	}
+
+	parts := strings.Split(spec, ":")
+	port := parts[len(parts)-1] + "/" + protocol
+	switch len(parts) {
+	case 1:
+		return port, nil, nil
+	case 2:
+		return port, &portBinding{HostPort: parts[0]}, nil
+	case 3:
+		return port, &portBinding{HostIP: parts[0], HostPort: parts[1]}, nil
+	}
+	return "", nil, fmt.Errorf("invalid port %s", spec)
+}
+
+// networks returns the networks of the service, the first one being
+// the network the container is created on.
+func (s *Service) networks() []string {
+	if s.NetworkMode != "" {
+		return nil
+	}
+	if len(s.Networks) == 0 {
+		return []string{"default"}
+	}
+	return s.Networks
+}
+
+type containerSummary struct {
+	ID     string `json:"Id"`
+	Labels map[string]string
+}
+
+// containers lists containers of the project, or only running ones.
+func (n *native) containers(ctx context.Context, all bool) ([]containerSummary, error) {
+	query := filters("label", projectLabel+"="+n.project)
+	if all {
+		query.Set("all", "1")
+	}
+	result := []containerSummary{}
+	err := n.engine.call(ctx, "GET", "/containers/json", query, nil, &result)
+	return result, err
+}
+
+func (n *native) remove(ctx context.Context, id string) error {
+	err := n.engine.call(ctx, "POST", "/containers/"+id+"/stop", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return n.engine.call(ctx, "DELETE", "/containers/"+id, nil, nil, nil)
+}
+
+// Down removes containers and networks of the project.
+// Volumes are kept, as docker-compose down does.
+func (n *native) Down(ctx context.Context) error {
+	containers, err := n.containers(ctx, true)
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		fmt.Printf("Removing %s_%s_%s\n", n.project, c.Labels[serviceLabel], c.Labels[numberLabel])
+		err = n.remove(ctx, c.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	networks := []struct {
+		ID   string `json:"Id"`
+		Name string
+	}{}
+	err = n.engine.call(ctx, "GET", "/networks", filters("label", projectLabel+"="+n.project), nil, &networks)
+	if err != nil {
+		return err
+	}
+	for _, net := range networks {
+		fmt.Printf("Removing network %s\n", net.Name)
+		err = n.engine.call(ctx, "DELETE", "/networks/"+net.ID, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *native) Running(ctx context.Context) (bool, error) {
+	containers, err := n.containers(ctx, false)
+	if err != nil {
+		return false, err
+	}
+	return len(containers) > 0, nil
+}
+
+func (n *native) States(ctx context.Context) (map[string][]string, error) {
+	containers, err := n.containers(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string][]string{}
+	for _, c := range containers {
+		inspect := struct {
+			State struct {
+				Status string
+				Health *struct{ Status string }
+			}
+		}{}
+		err = n.engine.call(ctx, "GET", "/containers/"+c.ID+"/json", nil, nil, &inspect)
+		if err != nil {
+			return nil, err
+		}
+		state := inspect.State.Status
+		if inspect.State.Health != nil {
+			state = inspect.State.Health.Status
+		}
+		service := c.Labels[serviceLabel]
+		result[service] = append(result[service], state)
+	}
+	for _, states := range result {
+		sort.Strings(states)
+	}
+	return result, nil
+}
@@ -0,0 +1,294 @@
+package composition
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/dpmtest"
+)
+
+// fakeEngine is an in-memory Docker Engine API,
+// serving what the native composer uses of it.
+type fakeEngine struct {
+	sync.Mutex
+	images     map[string]bool
+	networks   map[string]map[string]string
+	volumes    map[string]bool
+	containers map[string]*containerConfig
+	running    map[string]bool
+	calls      []string
+}
+
+func newFakeEngine() *fakeEngine {
+	return &fakeEngine{
+		images:     map[string]bool{"postgres": true},
+		networks:   map[string]map[string]string{},
+		volumes:    map[string]bool{},
+		containers: map[string]*containerConfig{},
+		running:    map[string]bool{},
+	}
+}
+
+func (e *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.Lock()
+	defer e.Unlock()
+	e.calls = append(e.calls, r.Method+" "+r.URL.Path)
+
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "no such object"})
+	}
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && path[0] == "images":
+		if !e.images[strings.Join(path[1:len(path)-1], "/")] {
+			notFound()
+		}
+	case r.Method == "POST" && r.URL.Path == "/images/create":
+		e.images[r.URL.Query().Get("fromImage")] = true
+		w.Write([]byte(`{"status":"Pulling"}{"status":"Done"}`))
+	case r.Method == "GET" && r.URL.Path == "/networks":
+		result := []map[string]string{}
+		for name := range e.networks {
+			result = append(result, map[string]string{"Id": name, "Name": name})
+		}
+		json.NewEncoder(w).Encode(result)
+	case r.Method == "GET" && path[0] == "networks":
+		if e.networks[path[1]] == nil {
+			notFound()
+		}
+	case r.Method == "POST" && r.URL.Path == "/networks/create":
+		body := struct{ Name string }{}
+		json.NewDecoder(r.Body).Decode(&body)
+		e.networks[body.Name] = map[string]string{}
+	case r.Method == "POST" && path[0] == "networks" && path[2] == "connect":
+		body := struct{ Container string }{}
+		json.NewDecoder(r.Body).Decode(&body)
+		e.networks[path[1]][body.Container] = body.Container
+	case r.Method == "DELETE" && path[0] == "networks":
+		delete(e.networks, path[1])
+	case r.Method == "GET" && path[0] == "volumes":
+		if !e.volumes[path[1]] {
+			notFound()
+		}
+	case r.Method == "POST" && r.URL.Path == "/volumes/create":
+		body := struct{ Name string }{}
+		json.NewDecoder(r.Body).Decode(&body)
+		e.volumes[body.Name] = true
+	case r.Method == "GET" && r.URL.Path == "/containers/json":
+		result := []containerSummary{}
+		for id, c := range e.containers {
+			if r.URL.Query().Get("all") == "1" || e.running[id] {
+				result = append(result, containerSummary{id, c.Labels})
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	case r.Method == "GET" && path[0] == "containers":
+		c := e.containers[path[1]]
+		if c == nil {
+			notFound()
+			return
+		}
+		status := "exited"
+		if e.running[path[1]] {
+			status = "running"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ID":     path[1],
+			"Config": map[string]interface{}{"Labels": c.Labels},
+			"State":  map[string]interface{}{"Running": e.running[path[1]], "Status": status},
+		})
+	case r.Method == "POST" && r.URL.Path == "/containers/create":
+		c := &containerConfig{}
+		json.NewDecoder(r.Body).Decode(c)
+		id := r.URL.Query().Get("name")
+		e.containers[id] = c
+		json.NewEncoder(w).Encode(map[string]string{"Id": id})
+	case r.Method == "POST" && path[0] == "containers" && path[2] == "start":
+		e.running[path[1]] = true
+	case r.Method == "POST" && path[0] == "containers" && path[2] == "stop":
+		e.running[path[1]] = false
+	case r.Method == "DELETE" && path[0] == "containers":
+		delete(e.containers, path[1])
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func setupNative(t *testing.T, composition string) (*Spec, *fakeEngine, func()) {
+	home, err := ioutil.TempDir("", "dpm-native")
+	assert.NoError(t, err)
+	dir := filepath.Join(home, ".dpm", "workspace", "1234")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(composition), 0644))
+
+	fake := newFakeEngine()
+	server := httptest.NewServer(fake)
+
+	// the engine is a local host, dpm's own DOCKER_HOST is not used
+	assert.NoError(t, os.MkdirAll(filepath.Join(home, ".dpm", "hosts"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(home, ".dpm", "hosts", "none.yml"), []byte(`
+name: none
+driver: local
+docker-env:
+- DOCKER_HOST=tcp://`+strings.TrimPrefix(server.URL, "http://")+`
+`), 0600))
+
+	oldHome, oldHost := os.Getenv("HOME"), os.Getenv("DOCKER_HOST")
+	os.Setenv("HOME", home)
+	os.Setenv("DOCKER_HOST", "tcp://127.0.0.1:1")
+	os.Setenv("DPM_COMPOSER", NativeBackend)
+
+	s := &Spec{host: "none", hash: "1234", projectName: "My-App", compositionFile: "docker-compose.yml"}
+	return s, fake, func() {
+		server.Close()
+		os.Setenv("HOME", oldHome)
+		os.Setenv("DOCKER_HOST", oldHost)
+		os.Unsetenv("DPM_COMPOSER")
+		os.RemoveAll(home)
+	}
+}
+
+func TestNativeUpDown(t *testing.T) {
+	s, fake, teardown := setupNative(t, `
+version: "2"
+services:
+  web:
+    image: nginx:1.11
+    depends_on: [db]
+    ports: ["8080:80"]
+    environment:
+      PORT: ${PORT}
+    volumes:
+    - ./html:/usr/share/nginx/html:ro
+    networks: [front, back]
+  db:
+    image: postgres
+    volumes:
+    - data:/var/lib/postgresql/data
+    networks: [back]
+networks:
+  front:
+  back:
+volumes:
+  data:
+`)
+	defer teardown()
+	s.Params = map[string]string{"port": "80"}
+
+	ctx := context.Background()
+	assert.NoError(t, s.Up(ctx))
+	assert.True(t, fake.images["nginx"])
+	assert.NotNil(t, fake.networks["myapp_front"])
+	assert.NotNil(t, fake.networks["myapp_back"])
+	assert.True(t, fake.volumes["myapp_data"])
+	assert.Equal(t, fake.networks["myapp_back"]["myapp_web_1"], "myapp_web_1")
+
+	// db is created before web, which depends on it
+	created := []string{}
+	for _, call := range fake.calls {
+		if strings.HasSuffix(call, "/start") {
+			created = append(created, call)
+		}
+	}
+	assert.Equal(t, created, []string{
+		"POST /containers/myapp_db_1/start",
+		"POST /containers/myapp_web_1/start",
+	})
+
+	web := fake.containers["myapp_web_1"]
+	assert.Equal(t, web.Env, []string{"PORT=80"})
+	assert.Equal(t, web.HostConfig.NetworkMode, "myapp_front")
+	assert.Equal(t, web.HostConfig.PortBindings["80/tcp"], []portBinding{{HostPort: "8080"}})
+	assert.Equal(t, web.HostConfig.Binds, []string{filepath.Join(s.dir(), "html") + ":/usr/share/nginx/html:ro"})
+	assert.Equal(t, web.Labels[serviceLabel], "web")
+	assert.Equal(t, fake.containers["myapp_db_1"].HostConfig.Binds, []string{"myapp_data:/var/lib/postgresql/data"})
+
+	running, err := s.Running(ctx)
+	assert.NoError(t, err)
+	assert.True(t, running)
+	states, err := s.States(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, states, map[string][]string{"web": {"running"}, "db": {"running"}})
+
+	// nothing changed, nothing is re-created
+	fake.calls = nil
+	assert.NoError(t, s.Up(ctx))
+	for _, call := range fake.calls {
+		assert.NotEqual(t, call, "POST /containers/create")
+	}
+
+	// a changed parameter re-creates the container
+	s.Params["port"] = "8000"
+	assert.NoError(t, s.Up(ctx))
+	assert.Equal(t, fake.containers["myapp_web_1"].Env, []string{"PORT=8000"})
+
+	assert.NoError(t, s.Down(ctx))
+	assert.Empty(t, fake.containers)
+	assert.Empty(t, fake.networks)
+	assert.True(t, fake.volumes["myapp_data"])
+	running, err = s.Running(ctx)
+	assert.NoError(t, err)
+	assert.False(t, running)
+}
+
+func TestNativeLinksV1(t *testing.T) {
+	s, fake, teardown := setupNative(t, `
+web:
+  image: postgres
+  links:
+  - db:database
+db:
+  image: postgres
+  restart: on-failure:3
+`)
+	defer teardown()
+
+	assert.NoError(t, s.Up(context.Background()))
+	assert.Empty(t, fake.networks)
+	assert.Equal(t, fake.containers["myapp_web_1"].HostConfig.Links, []string{"myapp_db_1:database"})
+	assert.Equal(t, fake.containers["myapp_db_1"].HostConfig.RestartPolicy, restartPolicy{"on-failure", 3})
+}
+
+func TestNativeEngineError(t *testing.T) {
+	s, _, teardown := setupNative(t, `
+web:
+  image: postgres
+  ports: ["8080"]
+`)
+	defer teardown()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(os.Getenv("HOME"), ".dpm", "hosts", "none.yml"),
+		[]byte("name: none\ndriver: local\ndocker-env:\n- DOCKER_HOST=ftp://localhost\n"), 0600))
+
+	err := s.Up(context.Background())
+	assert.EqualError(t, err, "Unsupported DOCKER_HOST 'ftp://localhost'")
+}
+
+func TestEngineOverSSH(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	// docker system dial-stdio answering a single request
+	h.Fake("ssh", `while read -r line; do
+	case "$line" in
+	"$(printf '\r')"|"") break ;;
+	esac
+done
+printf 'HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 20\r\nConnection: close\r\n\r\n{"Version":"1.13.1"}'
+`)
+
+	e, err := newEngine([]string{"DOCKER_HOST=ssh://core@10.0.0.3:2222"})
+	assert.NoError(t, err)
+	version := struct{ Version string }{}
+	assert.NoError(t, e.call(context.Background(), "GET", "/version", nil, nil, &version))
+	assert.Equal(t, version.Version, "1.13.1")
+	assert.Equal(t, h.Calls("ssh"), []string{"-p 2222 -l core -- 10.0.0.3 docker system dial-stdio"})
+}
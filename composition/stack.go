@@ -0,0 +1,145 @@
+package composition
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// stack deploys the compose file as a stack of a swarm-mode cluster,
+// through the docker CLI talking to a manager. The compose file must
+// be of a version docker stack deploy accepts, 3 or later.
+type stack struct {
+	s    *Spec
+	name string
+}
+
+func newStack(s *Spec) *stack {
+	return &stack{s, projectName(s.projectName)}
+}
+
+func (st *stack) docker(ctx context.Context, args ...string) (*exec.Cmd, error) {
+	env, err := st.s.env()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Env = env
+	cmd.Dir = st.s.dir()
+	return cmd, nil
+}
+
+func (st *stack) attach(ctx context.Context, args ...string) error {
+	cmd, err := st.docker(ctx, args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (st *stack) Up(ctx context.Context) error {
+	return st.attach(ctx, "stack", "deploy", "--compose-file", st.s.compositionFile, st.name)
+}
+
+func (st *stack) Down(ctx context.Context) error {
+	return st.attach(ctx, "stack", "rm", st.name)
+}
+
+// replicas returns running and desired replicas of services of the stack.
+func (st *stack) replicas(ctx context.Context) (map[string][2]int, error) {
+	cmd, err := st.docker(ctx, "stack", "services", "--format", "{{.Name}} {{.Replicas}}", st.name)
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list services of stack %s: %s", st.name, strings.TrimSpace(string(out)))
+	}
+	return parseReplicas(st.name, string(out)), nil
+}
+
+// parseReplicas parses lines of service names and replicas, like
+// "app_web 1/2", into running and desired replicas by service.
+// Global services are reported the same way.
+func parseReplicas(stack string, out string) map[string][2]int {
+	result := map[string][2]int{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		var running, desired int
+		_, err := fmt.Sscanf(fields[1], "%d/%d", &running, &desired)
+		if err != nil {
+			continue
+		}
+		result[strings.TrimPrefix(fields[0], stack+"_")] = [2]int{running, desired}
+	}
+	return result
+}
+
+func (st *stack) Running(ctx context.Context) (bool, error) {
+	replicas, err := st.replicas(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range replicas {
+		if r[0] > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// States returns, by service, running for each running replica
+// and starting for the others.
+func (st *stack) States(ctx context.Context) (map[string][]string, error) {
+	replicas, err := st.replicas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string][]string{}
+	for service, r := range replicas {
+		states := []string{}
+		for i := 0; i < r[1]; i++ {
+			state := "starting"
+			if i < r[0] {
+				state = "running"
+			}
+			states = append(states, state)
+		}
+		result[service] = states
+	}
+	return result, nil
+}
+
+// Logs prints logs of the services of the stack, or all services if none given.
+func (st *stack) Logs(ctx context.Context, follow bool, services ...string) error {
+	if len(services) == 0 {
+		replicas, err := st.replicas(ctx)
+		if err != nil {
+			return err
+		}
+		for service := range replicas {
+			services = append(services, service)
+		}
+	}
+	if follow && len(services) > 1 {
+		return fmt.Errorf("Logs of a single service can be followed on swarm-mode clusters")
+	}
+	for _, service := range services {
+		args := []string{"service", "logs"}
+		if follow {
+			args = append(args, "-f")
+		}
+		err := st.attach(ctx, append(args, st.name+"_"+service)...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
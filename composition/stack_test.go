@@ -0,0 +1,15 @@
+package composition
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReplicas(t *testing.T) {
+	replicas := parseReplicas("app", "app_web 1/2\napp_agent 3/3 (max 1 per node)\nbroken\n")
+	assert.Equal(t, replicas, map[string][2]int{
+		"web":   {1, 2},
+		"agent": {3, 3},
+	})
+}
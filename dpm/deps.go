@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/repo"
+)
+
+// describe returns name:version of the package of the hash,
+// looked up in the index first, for packages not extracted.
+func describe(entries repo.Entries, hash string) string {
+	if e := entries.FindByHash(hash); e != nil {
+		return e.PackageName + ":" + e.Version
+	}
+	return build.Describe(hash)
+}
+
+// cachedDeps merges dependency graphs of all packages in the local cache.
+func cachedDeps() (build.DepGraph, error) {
+	home := os.Getenv("HOME")
+	dir := filepath.Join(home, ".dpm", "cache")
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(build.DepGraph)
+	for _, f := range infos {
+		if !strings.HasSuffix(f.Name(), ".dpm") {
+			continue
+		}
+		p, err := build.LoadPackage(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		deps, err := p.Deps()
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range deps {
+			result[k] = append(result[k], v...)
+		}
+	}
+	return result, nil
+}
+
+func printTree(g build.DepGraph, hash string, indent string, path map[string]bool, entries repo.Entries) {
+	fmt.Printf("%s%s (%s)\n", indent, describe(entries, hash), build.ShortHash(hash))
+	if path[hash] {
+		return
+	}
+	path[hash] = true
+	children := append([]string{}, g[hash]...)
+	sort.Strings(children)
+	for _, child := range children {
+		printTree(g, child, indent+"  ", path, entries)
+	}
+	delete(path, hash)
+}
+
+func printDot(g build.DepGraph, root string, entries repo.Entries) {
+	reachable := map[string]bool{}
+	var visit func(string)
+	visit = func(n string) {
+		if reachable[n] {
+			return
+		}
+		reachable[n] = true
+		for _, m := range g[n] {
+			visit(m)
+		}
+	}
+	visit(root)
+
+	nodes := []string{}
+	for n := range reachable {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+
+	fmt.Println("digraph dpm {")
+	for _, n := range nodes {
+		fmt.Printf("  %q [label=%q];\n", build.ShortHash(n), describe(entries, n))
+	}
+	for _, n := range nodes {
+		children := append([]string{}, g[n]...)
+		sort.Strings(children)
+		for _, m := range children {
+			fmt.Printf("  %q -> %q;\n", build.ShortHash(n), build.ShortHash(m))
+		}
+	}
+	fmt.Println("}")
+}
+
+func doDeps(c *cli.Context) {
+	home := os.Getenv("HOME")
+	packageName := c.Args().First()
+	entry, err := repo.Get(packageName, "")
+	if err != nil {
+		fmt.Println("Cannot find package in the index")
+		os.Exit(1)
+	}
+
+	p, err := extractEntry(entry)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// names are best effort, hashes are printed when not found
+	entries, _ := repo.LoadIndex(filepath.Join(home, ".dpm", "index", "dpm.index"))
+
+	graph, err := p.Deps()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if c.Bool("reverse") {
+		graph, err = cachedDeps()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		graph = graph.Reverse()
+	}
+
+	switch c.String("format") {
+	case "dot":
+		printDot(graph, entry.Hash, entries)
+
+	case "tree":
+		if c.Bool("reverse") {
+			fmt.Println("Required by:")
+		} else {
+			fmt.Println("Dependencies:")
+		}
+		printTree(graph, entry.Hash, "  ", map[string]bool{}, entries)
+		if c.Bool("reverse") {
+			return
+		}
+
+		order, err := p.Order()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("\nInstall order:")
+		for i, hash := range order {
+			fmt.Printf("  %d. %s (%s)\n", i+1, describe(entries, hash), build.ShortHash(hash))
+		}
+
+	default:
+		fmt.Printf("Unknown format '%s'\n", c.String("format"))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/build"
+)
+
+func TestPrintDanglingDependency(t *testing.T) {
+	// a crafted DEPS may name a dependency by less than a hash
+	g := build.DepGraph{"0123456789abcdef": {"abc"}}
+	assert.NotPanics(t, func() {
+		printTree(g, "0123456789abcdef", "  ", map[string]bool{}, nil)
+		printDot(g, "0123456789abcdef", nil)
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/swasd/dpm/provision"
+)
+
+// shellFormats are how variables are set and unset in each shell.
+// Values are quoted, so the output can be evaluated whatever they have.
+var shellFormats = map[string]struct {
+	set, unset, eval string
+	quote            func(string) string
+}{
+	"bash":       {`export %s=%s`, `unset %s`, `eval $(%s)`, quoteBash},
+	"fish":       {`set -gx %s %s;`, `set -e %s;`, `eval (%s)`, quoteFish},
+	"powershell": {`$Env:%s = %s`, `Remove-Item Env:\%s`, `& %s | Invoke-Expression`, quotePowerShell},
+	"cmd":        {`SET "%s=%s"`, `SET %s=`, `@FOR /f "tokens=*" %%i IN ('%s') DO @%%i`, quoteCmd},
+}
+
+// quoteBash single quotes the value, nothing is expanded in it.
+func quoteBash(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// quoteFish single quotes the value, where only \ and ' are escaped.
+func quoteFish(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	return "'" + strings.Replace(value, "'", `\'`, -1) + "'"
+}
+
+// quotePowerShell single quotes the value, where ' is doubled.
+func quotePowerShell(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// quoteCmd leaves the value to the quotes around the assignment,
+// in which cmd takes &, | and < literally. A " cannot be escaped, it is dropped.
+func quoteCmd(value string) string {
+	return strings.Replace(value, `"`, "", -1)
+}
+
+// readEnvFile reads KEY=VALUE lines of an .env file written by ExportEnvsToFile.
+func readEnvFile(filename string) ([][2]string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := [][2]string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && parts[0] != "" {
+			result = append(result, [2]string{parts[0], parts[1]})
+		}
+	}
+	return result, nil
+}
+
+func doEnv(c *cli.Context) {
+	home := os.Getenv("HOME")
+	name := c.Args().First()
+	if name == "" {
+		fmt.Println("Specify the package to print the environment of")
+		os.Exit(1)
+	}
+	shell := c.String("shell")
+	format, exist := shellFormats[shell]
+	if !exist {
+		fmt.Printf("Unknown shell '%s', use bash, fish, powershell or cmd\n", shell)
+		os.Exit(1)
+	}
+	unset := c.Bool("unset")
+
+	hash, packageSpec, params, err := findInstalled(name)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	provSpec, err := loadProvision(hash, packageSpec, params, "")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	em := provSpec.ExportedMachine()
+
+	// docker-machine knows how to connect, given the dpm storage path
+	args := []string{"-s", filepath.Join(home, ".dpm"), "env", "--shell", shell}
+	if em.Mode == provision.Swarm {
+		args = append(args, "--swarm")
+	}
+	if unset {
+		args = append(args, "--unset")
+	}
+	h, err := provision.LoadHost(em.Name)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	out := []byte{}
+	if h != nil {
+		// existing hosts are not known by docker-machine
+		for _, e := range h.Env() {
+			kv := strings.SplitN(e, "=", 2)
+			if unset {
+				fmt.Printf(format.unset+"\n", kv[0])
+			} else {
+				fmt.Printf(format.set+"\n", kv[0], format.quote(kv[1]))
+			}
+		}
+	} else {
+		out, err = exec.Command("docker-machine", append(args, em.Name)...).Output()
+		if err != nil {
+			fmt.Printf("Cannot get the environment of machine %s: %s\n", em.Name, err)
+			os.Exit(1)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		// drop docker-machine hints, ours is printed below
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "REM") {
+			continue
+		}
+		fmt.Println(line)
+	}
+
+	envs, err := readEnvFile(filepath.Join(home, ".dpm", "workspace", hash, ".env"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, kv := range envs {
+		if unset {
+			fmt.Printf(format.unset+"\n", kv[0])
+		} else {
+			fmt.Printf(format.set+"\n", kv[0], format.quote(kv[1]))
+		}
+	}
+
+	command := "dpm env --shell " + shell
+	if unset {
+		command += " --unset"
+	}
+	comment := "#"
+	if shell == "cmd" {
+		comment = "REM"
+	}
+	fmt.Printf("%s Run this command to configure your shell:\n", comment)
+	fmt.Printf("%s "+format.eval+"\n", comment, command+" "+name)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellQuote(t *testing.T) {
+	value := `a "b" $HOME ` + "`id`" + ` 'c' \d`
+
+	// the shell gets the value back as is
+	format := shellFormats["bash"]
+	out, err := exec.Command("sh", "-c", fmt.Sprintf(format.set, "X", format.quote(value))+`; printf %s "$X"`).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, string(out), value)
+
+	assert.Equal(t, shellFormats["fish"].quote(value), `'a "b" $HOME `+"`id`"+` \'c\' \\d'`)
+	assert.Equal(t, shellFormats["powershell"].quote(value), `'a "b" $HOME `+"`id`"+` ''c'' \d'`)
+	assert.Equal(t, fmt.Sprintf(shellFormats["powershell"].unset, "X"), `Remove-Item Env:\X`)
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/composition"
+	"github.com/swasd/dpm/healthcheck"
+	"github.com/swasd/dpm/hook"
+	"github.com/swasd/dpm/provision"
+	"github.com/swasd/dpm/render"
+	"github.com/swasd/dpm/repo"
+	"github.com/swasd/dpm/state"
+)
+
+// exitInterrupted reports machines left in the middle of creation
+// and terminates dpm.
+func exitInterrupted() {
+	fmt.Println("Installation was interrupted.")
+	pending, err := provision.PendingMachines()
+	if err == nil && len(pending) > 0 {
+		fmt.Printf("Machines not completely provisioned: %s\n", strings.Join(pending, ", "))
+	}
+	fmt.Println("Run install with --resume to continue it.")
+	os.Exit(1)
+}
+
+// extractEntry loads the cached package of the entry
+// and extracts it with all dependencies, if not yet extracted.
+func extractEntry(entry *repo.Entry) (*build.Package, error) {
+	home := os.Getenv("HOME")
+	p, err := build.LoadPackage(filepath.Join(home, ".dpm", "cache", entry.Filename))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(filepath.Join(home, ".dpm", "workspace", entry.Hash))
+	if err != nil {
+		err = p.Extract(filepath.Join(home, ".dpm", "workspace", entry.Hash))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func install(c *cli.Context) {
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	home := os.Getenv("HOME")
+	packageName := c.Args().First()
+	entry, err := repo.Get(packageName, "")
+	if err != nil {
+		fmt.Println("Cannot find package in the index")
+		os.Exit(1)
+	}
+
+	packageFile := filepath.Join(home, ".dpm", "cache", entry.Filename)
+	_, err = os.Stat(packageFile)
+	if err != nil {
+		// not existed
+		doInstall(c)
+	}
+
+	p, err := extractEntry(entry)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	hashes, err := p.Order()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Dependencies resolved...")
+
+	values, err := readValues(c)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	params, err := resolveParams(hashes, entry.Hash, values)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	journal, err := state.LoadJournal(entry.Hash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if c.Bool("resume") == false {
+		if journal.Empty() == false && c.Bool("from-scratch") == false {
+			fmt.Printf("A previous install of %s did not finish.\n", packageName)
+			fmt.Println("Run install with --resume to continue it, or with --from-scratch to start over.")
+			os.Exit(1)
+		}
+		err = journal.Reset()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	em, err := installPackages(ctx, hashes, params, journal, "")
+	if err != nil {
+		if ctx.Err() != nil {
+			exitInterrupted()
+		}
+		fmt.Println(err)
+		if c.Bool("no-rollback") {
+			fmt.Println("Rollback skipped, resources created by this install are left as is.")
+			os.Exit(1)
+		}
+
+		fmt.Println("Rolling back...")
+		err = rollback(ctx, journal, params, "")
+		if err != nil {
+			fmt.Println(err)
+		}
+		os.Exit(1)
+	}
+
+	// all steps are done, nothing to resume
+	err = journal.Reset()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = recordInstallation(entry, hashes, em, params[entry.Hash])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	mode := "engine"
+	if em.Mode == provision.Swarm || em.Mode == provision.SwarmMode {
+		mode = "cluster"
+	}
+	fmt.Printf("\nExported machine is %s.\n", em.Name)
+	fmt.Printf("Run \"eval $(dpm env %s)\" to connect to your Docker %s.\n", packageName, mode)
+
+}
+
+// installPackages provisions and composes the packages in order,
+// skipping steps the journal already has.
+// It returns the machine exported by the last package.
+func installPackages(ctx context.Context, hashes []string, params map[string]map[string]string, journal *state.Journal, driver string) (provision.ExportedMachine, error) {
+	var em provision.ExportedMachine
+	for _, hash := range hashes {
+		if ctx.Err() != nil {
+			return em, ctx.Err()
+		}
+
+		packageSpec, err := build.ReadSpec(hash)
+		if err != nil {
+			return em, err
+		}
+
+		fmt.Printf("Installing %s:%s (%s)...\n", packageSpec.Name, packageSpec.Version, build.ShortHash(hash))
+
+		err = runHooks(ctx, hook.PreInstall, hash, packageSpec, params[hash], provision.ExportedMachine{}, journal, driver)
+		if err != nil {
+			return em, err
+		}
+
+		em, err = provisionPackage(ctx, hash, packageSpec, params[hash], journal, driver)
+		if err != nil {
+			return em, err
+		}
+
+		err = composePackage(ctx, hash, packageSpec, em, params[hash], journal)
+		if err != nil {
+			return em, err
+		}
+
+		err = waitHealthy(ctx, hash, packageSpec, params[hash], em, driver)
+		if err != nil {
+			return em, err
+		}
+
+		err = runHooks(ctx, hook.PostInstall, hash, packageSpec, params[hash], em, journal, driver)
+		if err != nil {
+			return em, err
+		}
+	}
+
+	return em, nil
+}
+
+// hookEnv returns the environment of hooks of the package,
+// including the Docker env of the machine, if any.
+func hookEnv(hash string, packageSpec *build.Spec, params map[string]string, em provision.ExportedMachine, driver string) []string {
+	home := os.Getenv("HOME")
+	env := []string{
+		"DPM_PACKAGE=" + packageSpec.Name,
+		"DPM_VERSION=" + packageSpec.Version,
+		"DPM_WORKSPACE=" + filepath.Join(home, ".dpm", "workspace", hash),
+	}
+	if em.Name != "" {
+		env = append(env, "DPM_MACHINE="+em.Name)
+		if provSpec, err := loadProvision(hash, packageSpec, params, driver); err == nil {
+			if m := provSpec.Machine(em.Name); m != nil {
+				env = append(env, m.GetEnv()...)
+			}
+		}
+	}
+	for k, v := range params {
+		env = append(env, build.ParamEnv(k)+"="+v)
+	}
+	return env
+}
+
+// runHooks runs hooks of the package at the lifecycle point.
+// With a journal, hooks already run are skipped.
+func runHooks(ctx context.Context, point string, hash string, packageSpec *build.Spec, params map[string]string, em provision.ExportedMachine, journal *state.Journal, driver string) error {
+	hooks := hook.Of(packageSpec, point)
+	if len(hooks) == 0 {
+		return nil
+	}
+	if journal != nil && journal.IsDone(hash, state.HookRun, point) {
+		return nil
+	}
+
+	home := os.Getenv("HOME")
+	dir := filepath.Join(home, ".dpm", "workspace", hash)
+	err := hook.Run(ctx, point, hooks, dir, hookEnv(hash, packageSpec, params, em, driver))
+	if err != nil {
+		return err
+	}
+	if journal != nil {
+		return journal.Done(hash, state.HookRun, point)
+	}
+	return nil
+}
+
+// healthProbe returns the probe of the health check of the package, if any.
+func healthProbe(hash string, packageSpec *build.Spec, params map[string]string, em provision.ExportedMachine, driver string) (healthcheck.Probe, error) {
+	h := packageSpec.Healthcheck
+	if h == nil {
+		return nil, nil
+	}
+	err := h.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	provSpec, err := loadProvision(hash, packageSpec, params, driver)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case h.HTTP != "":
+		url, err := provSpec.Expand("healthcheck.http", h.HTTP)
+		if err != nil {
+			return nil, err
+		}
+		return healthcheck.HTTP(url), nil
+	case h.TCP != "":
+		address, err := provSpec.Expand("healthcheck.tcp", h.TCP)
+		if err != nil {
+			return nil, err
+		}
+		return healthcheck.TCP(address), nil
+	case h.Command != "":
+		home := os.Getenv("HOME")
+		dir := filepath.Join(home, ".dpm", "workspace", hash)
+		return healthcheck.Command(h.Command, dir, hookEnv(hash, packageSpec, params, em, driver)), nil
+	default:
+		compose, err := composeProject(em, hash, packageSpec, params)
+		if err != nil {
+			return nil, err
+		}
+		return healthcheck.Status(func(ctx context.Context) ([]string, error) {
+			return compose.ServiceStates(ctx, h.Service)
+		}), nil
+	}
+}
+
+// waitHealthy waits for the health check of the package to pass,
+// so its dependents get provisioned once it is ready.
+func waitHealthy(ctx context.Context, hash string, packageSpec *build.Spec, params map[string]string, em provision.ExportedMachine, driver string) error {
+	probe, err := healthProbe(hash, packageSpec, params, em, driver)
+	if err != nil || probe == nil {
+		return err
+	}
+	timeout, interval, err := packageSpec.Healthcheck.Durations()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Waiting for %s to be ready...\n", packageSpec.Name)
+	err = healthcheck.Wait(ctx, probe, timeout, interval)
+	if err != nil {
+		return fmt.Errorf("Package %s is not healthy: %s", packageSpec.Name, err)
+	}
+	return nil
+}
+
+// loadProvision loads the provision file of the package
+// with values of its parameters. A driver, if not empty,
+// replaces the driver of all machines.
+func loadProvision(hash string, packageSpec *build.Spec, params map[string]string, driver string) (*provision.Spec, error) {
+	home := os.Getenv("HOME")
+	provisionFile := filepath.Join(home, ".dpm", "workspace", hash, packageSpec.Provision)
+	provSpec, err := provision.Load(provisionFile, params)
+	if err != nil || driver == "" {
+		return provSpec, err
+	}
+	// options of the package drivers do not apply to the replacing one
+	for name, m := range provSpec.MachineSpecs {
+		m.Driver = driver
+		m.Options = nil
+		provSpec.MachineSpecs[name] = m
+	}
+	return provSpec, nil
+}
+
+// composeProject returns the compose project of the package,
+// rendering its composition first if it is a template.
+func composeProject(em provision.ExportedMachine, hash string, packageSpec *build.Spec, params map[string]string) (*composition.Spec, error) {
+	home := os.Getenv("HOME")
+	spec := *packageSpec
+	if render.IsTemplate(spec.Composition) {
+		// groups of machines do not depend on their drivers
+		provSpec, err := loadProvision(hash, packageSpec, params, "")
+		if err != nil {
+			return nil, err
+		}
+
+		dir := filepath.Join(home, ".dpm", "workspace", hash)
+		content, err := ioutil.ReadFile(filepath.Join(dir, spec.Composition))
+		if err != nil {
+			return nil, err
+		}
+		out, err := render.Render(spec.Composition, content, &render.Context{
+			Params: params,
+			Groups: provSpec.Groups(),
+			IP:     provision.IP,
+		})
+		if err != nil {
+			return nil, err
+		}
+		spec.Composition = render.Target(spec.Composition)
+		// the rendered composition has values of parameters
+		target := filepath.Join(dir, spec.Composition)
+		err = ioutil.WriteFile(target, out, 0600)
+		if err != nil {
+			return nil, err
+		}
+		err = os.Chmod(target, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	compose, err := composition.NewProject(em, hash, &spec)
+	if err != nil {
+		return nil, err
+	}
+	compose.Params = params
+	return compose, nil
+}
+
+// provisionPackage provisions machines of the package and exports its envs.
+func provisionPackage(ctx context.Context, hash string, packageSpec *build.Spec, params map[string]string, journal *state.Journal, driver string) (provision.ExportedMachine, error) {
+	home := os.Getenv("HOME")
+
+	var em provision.ExportedMachine
+	provSpec, err := loadProvision(hash, packageSpec, params, driver)
+	if err != nil {
+		return em, err
+	}
+	provSpec.Journal = journal.For(hash)
+
+	times := 0
+loop:
+	err = provSpec.Provision(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return em, ctx.Err()
+		}
+		fmt.Println(err)
+		times++
+		if times < 10 {
+			goto loop
+		}
+		return em, err
+	}
+
+	if journal.IsDone(hash, state.EnvExported, "") == false {
+		err = provSpec.ExportEnvsToFile(filepath.Join(home, ".dpm", "workspace", hash, ".env"))
+		if err != nil {
+			return em, err
+		}
+		err = journal.Done(hash, state.EnvExported, "")
+		if err != nil {
+			return em, err
+		}
+	}
+
+	return provSpec.ExportedMachine(), nil
+}
+
+// composePackage brings the composition of the package up on the machine.
+func composePackage(ctx context.Context, hash string, packageSpec *build.Spec, em provision.ExportedMachine, params map[string]string, journal *state.Journal) error {
+	if journal.IsDone(hash, state.ComposeUp, packageSpec.Name) {
+		return nil
+	}
+
+	compose, err := composeProject(em, hash, packageSpec, params)
+	if err != nil {
+		return err
+	}
+
+	// only a project started by this install gets rolled back,
+	// one which cannot be told not running is left alone
+	running, err := compose.Running(ctx)
+	if err != nil {
+		return err
+	}
+	if running == false {
+		err = journal.Done(hash, state.ProjectCreated, packageSpec.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = compose.Up(ctx)
+	if err != nil {
+		return err
+	}
+	return journal.Done(hash, state.ComposeUp, packageSpec.Name)
+}
+
+// recordInstallation remembers the package as installed.
+func recordInstallation(entry *repo.Entry, hashes []string, em provision.ExportedMachine, params map[string]string) error {
+	installations, err := state.LoadInstallations()
+	if err != nil {
+		return err
+	}
+	packageSpec, err := build.ReadSpec(entry.Hash)
+	if err != nil {
+		return err
+	}
+	params, secrets, err := sealParams(entry.PackageName, packageSpec, params)
+	if err != nil {
+		return err
+	}
+	installations = installations.Put(&state.Installation{
+		Name:    entry.PackageName,
+		Version: entry.Version,
+		Hash:    entry.Hash,
+		Order:   hashes,
+		Machine: em.Name,
+		Params:  params,
+		Secrets: secrets,
+	})
+	return installations.Save()
+}
+
+// rollback tears down, in reverse order, projects and machines
+// created by the journaled install, with the driver it used.
+// Resources existed before are untouched.
+func rollback(ctx context.Context, journal *state.Journal, params map[string]map[string]string, driver string) error {
+	failed := false
+	for i := len(journal.Steps) - 1; i >= 0; i-- {
+		step := journal.Steps[i]
+		if step.Action != state.ProjectCreated && step.Action != provision.MachineCreated {
+			continue
+		}
+
+		// a step which cannot be undone does not stop the others
+		packageSpec, err := build.ReadSpec(step.Package)
+		if err != nil {
+			fmt.Println(err)
+			failed = true
+			continue
+		}
+		provSpec, err := loadProvision(step.Package, packageSpec, params[step.Package], driver)
+		if err != nil {
+			fmt.Println(err)
+			failed = true
+			continue
+		}
+
+		switch step.Action {
+		case state.ProjectCreated:
+			fmt.Printf("  ... removing containers of %s\n", step.Target)
+			compose, err := composeProject(provSpec.ExportedMachine(), step.Package, packageSpec, params[step.Package])
+			if err == nil {
+				err = compose.Down(ctx)
+			}
+			if err != nil {
+				fmt.Println(err)
+				failed = true
+			}
+
+		case provision.MachineCreated:
+			fmt.Printf("  ... removing machine %s\n", step.Target)
+			m := provSpec.Machine(step.Target)
+			if m == nil {
+				continue
+			}
+			err = m.Remove(ctx)
+			if err != nil {
+				fmt.Println(err)
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("Rollback did not complete, run the command again with --resume or --from-scratch to retry")
+	}
+	return journal.Reset()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/composition"
+	"github.com/swasd/dpm/dpmtest"
+	"github.com/swasd/dpm/provision"
+	"github.com/swasd/dpm/repo"
+	"github.com/swasd/dpm/secret"
+	"github.com/swasd/dpm/state"
+)
+
+func packageFiles(name, url string) map[string]string {
+	return map[string]string{
+		"SPEC.yml": `---
+specVersion: 0.2.0
+spec:
+  name: ` + name + `
+  version: 1.0.0
+  provision: provision.yml
+  composition: composition.yml
+`,
+		"provision.yml": `---
+machines:
+  ` + name + `:
+    driver: none
+    export: true
+    options:
+      url: ` + url + `
+`,
+		"composition.yml": name + ":\n  image: " + name + "\n",
+	}
+}
+
+func TestInstallPackages(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+	h.FakeCompose()
+	os.Setenv("DPM_COMPOSER", composition.ComposeBackend)
+	defer os.Unsetenv("DPM_COMPOSER")
+
+	consulFiles := packageFiles("consul", "tcp://10.0.0.1:2376")
+	consul := h.AddPackage("consul", "1.0.0", dpmtest.Package(consulFiles))
+	// as built, the package has its dependencies under their hashes
+	webFiles := packageFiles("web", "tcp://10.0.0.2:2376")
+	webFiles["DEPS"] = "this: [" + consul + "]\n" + consul + ": []\n"
+	for name, content := range consulFiles {
+		webFiles[consul+"/"+name] = content
+	}
+	web := h.AddPackage("web", "1.0.0", dpmtest.Package(webFiles))
+
+	entry, err := repo.Get("web", "")
+	assert.NoError(t, err)
+	p, err := extractEntry(entry)
+	assert.NoError(t, err)
+	hashes, err := p.Order()
+	assert.NoError(t, err)
+	assert.Equal(t, hashes, []string{consul, web})
+	params, err := resolveParams(hashes, web, map[string]string{})
+	assert.NoError(t, err)
+	journal, err := state.LoadJournal(web)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	em, err := installPackages(ctx, hashes, params, journal, "")
+	assert.NoError(t, err)
+	assert.Equal(t, em, provision.ExportedMachine{Name: "web", Mode: provision.Standalone})
+	assert.Equal(t, h.Calls("docker-compose"), []string{
+		"-p consul -f composition.yml ps -q",
+		"-p consul -f composition.yml up -d",
+		"-p web -f composition.yml ps -q",
+		"-p web -f composition.yml up -d",
+	})
+	ip, err := provision.IP("consul")
+	assert.NoError(t, err)
+	assert.Equal(t, ip, "10.0.0.1")
+
+	// a resumed install has nothing left to do
+	_, err = installPackages(ctx, hashes, params, journal, "")
+	assert.NoError(t, err)
+	assert.Equal(t, len(h.Calls("docker-compose")), 4)
+
+	assert.NoError(t, rollback(ctx, journal, params, ""))
+	assert.Equal(t, h.Calls("docker-compose")[4:], []string{
+		"-p web -f composition.yml down",
+		"-p consul -f composition.yml down",
+	})
+	_, err = provision.IP("consul")
+	assert.Error(t, err)
+	assert.True(t, journal.Empty())
+}
+
+func TestComposePackageUnknownState(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+	h.Fake("docker-compose", "echo cannot connect >&2; exit 1\n")
+	os.Setenv("DPM_COMPOSER", composition.ComposeBackend)
+	defer os.Unsetenv("DPM_COMPOSER")
+	// the machine exists, its Docker cannot be reached
+	assert.NoError(t, exec.Command("docker-machine", "-s", filepath.Join(h.Dir, ".dpm"), "create", "--driver", "none", "--url", "tcp://10.0.0.2:2376", "web").Run())
+
+	hash := h.AddPackage("web", "1.0.0", dpmtest.Package(packageFiles("web", "tcp://10.0.0.2:2376")))
+	entry, err := repo.Get("web", "")
+	assert.NoError(t, err)
+	_, err = extractEntry(entry)
+	assert.NoError(t, err)
+	packageSpec, err := build.ReadSpec(hash)
+	assert.NoError(t, err)
+	journal, err := state.LoadJournal(hash)
+	assert.NoError(t, err)
+
+	err = composePackage(context.Background(), hash, packageSpec, provision.ExportedMachine{Name: "web"}, nil, journal)
+	assert.EqualError(t, err, "exit status 1")
+	// the project may have existed before, rollback must not remove it
+	assert.True(t, journal.Empty())
+	assert.Equal(t, h.Calls("docker-compose"), []string{"-p web -f composition.yml ps -q"})
+}
+
+func TestRollbackContinues(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+	h.FakeCompose()
+	os.Setenv("DPM_COMPOSER", composition.ComposeBackend)
+	defer os.Unsetenv("DPM_COMPOSER")
+
+	hash := h.AddPackage("web", "1.0.0", dpmtest.Package(packageFiles("web", "tcp://10.0.0.2:2376")))
+	entry, err := repo.Get("web", "")
+	assert.NoError(t, err)
+	_, err = extractEntry(entry)
+	assert.NoError(t, err)
+	params := map[string]map[string]string{hash: {}}
+	journal, err := state.LoadJournal(hash)
+	assert.NoError(t, err)
+	_, err = installPackages(context.Background(), []string{hash}, params, journal, "")
+	assert.NoError(t, err)
+	// a step of a package gone from the workspace
+	assert.NoError(t, journal.Done("0123abcd", state.ProjectCreated, "gone"))
+
+	err = rollback(context.Background(), journal, params, "")
+	assert.EqualError(t, err, "Rollback did not complete, run the command again with --resume or --from-scratch to retry")
+	assert.Equal(t, h.Calls("docker-compose")[2:], []string{"-p web -f composition.yml down"})
+	_, err = provision.IP("web")
+	assert.Error(t, err)
+	assert.False(t, journal.Empty())
+}
+
+func TestLoadProvisionDriver(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	hash := h.AddPackage("web", "1.0.0", dpmtest.Package(packageFiles("web", "tcp://10.0.0.2:2376")))
+	entry, err := repo.Get("web", "")
+	assert.NoError(t, err)
+	p, err := extractEntry(entry)
+	assert.NoError(t, err)
+	packageSpec, err := p.Spec()
+	assert.NoError(t, err)
+
+	provSpec, err := loadProvision(hash, packageSpec, nil, "")
+	assert.NoError(t, err)
+	assert.Equal(t, provSpec.MachineSpecs["web"].Driver, "none")
+	assert.NotNil(t, provSpec.MachineSpecs["web"].Options)
+
+	provSpec, err = loadProvision(hash, packageSpec, nil, provision.LocalDriver)
+	assert.NoError(t, err)
+	assert.Equal(t, provSpec.MachineSpecs["web"].Driver, provision.LocalDriver)
+	assert.Nil(t, provSpec.MachineSpecs["web"].Options)
+}
+
+func TestRecordSecretParameter(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	os.Setenv(secret.PassphraseEnv, "open sesame")
+	defer os.Unsetenv(secret.PassphraseEnv)
+
+	files := packageFiles("web", "tcp://10.0.0.2:2376")
+	files["SPEC.yml"] += `  parameters:
+    token:
+      secret: true
+    region: {}
+`
+	h.AddPackage("web", "1.0.0", dpmtest.Package(files))
+	entry, err := repo.Get("web", "")
+	assert.NoError(t, err)
+	_, err = extractEntry(entry)
+	assert.NoError(t, err)
+
+	params := map[string]string{"token": "abcdef123456", "region": "sgp1"}
+	assert.NoError(t, recordInstallation(entry, []string{entry.Hash}, provision.ExportedMachine{}, params))
+
+	filename := filepath.Join(os.Getenv("HOME"), ".dpm", "installed.yml")
+	content, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "abcdef123456")
+	assert.Contains(t, string(content), "sgp1")
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0600))
+
+	installations, err := state.LoadInstallations()
+	assert.NoError(t, err)
+	values, err := installedParams(installations.FindByName("web"))
+	assert.NoError(t, err)
+	assert.Equal(t, values, params)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/composition"
+	"github.com/swasd/dpm/state"
+)
+
+// findInstalled finds a package installed directly or as a dependency.
+// It returns its hash, spec and parameter values.
+func findInstalled(name string) (string, *build.Spec, map[string]string, error) {
+	installations, err := state.LoadInstallations()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	for _, installed := range installations {
+		for _, hash := range installed.Order {
+			packageSpec, err := build.ReadSpec(hash)
+			if err != nil || packageSpec.Name != name {
+				continue
+			}
+			if hash != installed.Hash {
+				return hash, packageSpec, packageSpec.DefaultParameters(), nil
+			}
+			params, err := installedParams(installed)
+			return hash, packageSpec, params, err
+		}
+	}
+	return "", nil, nil, fmt.Errorf("Package %s is not installed", name)
+}
+
+// installedProject finds the compose project of an installed package.
+func installedProject(name string) (*composition.Spec, error) {
+	hash, packageSpec, params, err := findInstalled(name)
+	if err != nil {
+		return nil, err
+	}
+	provSpec, err := loadProvision(hash, packageSpec, params, "")
+	if err != nil {
+		return nil, err
+	}
+	return composeProject(provSpec.ExportedMachine(), hash, packageSpec, params)
+}
+
+// commandArgs returns arguments after the --, if any.
+func commandArgs(args []string) []string {
+	if len(args) > 0 && args[0] == "--" {
+		return args[1:]
+	}
+	return args
+}
+
+func doLogs(c *cli.Context) {
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	// flags are parsed only before arguments, so accept -f after them too
+	follow := c.Bool("follow")
+	args := []string{}
+	for _, arg := range c.Args() {
+		if arg == "-f" || arg == "--follow" {
+			follow = true
+			continue
+		}
+		args = append(args, arg)
+	}
+	if len(args) < 1 {
+		fmt.Println("Specify the package to show logs of")
+		os.Exit(1)
+	}
+
+	compose, err := installedProject(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = compose.Logs(ctx, follow, args[1:]...)
+	if err != nil && ctx.Err() == nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func doExec(c *cli.Context) {
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	args := c.Args()
+	if len(args) < 3 {
+		fmt.Println("Specify the package, the service and the command to run")
+		os.Exit(1)
+	}
+	compose, err := installedProject(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = compose.Exec(ctx, args[1], commandArgs(args[2:]))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/codegangsta/cli"
 	"github.com/swasd/dpm/build"
-	"github.com/swasd/dpm/composition"
+	"github.com/swasd/dpm/hook"
+	"github.com/swasd/dpm/lint"
 	"github.com/swasd/dpm/provision"
 	"github.com/swasd/dpm/repo"
+	"github.com/swasd/dpm/schema"
+	"github.com/swasd/dpm/state"
 )
 
 func cp(src, dst string) (err error) {
@@ -43,6 +50,23 @@ func cp(src, dst string) (err error) {
 	return
 }
 
+// interruptible returns a context which is cancelled on SIGINT or SIGTERM,
+// so running commands get stopped and no new work is started.
+// A second signal terminates dpm immediately.
+func interruptible() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fmt.Println("\nInterrupted, stopping...")
+		cancel()
+		<-sig
+		os.Exit(1)
+	}()
+	return ctx, cancel
+}
+
 func doInstall(c *cli.Context) {
 	home := os.Getenv("HOME")
 	packageName := c.Args().First()
@@ -85,112 +109,10 @@ func doInstall(c *cli.Context) {
 	}
 }
 
-func install(c *cli.Context) {
-	home := os.Getenv("HOME")
-	packageName := c.Args().First()
-	entry, err := repo.Get(packageName, "")
-	if err != nil {
-		fmt.Println("Cannot find package in the index")
-		os.Exit(1)
-	}
-
-	packageFile := filepath.Join(home, ".dpm", "cache", entry.Filename)
-	_, err = os.Stat(packageFile)
-	if err != nil {
-		// not existed
-		doInstall(c)
-	}
-
-	p, err := build.LoadPackage(packageFile)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	// extract the package
-	// it will extract all dependencies in process
-	_, err = os.Stat(filepath.Join(home, ".dpm", "workspace", entry.Hash))
-	if err != nil {
-		err = p.Extract(filepath.Join(home, ".dpm", "workspace", entry.Hash))
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-	}
-
-	hashes, err := p.Order()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-	fmt.Println("Dependencies resolved...")
-
-	var em provision.ExportedMachine
-	for _, hash := range hashes {
-
-		packageSpec, err := build.ReadSpec(hash)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-		fmt.Printf("Installing %s:%s (%s)...\n", packageSpec.Name, packageSpec.Version, hash[0:8])
-
-		provisionFile := filepath.Join(home, ".dpm", "workspace", hash, packageSpec.Provision)
-		provSpec, err := provision.LoadFromFile(provisionFile)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-		times := 0
-	loop:
-		err = provSpec.Provision()
-		if err != nil {
-			fmt.Println(err)
-			times++
-			if times < 10 {
-				goto loop
-			}
-			os.Exit(1)
-		}
-
-		err = provSpec.ExportEnvsToFile(filepath.Join(home, ".dpm", "workspace", hash, ".env"))
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-		em = provSpec.ExportedMachine()
-
-		compose, err := composition.NewProject(em, hash, packageSpec)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-		err = compose.Up()
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-	}
-
-	flag := ""
-	mode := "engine"
-	if em.Mode == provision.Swarm {
-		flag = "--swarm "
-		mode = "cluster"
-	}
-	fmt.Printf("\nExported machine is %s.\n", em.Name)
-	fmt.Printf("Run \"docker-machine env %s%s\" to see how to connect to your Docker %s.\n", flag, em.Name, mode)
-
-}
-
 func doInit(c *cli.Context) {
 	force := c.Bool("force")
 	spec := `---
-specVersion: 0.1.0
+specVersion: 0.2.0
 spec:
   name: unnamed-cluster
   version: 0.1.0
@@ -198,7 +120,8 @@ spec:
   provision: provision.yml
   composition: composition.yml
   dependencies:
-    package: version=1.0.0
+    package:
+      version: 1.0.0
   description: >
     This is the description.
 `
@@ -223,7 +146,8 @@ spec:
 	provision := `---
 machines:
   node:
-    driver: none
+    driver: local
+    export: true
 
 `
 	write = force
@@ -331,6 +255,79 @@ func generateIndex(dir string, outdir string) error {
 	return entries.Save(filepath.Join(outdir, "dpm.index"))
 }
 
+func doLint(c *cli.Context) {
+	dir := "."
+	if len(c.Args()) >= 1 {
+		dir = c.Args().First()
+	}
+
+	problems := lint.Dir(dir)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Println("No problems found")
+}
+
+func doMigrate(c *cli.Context) {
+	dir := "."
+	if len(c.Args()) >= 1 {
+		dir = c.Args().First()
+	}
+
+	specFile := filepath.Join(dir, "SPEC.yml")
+	content, err := ioutil.ReadFile(specFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	migrated, from, err := build.MigrateSpec(content)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if from == build.SpecVersion {
+		fmt.Printf("%s is already at version %s\n", specFile, build.SpecVersion)
+		return
+	}
+
+	if c.Bool("dry-run") {
+		fmt.Print(string(migrated))
+		return
+	}
+	err = ioutil.WriteFile(specFile, migrated, 0644)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Migrated %s from version %s to %s\n", specFile, from, build.SpecVersion)
+	fmt.Println("Comments and formatting are not preserved, please review the file")
+}
+
+func doSchema(c *cli.Context) {
+	var s *schema.Schema
+	switch c.Args().First() {
+	case "spec":
+		s = schema.Spec()
+	case "provision":
+		s = schema.Provision()
+	default:
+		fmt.Println("Specify the schema to print, spec or provision")
+		os.Exit(1)
+	}
+
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(string(content))
+}
+
 func doIndex(c *cli.Context) {
 	home := os.Getenv("HOME")
 	dir := "."
@@ -351,6 +348,9 @@ func doIndex(c *cli.Context) {
 }
 
 func doRemove(c *cli.Context) {
+	ctx, cancel := interruptible()
+	defer cancel()
+
 	home := os.Getenv("HOME")
 	packageName := c.Args().First()
 	e, err := repo.LoadIndex(filepath.Join(home, ".dpm", "index", "dpm.index"))
@@ -384,20 +384,61 @@ func doRemove(c *cli.Context) {
 		os.Exit(1)
 	}
 
-	provisionFile := filepath.Join(home, "/.dpm/workspace", entry.Hash, packageSpec.Provision)
-	provSpec, err := provision.LoadFromFile(provisionFile)
+	// the installed version may differ from the one in the index
+	hash := entry.Hash
+	installations, err := state.LoadInstallations()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	params := packageSpec.DefaultParameters()
+	if installed := installations.FindByName(packageSpec.Name); installed != nil {
+		hash = installed.Hash
+		params, err = installedParams(installed)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		packageSpec, err = build.ReadSpec(hash)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 
-	err = provSpec.RemoveMachines()
+	err = removePackage(ctx, hash, packageSpec, params)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = installations.Remove(packageSpec.Name).Save()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 }
 
+// removePackage removes machines of the package, running its remove hooks.
+func removePackage(ctx context.Context, hash string, packageSpec *build.Spec, params map[string]string) error {
+	provSpec, err := loadProvision(hash, packageSpec, params, "")
+	if err != nil {
+		return err
+	}
+
+	err = runHooks(ctx, hook.PreRemove, hash, packageSpec, params, provSpec.ExportedMachine(), nil, "")
+	if err != nil {
+		return err
+	}
+
+	err = provSpec.RemoveMachines(ctx)
+	if err != nil {
+		return err
+	}
+
+	return runHooks(ctx, hook.PostRemove, hash, packageSpec, params, provision.ExportedMachine{}, nil, "")
+}
+
 func doInfo(c *cli.Context) {
 	home := os.Getenv("HOME")
 	packageName := c.Args().First()
@@ -446,7 +487,41 @@ func main() {
 			Name:    "install",
 			Aliases: []string{"i"},
 			Usage:   "install the package",
-			Action:  install,
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "continue the unfinished install from its first incomplete step",
+				},
+				cli.BoolFlag{
+					Name:  "from-scratch",
+					Usage: "ignore steps recorded by the unfinished install and start over",
+				},
+				cli.BoolFlag{
+					Name:  "no-rollback",
+					Usage: "keep resources created by a failed install for debugging",
+				},
+			}, paramsFlags...),
+			Action: install,
+		},
+		{
+			Name:      "upgrade",
+			Usage:     "upgrade the installed package",
+			ArgsUsage: "<package> [version]",
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "continue the unfinished upgrade from its first incomplete step",
+				},
+				cli.BoolFlag{
+					Name:  "from-scratch",
+					Usage: "ignore steps recorded by the unfinished upgrade and start over",
+				},
+				cli.BoolFlag{
+					Name:  "no-rollback",
+					Usage: "keep resources created by a failed upgrade for debugging",
+				},
+			}, paramsFlags...),
+			Action: doUpgrade,
 		},
 		{
 			Name:    "build",
@@ -461,6 +536,94 @@ func main() {
 			},
 			Action: doBuild,
 		},
+		{
+			Name:      "status",
+			Usage:     "show machines, services and health of installed packages",
+			ArgsUsage: "[package]",
+			Action:    doStatus,
+		},
+		{
+			Name:      "logs",
+			Usage:     "show logs of services of the installed package",
+			ArgsUsage: "<package> [service...]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "follow, f",
+					Usage: "follow log output",
+				},
+			},
+			Action: doLogs,
+		},
+		{
+			Name:            "exec",
+			Usage:           "run a command in a service of the installed package",
+			ArgsUsage:       "<package> <service> -- <command> [args...]",
+			SkipFlagParsing: true,
+			Action:          doExec,
+		},
+		{
+			Name:      "env",
+			Usage:     "print the environment to connect to the installed package",
+			ArgsUsage: "<package>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "shell",
+					Value: "bash",
+					Usage: "shell to print the environment for, bash, fish, powershell or cmd",
+				},
+				cli.BoolFlag{
+					Name:  "unset, u",
+					Usage: "print commands to unset the environment instead",
+				},
+			},
+			Action: doEnv,
+		},
+		{
+			Name:      "lint",
+			Usage:     "check the package files for problems",
+			ArgsUsage: "[dir]",
+			Action:    doLint,
+		},
+		{
+			Name:      "test",
+			Usage:     "install the package in a throwaway home and run its tests",
+			ArgsUsage: "[dir]",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "tap",
+					Usage: "report format, tap or junit",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "file to write the report to instead of stdout",
+				},
+				cli.BoolFlag{
+					Name:  "keep-drivers",
+					Usage: "provision machines with drivers of the packages instead of the local host",
+				},
+			}, paramsFlags...),
+			Action: doTest,
+		},
+		{
+			Name:      "migrate",
+			Usage:     "upgrade SPEC.yml to the current spec version",
+			ArgsUsage: "[dir]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the migrated SPEC.yml instead of writing it",
+				},
+			},
+			Action: doMigrate,
+		},
+		secretCommand,
+		{
+			Name:      "schema",
+			Usage:     "print JSON Schema of SPEC.yml or provision.yml",
+			ArgsUsage: "spec|provision",
+			Action:    doSchema,
+		},
 		{
 			Name:  "index",
 			Usage: "generate dpm.index",
@@ -483,6 +646,23 @@ func main() {
 			Usage:  "show info of the package",
 			Action: doInfo,
 		},
+		{
+			Name:      "deps",
+			Usage:     "show dependencies of the package",
+			ArgsUsage: "<package>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "reverse",
+					Usage: "show packages depending on the package",
+				},
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "tree",
+					Usage: "output format, tree or dot",
+				},
+			},
+			Action: doDeps,
+		},
 		{
 			Name:   "init",
 			Usage:  "init the package files",
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/secret"
+	"github.com/swasd/dpm/state"
+
+	"gopkg.in/yaml.v2"
+)
+
+// readValues collects parameter values from the --values file
+// and --set flags, the latter taking precedence.
+func readValues(c *cli.Context) (map[string]string, error) {
+	values := map[string]string{}
+
+	if filename := c.String("values"); filename != "" {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		m := map[string]interface{}{}
+		err = yaml.Unmarshal(content, &m)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		for k, v := range m {
+			switch v.(type) {
+			case map[interface{}]interface{}, []interface{}:
+				return nil, fmt.Errorf("%s: value of %s must be a scalar", filename, k)
+			case nil:
+				values[k] = ""
+			default:
+				values[k] = fmt.Sprint(v)
+			}
+		}
+	}
+
+	for _, each := range c.StringSlice("set") {
+		parts := strings.SplitN(each, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("--set %s must be in key=value format", each)
+		}
+		values[parts[0]] = parts[1]
+	}
+	return values, nil
+}
+
+// resolveParams resolves parameters of all packages in the install order
+// before anything gets provisioned. Values are for the requested package
+// of the root hash, dependencies get their defaults.
+func resolveParams(hashes []string, root string, values map[string]string) (map[string]map[string]string, error) {
+	result := map[string]map[string]string{}
+	for _, hash := range hashes {
+		spec, err := build.ReadSpec(hash)
+		if err != nil {
+			return nil, err
+		}
+		v := map[string]string{}
+		if hash == root {
+			v = values
+		}
+		params, err := spec.ResolveParameters(v)
+		if err != nil {
+			return nil, err
+		}
+		result[hash] = params
+	}
+	return result, nil
+}
+
+// sealParams splits values of secret parameters of the package off params,
+// encrypted to be recorded with the installation of the package name.
+func sealParams(name string, packageSpec *build.Spec, params map[string]string) (map[string]string, map[string]string, error) {
+	plain := map[string]string{}
+	sealed := map[string]string{}
+	var store *secret.Store
+	for k, v := range params {
+		if !packageSpec.Parameters[k].Secret || v == "" {
+			plain[k] = v
+			continue
+		}
+		if store == nil {
+			var err error
+			store, err = secret.Open()
+			if err != nil {
+				return nil, nil, fmt.Errorf("Cannot keep secret parameter %s: %s", k, err)
+			}
+		}
+		encrypted, err := store.Encrypt(name+"."+k, v)
+		if err != nil {
+			return nil, nil, err
+		}
+		sealed[k] = encrypted
+	}
+	return plain, sealed, nil
+}
+
+// installedParams returns values of parameters of the installation,
+// secret ones decrypted.
+func installedParams(i *state.Installation) (map[string]string, error) {
+	result := map[string]string{}
+	for k, v := range i.Params {
+		result[k] = v
+	}
+	if len(i.Secrets) == 0 {
+		return result, nil
+	}
+	store, err := secret.Open()
+	if err != nil {
+		return nil, err
+	}
+	for k, encrypted := range i.Secrets {
+		result[k], err = store.Decrypt(i.Name+"."+k, encrypted)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// paramsFlags are the flags supplying parameter values.
+var paramsFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "set",
+		Usage: "set a package parameter, as key=value",
+		Value: &cli.StringSlice{},
+	},
+	cli.StringFlag{
+		Name:  "values",
+		Usage: "YAML file of package parameter values",
+	},
+}
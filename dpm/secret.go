@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/swasd/dpm/secret"
+)
+
+// secret names are referred as ${secret.name}, so cannot have dots
+var secretName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func openSecrets() *secret.Store {
+	store, err := secret.Open()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return store
+}
+
+func doSecretSet(c *cli.Context) {
+	name := c.Args().First()
+	if !secretName.MatchString(name) {
+		fmt.Println("Specify a secret name made of letters, digits, '-' and '_'")
+		os.Exit(1)
+	}
+
+	value := c.Args().Get(1)
+	if len(c.Args()) < 2 {
+		// read from stdin to keep the value out of the shell history
+		fmt.Fprintf(os.Stderr, "Value of %s: ", name)
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		value = strings.TrimRight(line, "\r\n")
+	}
+
+	err := openSecrets().Set(name, value)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Secret %s is set, refer it as ${secret.%s}\n", name, name)
+}
+
+func doSecretGet(c *cli.Context) {
+	value, err := openSecrets().Get(c.Args().First())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(value)
+}
+
+func doSecretList(c *cli.Context) {
+	for _, name := range openSecrets().Names() {
+		fmt.Println(name)
+	}
+}
+
+func doSecretRemove(c *cli.Context) {
+	err := openSecrets().Remove(c.Args().First())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+var secretCommand = cli.Command{
+	Name:  "secret",
+	Usage: "manage secrets referred as ${secret.name} in provision files, encrypted with the passphrase in " + secret.PassphraseEnv,
+	Subcommands: []cli.Command{
+		{
+			Name:      "set",
+			Usage:     "set a secret, reading the value from stdin if not given",
+			ArgsUsage: "<name> [value]",
+			Action:    doSecretSet,
+		},
+		{
+			Name:      "get",
+			Usage:     "print the value of a secret",
+			ArgsUsage: "<name>",
+			Action:    doSecretGet,
+		},
+		{
+			Name:   "list",
+			Usage:  "list names of secrets",
+			Action: doSecretList,
+		},
+		{
+			Name:      "rm",
+			Usage:     "remove a secret",
+			ArgsUsage: "<name>",
+			Action:    doSecretRemove,
+		},
+	},
+}
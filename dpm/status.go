@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/provision"
+	"github.com/swasd/dpm/state"
+)
+
+type byName []*provision.Machine
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name() < b[j].Name() }
+
+// packageStatus prints the state of machines, services and the health check
+// of an installed package. It tells if everything is up.
+func packageStatus(ctx context.Context, hash string, params map[string]string) bool {
+	healthy := true
+	packageSpec, err := build.ReadSpec(hash)
+	if err != nil {
+		fmt.Printf("  %s: %s\n", build.ShortHash(hash), err)
+		return false
+	}
+	fmt.Printf("  %s:%s (%s)\n", packageSpec.Name, packageSpec.Version, build.ShortHash(hash))
+
+	provSpec, err := loadProvision(hash, packageSpec, params, "")
+	if err != nil {
+		fmt.Printf("    %s\n", err)
+		return false
+	}
+
+	machines := provSpec.Machines()
+	sort.Sort(byName(machines))
+	for _, m := range machines {
+		status, err := m.Status()
+		if err != nil {
+			status = err.Error()
+		}
+		if status != "Running" {
+			healthy = false
+		}
+		fmt.Printf("    machine %s: %s\n", m.Name(), status)
+	}
+
+	em := provSpec.ExportedMachine()
+	compose, err := composeProject(em, hash, packageSpec, params)
+	if err == nil {
+		states, err := compose.States(ctx)
+		if err != nil {
+			fmt.Printf("    services: %s\n", err)
+			healthy = false
+		}
+		services := []string{}
+		for s := range states {
+			services = append(services, s)
+		}
+		sort.Strings(services)
+		for _, s := range services {
+			for _, st := range states[s] {
+				if st != "running" && st != "healthy" {
+					healthy = false
+				}
+			}
+			fmt.Printf("    service %s: %s\n", s, strings.Join(states[s], ", "))
+		}
+	} else {
+		fmt.Printf("    services: %s\n", err)
+		healthy = false
+	}
+
+	probe, err := healthProbe(hash, packageSpec, params, em, "")
+	if err == nil && probe != nil {
+		err = probe(ctx)
+		if err == nil {
+			fmt.Println("    healthcheck: ok")
+		}
+	}
+	if err != nil {
+		fmt.Printf("    healthcheck: %s\n", err)
+		healthy = false
+	}
+	return healthy
+}
+
+func doStatus(c *cli.Context) {
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	installations, err := state.LoadInstallations()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if name := c.Args().First(); name != "" {
+		installed := installations.FindByName(name)
+		if installed == nil {
+			fmt.Printf("Package %s is not installed\n", name)
+			os.Exit(1)
+		}
+		installations = state.Installations{installed}
+	}
+	if len(installations) == 0 {
+		fmt.Println("No packages installed")
+		return
+	}
+
+	degraded := false
+	for _, installed := range installations {
+		fmt.Printf("%s:%s\n", installed.Name, installed.Version)
+		healthy := true
+		values, err := installedParams(installed)
+		if err != nil {
+			fmt.Printf("  %s\n", err)
+			degraded = true
+			continue
+		}
+		for _, hash := range installed.Order {
+			params := values
+			if hash != installed.Hash {
+				// dependencies are installed with defaults
+				if spec, err := build.ReadSpec(hash); err == nil {
+					params = spec.DefaultParameters()
+				}
+			}
+			if !packageStatus(ctx, hash, params) {
+				healthy = false
+			}
+		}
+		if healthy {
+			fmt.Println("  status: healthy")
+		} else {
+			fmt.Println("  status: degraded")
+			degraded = true
+		}
+	}
+
+	if degraded {
+		os.Exit(1)
+	}
+}
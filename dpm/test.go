@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/pkgtest"
+	"github.com/swasd/dpm/provision"
+	"github.com/swasd/dpm/repo"
+	"github.com/swasd/dpm/state"
+)
+
+// throwawayHome creates a home with a copy of the package index of home
+// and of the cached packages it references. Nothing is written to home.
+func throwawayHome(home string) (dir string, err error) {
+	dir, err = ioutil.TempDir("", "dpm-test")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	cache := filepath.Join(".dpm", "cache")
+	err = os.MkdirAll(filepath.Join(dir, cache), 0755)
+	if err != nil {
+		return "", err
+	}
+	index := filepath.Join(".dpm", "index", "dpm.index")
+	if _, err := os.Stat(filepath.Join(home, index)); os.IsNotExist(err) {
+		return dir, nil
+	}
+	entries, err := repo.LoadIndex(filepath.Join(home, index))
+	if err != nil {
+		return "", err
+	}
+	err = cp(filepath.Join(home, index), filepath.Join(dir, index))
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		file := filepath.Join(cache, e.Filename)
+		if _, err := os.Stat(filepath.Join(home, file)); os.IsNotExist(err) {
+			// downloaded on install
+			continue
+		}
+		err = cp(filepath.Join(home, file), filepath.Join(dir, file))
+		if err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// testEnv returns the variables to set for tests to run in the throwaway
+// home testHome, tools still reading their configurations from home.
+func testEnv(home, testHome string) map[string]string {
+	env := map[string]string{"HOME": testHome}
+	configs := map[string]string{
+		"DOCKER_CONFIG": filepath.Join(home, ".docker"),
+		"KUBECONFIG":    filepath.Join(home, ".kube", "config"),
+	}
+	for name, path := range configs {
+		if _, set := os.LookupEnv(name); set {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			env[name] = path
+		}
+	}
+	return env
+}
+
+// setenv sets the variables and returns a function restoring them.
+func setenv(env map[string]string) func() {
+	old := map[string]*string{}
+	for name, value := range env {
+		if v, set := os.LookupEnv(name); set {
+			old[name] = &v
+		} else {
+			old[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, v := range old {
+			if v == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *v)
+			}
+		}
+	}
+}
+
+func doTest(c *cli.Context) {
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	dir := "."
+	if len(c.Args()) >= 1 {
+		dir = c.Args().First()
+	}
+	format := c.String("format")
+	if format != pkgtest.TAP && format != pkgtest.JUnit {
+		fmt.Printf("Unknown format '%s', use %s\n", format, strings.Join(pkgtest.Formats, " or "))
+		os.Exit(1)
+	}
+	values, err := readValues(c)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// packages are installed on the local Docker host, unless drivers are kept
+	driver := provision.LocalDriver
+	if c.Bool("keep-drivers") {
+		driver = ""
+	}
+
+	home := os.Getenv("HOME")
+	testHome, err := throwawayHome(home)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	restore := setenv(testEnv(home, testHome))
+	name, results, err := testPackage(ctx, dir, values, driver)
+	restore()
+	os.RemoveAll(testHome)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var w io.Writer = os.Stdout
+	if output := c.String("output"); output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	err = pkgtest.Write(w, format, name, results)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, r := range results {
+		if r.Failure != "" {
+			os.Exit(1)
+		}
+	}
+}
+
+// testPackage builds the package in dir, installs it with its dependencies
+// and runs its tests in the workspace. Installed resources are always
+// removed, even when interrupted. A failed install is reported as a failed
+// test, the package tests being skipped. A driver, if not empty,
+// replaces the driver of all machines.
+func testPackage(ctx context.Context, dir string, values map[string]string, driver string) (string, []pkgtest.Result, error) {
+	home := os.Getenv("HOME")
+	p, err := build.BuildPackage(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	packageSpec, err := p.Spec()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(packageSpec.Tests) == 0 {
+		return "", nil, fmt.Errorf("No tests declared in %s", filepath.Join(dir, "SPEC.yml"))
+	}
+
+	err = p.ExtractIfNotExist()
+	if err != nil {
+		return "", nil, err
+	}
+	hashes, err := p.Order()
+	if err != nil {
+		return "", nil, err
+	}
+	root := p.Sha256()
+	params, err := resolveParams(hashes, root, values)
+	if err != nil {
+		return "", nil, err
+	}
+	journal, err := state.LoadJournal(root)
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		fmt.Println("Cleaning up...")
+		err := rollback(context.Background(), journal, params, driver)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+
+	start := time.Now()
+	em, err := installPackages(ctx, hashes, params, journal, driver)
+	install := pkgtest.Result{Name: "install", Duration: time.Since(start)}
+	if err != nil {
+		install.Failure = err.Error()
+		return packageSpec.Name, append([]pkgtest.Result{install}, pkgtest.Skip(packageSpec.Tests, "install failed")...), nil
+	}
+
+	workspace := filepath.Join(home, ".dpm", "workspace", root)
+	env := hookEnv(root, packageSpec, params[root], em, driver)
+	if em.Name != "" {
+		if ip, err := provision.IP(em.Name); err == nil {
+			env = append(env, "DPM_MACHINE_IP="+ip)
+		}
+	}
+	envs, err := readEnvFile(filepath.Join(workspace, ".env"))
+	if err != nil {
+		return "", nil, err
+	}
+	for _, kv := range envs {
+		env = append(env, kv[0]+"="+kv[1])
+	}
+
+	fmt.Printf("Testing %s:%s...\n", packageSpec.Name, packageSpec.Version)
+	return packageSpec.Name, append([]pkgtest.Result{install}, pkgtest.Run(ctx, packageSpec.Tests, workspace, env)...), nil
+}
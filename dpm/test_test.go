@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/dpmtest"
+	"github.com/swasd/dpm/repo"
+)
+
+func TestThrowawayHome(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	hash := h.AddPackage("web", "1.0", []byte("package"))
+	entries, err := repo.LoadIndex(filepath.Join(h.Dir, ".dpm", "index", "dpm.index"))
+	assert.NoError(t, err)
+	filename := entries.FindByHash(hash).Filename
+	cache := filepath.Join(h.Dir, ".dpm", "cache")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(cache, "unlisted.dpm"), []byte("unlisted"), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(h.Dir, ".kube"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(h.Dir, ".kube", "config"), nil, 0644))
+
+	dir, err := throwawayHome(h.Dir)
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the cache is a copy of the packages of the index
+	content, err := ioutil.ReadFile(filepath.Join(dir, ".dpm", "cache", filename))
+	assert.NoError(t, err)
+	assert.Equal(t, string(content), "package")
+	_, err = os.Stat(filepath.Join(dir, ".dpm", "cache", "unlisted.dpm"))
+	assert.True(t, os.IsNotExist(err))
+	info, err := os.Lstat(filepath.Join(dir, ".dpm", "cache"))
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".dpm", "cache", filename), []byte("changed"), 0644))
+	content, err = ioutil.ReadFile(filepath.Join(cache, filename))
+	assert.NoError(t, err)
+	assert.Equal(t, string(content), "package")
+
+	// tools keep reading their configurations from home
+	os.Unsetenv("KUBECONFIG")
+	os.Setenv("DOCKER_CONFIG", "/etc/docker")
+	defer os.Unsetenv("DOCKER_CONFIG")
+	env := testEnv(h.Dir, dir)
+	assert.Equal(t, env, map[string]string{"HOME": dir, "KUBECONFIG": filepath.Join(h.Dir, ".kube", "config")})
+	restore := setenv(env)
+	assert.Equal(t, os.Getenv("KUBECONFIG"), filepath.Join(h.Dir, ".kube", "config"))
+	restore()
+	_, set := os.LookupEnv("KUBECONFIG")
+	assert.False(t, set)
+	assert.Equal(t, os.Getenv("HOME"), h.Dir)
+}
+
+func TestThrowawayHomeError(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(h.Dir, ".dpm", "index", "dpm.index"), []byte("{"), 0644))
+
+	_, err := throwawayHome(h.Dir)
+	assert.Error(t, err)
+}
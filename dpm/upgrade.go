@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/codegangsta/cli"
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/hook"
+	"github.com/swasd/dpm/provision"
+	"github.com/swasd/dpm/repo"
+	"github.com/swasd/dpm/state"
+)
+
+// compositionChanged tells if the composition of the package
+// differs between the two workspaces.
+func compositionChanged(oldHash string, oldSpec *build.Spec, newHash string, newSpec *build.Spec) bool {
+	home := os.Getenv("HOME")
+	oldContent, err := ioutil.ReadFile(filepath.Join(home, ".dpm", "workspace", oldHash, oldSpec.Composition))
+	if err != nil {
+		return true
+	}
+	newContent, err := ioutil.ReadFile(filepath.Join(home, ".dpm", "workspace", newHash, newSpec.Composition))
+	if err != nil {
+		return true
+	}
+	return !bytes.Equal(oldContent, newContent)
+}
+
+// sameParams tells if both sets of parameter values are equal.
+func sameParams(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, exist := b[k]; !exist || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+func doUpgrade(c *cli.Context) {
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	packageName := c.Args().First()
+	version := c.Args().Get(1)
+
+	installations, err := state.LoadInstallations()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	installed := installations.FindByName(packageName)
+	if installed == nil {
+		fmt.Printf("Package %s is not installed\n", packageName)
+		os.Exit(1)
+	}
+	installed.Params, err = installedParams(installed)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var entry *repo.Entry
+	if version == "" {
+		entry, err = repo.Latest(packageName)
+	} else {
+		entry, err = repo.Get(packageName, version)
+	}
+	if err != nil {
+		fmt.Println("Cannot find package in the index")
+		os.Exit(1)
+	}
+
+	if entry.Hash == installed.Hash && len(c.StringSlice("set")) == 0 && c.String("values") == "" {
+		fmt.Printf("%s:%s is already installed.\n", installed.Name, installed.Version)
+		return
+	}
+
+	p, err := extractEntry(entry)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	hashes, err := p.Order()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Dependencies resolved...")
+
+	newRoot, err := build.ReadSpec(entry.Hash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// values of the installed package are kept,
+	// unless the new version does not have the parameter anymore
+	values := map[string]string{}
+	for k, v := range installed.Params {
+		if _, exist := newRoot.Parameters[k]; exist {
+			values[k] = v
+		}
+	}
+	set, err := readValues(c)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for k, v := range set {
+		values[k] = v
+	}
+	params, err := resolveParams(hashes, entry.Hash, values)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// installed packages by name
+	olds := map[string]string{}
+	for _, hash := range installed.Order {
+		spec, err := build.ReadSpec(hash)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		olds[spec.Name] = hash
+	}
+
+	journal, err := state.LoadJournal(entry.Hash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if c.Bool("resume") == false {
+		if journal.Empty() == false && c.Bool("from-scratch") == false {
+			fmt.Printf("A previous upgrade of %s did not finish.\n", packageName)
+			fmt.Println("Run upgrade with --resume to continue it, or with --from-scratch to start over.")
+			os.Exit(1)
+		}
+		err = journal.Reset()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("Upgrading %s from %s to %s...\n", packageName, installed.Version, entry.Version)
+
+	em, err := upgradePackages(ctx, hashes, params, olds, installed, journal)
+	if err != nil {
+		if ctx.Err() != nil {
+			fmt.Println("Upgrade was interrupted.")
+			fmt.Println("Run upgrade with --resume to continue it.")
+			os.Exit(1)
+		}
+		fmt.Println(err)
+		if c.Bool("no-rollback") {
+			fmt.Println("Rollback skipped, resources created by this upgrade are left as is.")
+			os.Exit(1)
+		}
+
+		// machines removed to be re-created are not brought back
+		fmt.Println("Rolling back...")
+		err = rollback(ctx, journal, params, "")
+		if err != nil {
+			fmt.Println(err)
+		}
+		os.Exit(1)
+	}
+
+	err = removeOrphans(ctx, olds, installations.Remove(packageName))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = journal.Reset()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = recordInstallation(entry, hashes, em, params[entry.Hash])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("\n%s upgraded to %s.\n", packageName, entry.Version)
+}
+
+// upgradePackages upgrades the installed packages, by name in olds, to the
+// packages in order. Unchanged packages are kept, machines of changed ones
+// are re-created only if their definition changed. Upgraded packages are
+// deleted from olds, leaving those no longer required.
+// It returns the machine exported by the last package.
+func upgradePackages(ctx context.Context, hashes []string, params map[string]map[string]string, olds map[string]string, installed *state.Installation, journal *state.Journal) (provision.ExportedMachine, error) {
+	var em provision.ExportedMachine
+	for _, hash := range hashes {
+		if ctx.Err() != nil {
+			return em, ctx.Err()
+		}
+
+		newSpec, err := build.ReadSpec(hash)
+		if err != nil {
+			return em, err
+		}
+
+		oldHash, exist := olds[newSpec.Name]
+		delete(olds, newSpec.Name)
+		oldParams := map[string]string{}
+		if oldHash == installed.Hash {
+			oldParams = installed.Params
+		} else if exist {
+			// dependencies are installed with defaults
+			oldSpec, err := build.ReadSpec(oldHash)
+			if err == nil {
+				oldParams, _ = oldSpec.ResolveParameters(nil)
+			}
+		}
+		paramsChanged := !sameParams(oldParams, params[hash])
+
+		if oldHash == hash && !paramsChanged {
+			fmt.Printf("Keeping %s:%s (%s)...\n", newSpec.Name, newSpec.Version, build.ShortHash(hash))
+			provSpec, err := loadProvision(hash, newSpec, params[hash], "")
+			if err != nil {
+				return em, err
+			}
+			em = provSpec.ExportedMachine()
+			continue
+		}
+
+		compose := true
+		if exist {
+			oldSpec, err := build.ReadSpec(oldHash)
+			if err != nil {
+				return em, err
+			}
+			fmt.Printf("Upgrading %s:%s to %s (%s)...\n", newSpec.Name, oldSpec.Version, newSpec.Version, build.ShortHash(hash))
+
+			oldProv, err := loadProvision(oldHash, oldSpec, oldParams, "")
+			if err != nil {
+				return em, err
+			}
+			newProv, err := loadProvision(hash, newSpec, params[hash], "")
+			if err != nil {
+				return em, err
+			}
+
+			// machines of unchanged spec are reused,
+			// changed ones get re-created by provisioning
+			changed := provision.Changed(oldProv, newProv)
+			for _, m := range changed {
+				if journal.IsDone(hash, state.MachineRemoved, m.Name()) {
+					continue
+				}
+				fmt.Printf("  ... removing machine %s\n", m.Name())
+				err = m.Remove(ctx)
+				if err != nil {
+					return em, err
+				}
+				err = journal.Done(hash, state.MachineRemoved, m.Name())
+				if err != nil {
+					return em, err
+				}
+			}
+
+			// containers are gone with re-created machines
+			compose = len(changed) > 0 || paramsChanged || compositionChanged(oldHash, oldSpec, hash, newSpec)
+		} else {
+			fmt.Printf("Installing %s:%s (%s)...\n", newSpec.Name, newSpec.Version, build.ShortHash(hash))
+			err = runHooks(ctx, hook.PreInstall, hash, newSpec, params[hash], provision.ExportedMachine{}, journal, "")
+			if err != nil {
+				return em, err
+			}
+		}
+
+		em, err = provisionPackage(ctx, hash, newSpec, params[hash], journal, "")
+		if err != nil {
+			return em, err
+		}
+
+		if compose {
+			err = composePackage(ctx, hash, newSpec, em, params[hash], journal)
+			if err != nil {
+				return em, err
+			}
+		}
+
+		err = waitHealthy(ctx, hash, newSpec, params[hash], em, "")
+		if err != nil {
+			return em, err
+		}
+
+		point := hook.PostUpgrade
+		if !exist {
+			point = hook.PostInstall
+		}
+		err = runHooks(ctx, point, hash, newSpec, params[hash], em, journal, "")
+		if err != nil {
+			return em, err
+		}
+	}
+
+	return em, nil
+}
+
+// removeOrphans removes the packages, by name in olds, no longer required
+// after an upgrade. Those still in the order of other installations are kept.
+// Dependencies are installed with defaults.
+func removeOrphans(ctx context.Context, olds map[string]string, others state.Installations) error {
+	names := []string{}
+	for name := range olds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		hash := olds[name]
+		used := false
+		for _, i := range others {
+			for _, h := range i.Order {
+				used = used || h == hash
+			}
+		}
+		if used {
+			fmt.Printf("Package %s is no longer required, but kept for other installed packages.\n", name)
+			continue
+		}
+
+		packageSpec, err := build.ReadSpec(hash)
+		if err != nil {
+			return err
+		}
+		params, err := packageSpec.ResolveParameters(nil)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removing %s:%s, no longer required...\n", packageSpec.Name, packageSpec.Version)
+		err = removePackage(ctx, hash, packageSpec, params)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
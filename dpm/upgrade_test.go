@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/composition"
+	"github.com/swasd/dpm/dpmtest"
+	"github.com/swasd/dpm/repo"
+	"github.com/swasd/dpm/state"
+)
+
+// installed installs the package of the entry with the values
+// and returns it as recorded.
+func installed(t *testing.T, entry *repo.Entry, values map[string]string) *state.Installation {
+	p, err := extractEntry(entry)
+	assert.NoError(t, err)
+	hashes, err := p.Order()
+	assert.NoError(t, err)
+	params, err := resolveParams(hashes, entry.Hash, values)
+	assert.NoError(t, err)
+	journal, err := state.LoadJournal(entry.Hash)
+	assert.NoError(t, err)
+	_, err = installPackages(context.Background(), hashes, params, journal, "")
+	assert.NoError(t, err)
+	assert.NoError(t, journal.Reset())
+	return &state.Installation{Name: entry.PackageName, Version: entry.Version, Hash: entry.Hash, Order: hashes, Params: params[entry.Hash]}
+}
+
+// upgrade upgrades the installation to the package of the entry.
+func upgrade(t *testing.T, i *state.Installation, entry *repo.Entry, values map[string]string) {
+	p, err := extractEntry(entry)
+	assert.NoError(t, err)
+	hashes, err := p.Order()
+	assert.NoError(t, err)
+	params, err := resolveParams(hashes, entry.Hash, values)
+	assert.NoError(t, err)
+	journal, err := state.LoadJournal(entry.Hash)
+	assert.NoError(t, err)
+	_, err = upgradePackages(context.Background(), hashes, params, map[string]string{i.Name: i.Hash}, i, journal)
+	assert.NoError(t, err)
+}
+
+func webPackage(options string) []byte {
+	files := packageFiles("web", "${param.url}"+options)
+	files["SPEC.yml"] += `  parameters:
+    url:
+      default: tcp://10.0.0.1:2376
+    replicas:
+      default: "1"
+`
+	return dpmtest.Package(files)
+}
+
+func TestUpgradeParameterOfComposition(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+	h.FakeCompose()
+	os.Setenv("DPM_COMPOSER", composition.ComposeBackend)
+	defer os.Unsetenv("DPM_COMPOSER")
+
+	h.AddPackage("web", "1.0.0", webPackage(""))
+	entry, err := repo.Get("web", "1.0.0")
+	assert.NoError(t, err)
+	i := installed(t, entry, map[string]string{})
+	machineCalls := len(h.Calls("docker-machine"))
+
+	upgrade(t, i, entry, map[string]string{"replicas": "3"})
+	for _, call := range h.Calls("docker-machine")[machineCalls:] {
+		assert.NotContains(t, call, "rm")
+		assert.NotContains(t, call, "create")
+	}
+	assert.Equal(t, h.Calls("docker-compose")[2:], []string{
+		"-p web -f composition.yml ps -q",
+		"-p web -f composition.yml up -d",
+	})
+}
+
+func TestUpgradeMachineOption(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+	h.FakeCompose()
+	os.Setenv("DPM_COMPOSER", composition.ComposeBackend)
+	defer os.Unsetenv("DPM_COMPOSER")
+
+	h.AddPackage("web", "1.0.0", webPackage(""))
+	h.AddPackage("web", "1.1.0", webPackage("\n      engine-label: tier=web"))
+	entry, err := repo.Get("web", "1.0.0")
+	assert.NoError(t, err)
+	i := installed(t, entry, map[string]string{})
+	machineCalls := len(h.Calls("docker-machine"))
+
+	entry, err = repo.Get("web", "1.1.0")
+	assert.NoError(t, err)
+	upgrade(t, i, entry, i.Params)
+	calls := h.Calls("docker-machine")[machineCalls:]
+	assert.Contains(t, calls, "rm -y web")
+	assert.Contains(t, calls, "create --driver none --engine-label tier=web --url tcp://10.0.0.1:2376 web")
+	// the composition is the same, but its containers went with the machine
+	assert.Equal(t, h.Calls("docker-compose")[2:], []string{
+		"-p web -f composition.yml ps -q",
+		"-p web -f composition.yml up -d",
+	})
+}
+
+func TestUpgradeResumeKeepsRecreatedMachine(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+	h.FakeCompose()
+	os.Setenv("DPM_COMPOSER", composition.ComposeBackend)
+	defer os.Unsetenv("DPM_COMPOSER")
+
+	h.AddPackage("web", "1.0.0", webPackage(""))
+	h.AddPackage("web", "1.1.0", webPackage("\n      engine-label: tier=web"))
+	entry, err := repo.Get("web", "1.0.0")
+	assert.NoError(t, err)
+	i := installed(t, entry, map[string]string{})
+	machineCalls := len(h.Calls("docker-machine"))
+
+	// the interrupted upgrade removed the machine already
+	entry, err = repo.Get("web", "1.1.0")
+	assert.NoError(t, err)
+	journal, err := state.LoadJournal(entry.Hash)
+	assert.NoError(t, err)
+	assert.NoError(t, journal.Done(entry.Hash, state.MachineRemoved, "web"))
+
+	upgrade(t, i, entry, i.Params)
+	assert.NotContains(t, h.Calls("docker-machine")[machineCalls:], "rm -y web")
+}
+
+func TestRemoveOrphans(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+	h.FakeCompose()
+	os.Setenv("DPM_COMPOSER", composition.ComposeBackend)
+	defer os.Unsetenv("DPM_COMPOSER")
+
+	consul := h.AddPackage("consul", "1.0.0", dpmtest.Package(packageFiles("consul", "tcp://10.0.0.1:2376")))
+	entry, err := repo.Get("consul", "1.0.0")
+	assert.NoError(t, err)
+	installed(t, entry, map[string]string{})
+	machineCalls := len(h.Calls("docker-machine"))
+
+	// still required by another installed package
+	others := state.Installations{{Name: "app", Order: []string{consul}}}
+	assert.NoError(t, removeOrphans(context.Background(), map[string]string{"consul": consul}, others))
+	assert.NotContains(t, h.Calls("docker-machine")[machineCalls:], "rm -y consul")
+
+	assert.NoError(t, removeOrphans(context.Background(), map[string]string{"consul": consul}, nil))
+	assert.Contains(t, h.Calls("docker-machine")[machineCalls:], "rm -y consul")
+}
@@ -0,0 +1,304 @@
+// Package dpmtest provides a temporary DPM home and fake docker-machine,
+// docker-compose and docker commands recording their invocations,
+// so dpm can be tested without Docker, cloud accounts or the network.
+package dpmtest
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Home is a temporary home directory with an empty DPM index, set as HOME
+// with its bin directory first in PATH until closed.
+type Home struct {
+	Dir string
+
+	t       testing.TB
+	bin     string
+	index   *index
+	oldHome string
+	oldPath string
+}
+
+func NewHome(t testing.TB) *Home {
+	dir, err := ioutil.TempDir("", "dpmtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Home{
+		Dir:     dir,
+		t:       t,
+		bin:     filepath.Join(dir, "bin"),
+		index:   &index{dir: filepath.Join(dir, ".dpm", "cache"), filename: filepath.Join(dir, ".dpm", "index", "dpm.index")},
+		oldHome: os.Getenv("HOME"),
+		oldPath: os.Getenv("PATH"),
+	}
+	for _, d := range []string{h.bin, h.index.dir, filepath.Join(dir, ".dpm", "index"), filepath.Join(dir, ".dpm", "workspace")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.index.save(t)
+
+	os.Setenv("HOME", dir)
+	os.Setenv("PATH", h.bin+string(os.PathListSeparator)+h.oldPath)
+	return h
+}
+
+// Close restores HOME and PATH and removes the directory.
+func (h *Home) Close() {
+	os.Setenv("HOME", h.oldHome)
+	os.Setenv("PATH", h.oldPath)
+	os.RemoveAll(h.Dir)
+}
+
+// AddPackage puts the package content in the cache and the local index,
+// returning its hash.
+func (h *Home) AddPackage(name, version string, content []byte) string {
+	return h.index.add(h.t, name, version, content)
+}
+
+// Fake puts a command on PATH running the shell script, after recording
+// its arguments.
+func (h *Home) Fake(name, script string) {
+	h.script(name, "echo \"$*\" >> '"+h.calls(name)+"'\n"+script)
+}
+
+// FakeDocker puts a docker command succeeding with no output on PATH.
+func (h *Home) FakeDocker() {
+	h.Fake("docker", "exit 0\n")
+}
+
+// FakeMachine puts a docker-machine command on PATH, keeping machines
+// as directories of the storage path. Options other than --url of create
+// are ignored, machines are Running at the URL, tcp://127.0.0.1:2376 if none.
+// The -s storage option is not recorded.
+func (h *Home) FakeMachine() {
+	h.script("docker-machine", `storage="$HOME/.docker/machine"
+if [ "$1" = "-s" ]; then
+	storage="$2"
+	shift 2
+fi
+echo "$*" >> '`+h.calls("docker-machine")+`'
+command="$1"
+shift
+case "$command" in
+create)
+	url=tcp://127.0.0.1:2376
+	while [ $# -gt 1 ]; do
+		if [ "$1" = "--url" ]; then
+			url="$2"
+		fi
+		shift
+	done
+	if [ -d "$storage/machines/$1" ]; then
+		echo "Host already exists: \"$1\"" >&2
+		exit 1
+	fi
+	mkdir -p "$storage/machines/$1"
+	echo "$url" > "$storage/machines/$1/url"
+	;;
+ls)
+	for m in "$storage"/machines/*; do
+		[ -d "$m" ] || continue
+		name=$(basename "$m")
+		for arg in "$@"; do
+			case "$arg" in
+			--filter=name=*) [ "$name" = "${arg#--filter=name=}" ] || continue 2 ;;
+			esac
+		done
+		echo "$name"
+	done
+	;;
+status|ip|url|env|rm|provision)
+	for name; do :; done
+	if [ ! -d "$storage/machines/$name" ]; then
+		echo "Host does not exist: \"$name\"" >&2
+		exit 1
+	fi
+	url=$(cat "$storage/machines/$name/url")
+	case "$command" in
+	status) echo Running ;;
+	ip)
+		host="${url#*://}"
+		echo "${host%:*}"
+		;;
+	url) echo "$url" ;;
+	env)
+		echo "export DOCKER_HOST=\"$url\""
+		echo "export DOCKER_MACHINE_NAME=\"$name\""
+		;;
+	rm) rm -rf "$storage/machines/$name" ;;
+	esac
+	;;
+esac
+`)
+}
+
+// FakeCompose puts a docker-compose command on PATH. Projects are up
+// from up to down, ps -q printing the project name as their container.
+func (h *Home) FakeCompose() {
+	state := filepath.Join(h.bin, "compose")
+	h.Fake("docker-compose", `project=
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-p) project="$2"; shift 2 ;;
+	-f) shift 2 ;;
+	*) break ;;
+	esac
+done
+case "$1" in
+up)
+	mkdir -p '`+state+`'
+	touch '`+state+`'/"$project"
+	;;
+down) rm -f '`+state+`'/"$project" ;;
+ps)
+	if [ -f '`+state+`'/"$project" ]; then
+		echo "$project"
+	fi
+	;;
+esac
+`)
+}
+
+// Calls returns the arguments of each invocation of the fake command.
+func (h *Home) Calls(name string) []string {
+	content, err := ioutil.ReadFile(h.calls(name))
+	if os.IsNotExist(err) {
+		return []string{}
+	}
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func (h *Home) calls(name string) string {
+	return filepath.Join(h.bin, name+".calls")
+}
+
+func (h *Home) script(name, content string) {
+	err := ioutil.WriteFile(filepath.Join(h.bin, name), []byte("#!/bin/sh\n"+content), 0755)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// Repo is a remote package repository served over HTTP.
+type Repo struct {
+	*httptest.Server
+
+	t     testing.TB
+	index *index
+}
+
+func NewRepo(t testing.TB) *Repo {
+	dir, err := ioutil.TempDir("", "dpmtest-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Repo{
+		Server: httptest.NewServer(http.FileServer(http.Dir(dir))),
+		t:      t,
+		index:  &index{dir: dir, filename: filepath.Join(dir, "dpm.index")},
+	}
+	r.index.save(t)
+	return r
+}
+
+// URL returns the base URL of the repository, as repo.Repo.
+func (r *Repo) URL() string {
+	return r.Server.URL + "/"
+}
+
+// Close stops the server and removes the packages.
+func (r *Repo) Close() {
+	r.Server.Close()
+	os.RemoveAll(r.index.dir)
+}
+
+// AddPackage publishes the package content, returning its hash.
+func (r *Repo) AddPackage(name, version string, content []byte) string {
+	return r.index.add(r.t, name, version, content)
+}
+
+// entry is an entry of repo.Entries, not imported for
+// tests of repo and build to use this package.
+type entry struct {
+	PackageName string `yaml:"packagename"`
+	Version     string `yaml:"version"`
+	Filename    string `yaml:"filename"`
+	Hash        string `yaml:"hash"`
+}
+
+type index struct {
+	dir      string
+	filename string
+	entries  []entry
+}
+
+func (i *index) add(t testing.TB, name, version string, content []byte) string {
+	sum := sha256.Sum256(content)
+	e := entry{
+		PackageName: name,
+		Version:     version,
+		Filename:    name + "_" + version + ".dpm",
+		Hash:        hex.EncodeToString(sum[:]),
+	}
+	err := ioutil.WriteFile(filepath.Join(i.dir, e.Filename), content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.entries = append(i.entries, e)
+	i.save(t)
+	return e.Hash
+}
+
+func (i *index) save(t testing.TB) {
+	content, err := yaml.Marshal(i.entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(i.filename, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Package returns the content of a package archiving the files,
+// the same for the same files.
+func Package(files map[string]string) []byte {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, name := range names {
+		tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(files[name])),
+			ModTime: time.Unix(0, 0),
+		})
+		tw.Write([]byte(files[name]))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,105 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Probe checks once if something is ready.
+type Probe func(ctx context.Context) error
+
+// Wait runs the probe every interval until it succeeds,
+// giving up after the timeout with the last failure.
+func Wait(ctx context.Context, probe Probe, timeout, interval time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		err := probe(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("not ready after %s: %s", timeout, err)
+			}
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// HTTP is ready when GET of the URL answers with a 2xx or 3xx status.
+func HTTP(url string) Probe {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// TCP is ready when the address accepts connections.
+func TCP(address string) Probe {
+	return func(ctx context.Context) error {
+		d := net.Dialer{Timeout: 5 * time.Second}
+		conn, err := d.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// Command is ready when the command, run with sh in the directory, exits 0.
+func Command(command, dir string, env []string) Probe {
+	return func(ctx context.Context) error {
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), env...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			if output := strings.TrimSpace(string(out)); output != "" {
+				return fmt.Errorf("'%s': %s: %s", command, err, output)
+			}
+			return fmt.Errorf("'%s': %s", command, err)
+		}
+		return nil
+	}
+}
+
+// Status returns the health of containers, given by a status function.
+// Containers are ready when all are healthy, or running if they have no health check.
+func Status(status func(ctx context.Context) ([]string, error)) Probe {
+	return func(ctx context.Context) error {
+		states, err := status(ctx)
+		if err != nil {
+			return err
+		}
+		if len(states) == 0 {
+			return fmt.Errorf("no containers")
+		}
+		for _, s := range states {
+			if s != "healthy" && s != "running" {
+				return fmt.Errorf("container is %s", s)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,53 @@
+package healthcheck
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitHTTP(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	err := Wait(context.Background(), HTTP(server.URL), time.Second, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(3))
+}
+
+func TestWaitTimeout(t *testing.T) {
+	err := Wait(context.Background(), Command("exit 1", "", nil), 50*time.Millisecond, 10*time.Millisecond)
+	assert.EqualError(t, err, "not ready after 50ms: 'exit 1': exit status 1")
+}
+
+func TestTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	assert.NoError(t, TCP(addr)(context.Background()))
+	l.Close()
+	assert.Error(t, TCP(addr)(context.Background()))
+}
+
+func TestStatus(t *testing.T) {
+	states := []string{"healthy", "starting"}
+	probe := Status(func(ctx context.Context) ([]string, error) { return states, nil })
+	assert.EqualError(t, probe(context.Background()), "container is starting")
+	states = []string{"healthy", "running"}
+	assert.NoError(t, probe(context.Background()))
+	states = []string{}
+	assert.EqualError(t, probe(context.Background()), "no containers")
+}
@@ -0,0 +1,142 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/secret"
+)
+
+// Points of the package lifecycle hooks run at.
+const (
+	PreInstall  = "pre-install"
+	PostInstall = "post-install"
+	PreRemove   = "pre-remove"
+	PostRemove  = "post-remove"
+	PostUpgrade = "post-upgrade"
+)
+
+// LogFile is the file in the package workspace
+// the output of hooks is appended to.
+const LogFile = "hooks.log"
+
+// Of returns the hooks of the package at the point.
+func Of(spec *build.Spec, point string) []build.Hook {
+	switch point {
+	case PreInstall:
+		return spec.Hooks.PreInstall
+	case PostInstall:
+		return spec.Hooks.PostInstall
+	case PreRemove:
+		return spec.Hooks.PreRemove
+	case PostRemove:
+		return spec.Hooks.PostRemove
+	case PostUpgrade:
+		return spec.Hooks.PostUpgrade
+	}
+	return nil
+}
+
+// Run runs the hooks of the point with sh in the directory,
+// adding env to the environment of dpm. Output of each hook is captured
+// into the log file of the directory, and printed if the hook fails.
+// A failing hook stops the run unless its on-failure is warn.
+func Run(ctx context.Context, point string, hooks []build.Hook, dir string, env []string) error {
+	for _, h := range hooks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fmt.Printf("  ... %s hook '%s'\n", point, secret.Redact(h.Command))
+		out, err := run(ctx, point, h, dir, env)
+		if logErr := appendLog(dir, point, h, out, err); logErr != nil {
+			fmt.Println(logErr)
+		}
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err = fmt.Errorf("%s hook '%s' failed: %s\n%s", point, secret.Redact(h.Command), err, secret.Redact(string(out)))
+		if h.OnFailure == build.Warn {
+			fmt.Printf("Warning: %s\n", err)
+			continue
+		}
+		return err
+	}
+	return nil
+}
+
+func run(ctx context.Context, point string, h build.Hook, dir string, env []string) ([]byte, error) {
+	timeout, err := h.Duration()
+	if err != nil {
+		return nil, err
+	}
+	hctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// output goes to a file rather than a pipe, so a timed out hook
+	// is not waited for until all processes it started close the pipe
+	f, err := ioutil.TempFile("", "dpm-hook")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cmd := exec.CommandContext(hctx, "sh", "-c", h.Command)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "DPM_HOOK="+point), env...)
+	cmd.Stdout = f
+	cmd.Stderr = f
+	err = cmd.Run()
+
+	out, readErr := ioutil.ReadFile(f.Name())
+	if readErr != nil {
+		return nil, readErr
+	}
+	if hctx.Err() == context.DeadlineExceeded {
+		return out, fmt.Errorf("timed out after %s", timeout)
+	}
+	return out, err
+}
+
+func appendLog(dir, point string, h build.Hook, out []byte, result error) error {
+	status := "ok"
+	if result != nil {
+		status = result.Error()
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "--- %s %s '%s': %s\n", time.Now().Format(time.RFC3339), point, h.Command, status)
+	buf.Write(out)
+	if len(out) > 0 && !bytes.HasSuffix(out, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, LogFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(secret.Redact(buf.String()))
+	return err
+}
+
+// ReadLog returns the captured output of hooks run in the directory.
+func ReadLog(dir string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, LogFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSuffix(string(content), "\n"), err
+}
@@ -0,0 +1,53 @@
+package hook
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/build"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dpm")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = Run(context.Background(), PostInstall, []build.Hook{
+		{Command: "echo $DPM_HOOK $DPM_PACKAGE > out.txt"},
+		{Command: "echo flaky; exit 3", OnFailure: build.Warn},
+		{Command: "echo broken; exit 1"},
+		{Command: "echo never > never.txt"},
+	}, dir, []string{"DPM_PACKAGE=test"})
+	assert.EqualError(t, err, "post-install hook 'echo broken; exit 1' failed: exit status 1\nbroken\n")
+
+	out, err := ioutil.ReadFile(dir + "/out.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, string(out), "post-install test\n")
+	_, err = os.Stat(dir + "/never.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	log, err := ReadLog(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Count(log, "--- "), 3)
+	assert.Contains(t, log, "'echo flaky; exit 3': exit status 3\nflaky")
+}
+
+func TestRunTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dpm")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = Run(context.Background(), PreRemove, []build.Hook{
+		{Command: "sleep 5", Timeout: "100ms"},
+	}, dir, nil)
+	assert.EqualError(t, err, "pre-remove hook 'sleep 5' failed: timed out after 100ms\n")
+
+	err = Run(context.Background(), PreRemove, []build.Hook{
+		{Command: "true", Timeout: "soon"},
+	}, dir, nil)
+	assert.EqualError(t, err, "pre-remove hook 'true' failed: timeout 'soon' of hook 'true' is not a valid duration\n")
+}
@@ -0,0 +1,467 @@
+package lint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mattn/go-shellwords"
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/provision"
+	"github.com/swasd/dpm/render"
+	"github.com/swasd/dpm/schema"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Problem is an issue found in a file of a package.
+// Line is 0 when the position is unknown.
+type Problem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+}
+
+type Problems []Problem
+
+func (p Problems) Len() int      { return len(p) }
+func (p Problems) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p Problems) Less(i, j int) bool {
+	if p[i].File != p[j].File {
+		return p[i].File < p[j].File
+	}
+	return p[i].Line < p[j].Line
+}
+
+// file collects problems of a single file.
+type file struct {
+	name     string
+	content  []byte
+	problems Problems
+}
+
+func (f *file) report(path []string, format string, args ...interface{}) {
+	f.problems = append(f.problems, Problem{
+		File:    f.name,
+		Line:    locate(f.content, path...),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+var (
+	// names follow the syntax of the package spec
+	nameSyntax = regexp.MustCompile(schema.Spec().Properties["spec"].Properties["name"].Pattern)
+	refSyntax  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+)
+
+// Dir checks the package source in the directory
+// and returns all problems found, ordered by file and line.
+func Dir(dir string) Problems {
+	problems := Problems{}
+
+	specFile := filepath.Join(dir, "SPEC.yml")
+	content, err := ioutil.ReadFile(specFile)
+	if err != nil {
+		return append(problems, Problem{File: specFile, Message: err.Error()})
+	}
+
+	spec, specProblems := Spec(specFile, content)
+	problems = append(problems, specProblems...)
+	if spec == nil {
+		return problems
+	}
+
+	f := &file{name: specFile, content: content}
+	check := func(path []string, name string, isDir bool) bool {
+		field := path[1]
+		info, err := os.Stat(filepath.Join(dir, name))
+		switch {
+		case err != nil:
+			f.report(path, "%s '%s' does not exist", field, name)
+		case isDir && !info.IsDir():
+			f.report(path, "%s '%s' is not a directory", field, name)
+		case !isDir && info.IsDir():
+			f.report(path, "%s '%s' is not a file", field, name)
+		default:
+			return true
+		}
+		return false
+	}
+	provisionOk := spec.Provision != "" && check([]string{"spec", "provision"}, spec.Provision, false)
+	compositionOk := false
+	if info, err := os.Stat(filepath.Join(dir, spec.Composition)); err == nil && info.IsDir() && spec.CompositionType == build.KubernetesType {
+		// a directory of manifests
+	} else if spec.Composition != "" {
+		compositionOk = check([]string{"spec", "composition"}, spec.Composition, false)
+	}
+	if compositionOk && render.IsTemplate(spec.Composition) {
+		compositionFile := filepath.Join(dir, spec.Composition)
+		content, err := ioutil.ReadFile(compositionFile)
+		if err == nil {
+			_, err = render.Render(compositionFile, content, &render.Context{
+				Params: spec.DefaultParameters(),
+				IP: func(machine string) (string, error) {
+					return "127.0.0.1", nil
+				},
+			})
+		}
+		if err != nil {
+			problems = append(problems, Problem{File: compositionFile, Message: err.Error()})
+		}
+	}
+	for i, d := range spec.Dirs {
+		check([]string{"spec", "dirs", fmt.Sprint(i)}, d, true)
+	}
+	problems = append(problems, f.problems...)
+
+	if provisionOk {
+		provisionFile := filepath.Join(dir, spec.Provision)
+		content, err := ioutil.ReadFile(provisionFile)
+		if err != nil {
+			problems = append(problems, Problem{File: provisionFile, Message: err.Error()})
+		} else if render.IsTemplate(provisionFile) {
+			// problems are found in the template rendered with defaults
+			rendered, err := provision.RenderTemplate(provisionFile, content, spec.DefaultParameters())
+			if err != nil {
+				problems = append(problems, Problem{File: provisionFile, Message: err.Error()})
+			} else {
+				problems = append(problems, Provision(provisionFile+" (rendered)", rendered)...)
+			}
+			problems = append(problems, undeclaredParams(provisionFile, content, spec)...)
+		} else {
+			problems = append(problems, Provision(provisionFile, content)...)
+			problems = append(problems, undeclaredParams(provisionFile, content, spec)...)
+		}
+	}
+
+	sort.Stable(problems)
+	return problems
+}
+
+// structure checks the document against the schema, then decodes it into v.
+// The content may differ from the file content when the file was migrated,
+// positions are always looked up in the file.
+// It tells if the document could be decoded.
+func (f *file) structure(s *schema.Schema, content []byte, v interface{}) bool {
+	var doc interface{}
+	err := yaml.Unmarshal(content, &doc)
+	if err != nil {
+		f.problems = append(f.problems, Problem{f.name, errorLine(err), err.Error()})
+		return false
+	}
+
+	violations := s.Validate(doc)
+	for _, v := range violations {
+		f.report(v.Path, "%s", v)
+	}
+
+	err = yaml.Unmarshal(content, v)
+	if err != nil {
+		// mismatching types are already reported as violations
+		if len(violations) == 0 {
+			f.problems = append(f.problems, Problem{f.name, errorLine(err), err.Error()})
+		}
+		return false
+	}
+	return true
+}
+
+// Spec checks content of SPEC.yml. The spec is returned
+// if it could be parsed, even when problems are found.
+func Spec(filename string, content []byte) (*build.Spec, Problems) {
+	f := &file{name: filename, content: content}
+
+	migrated, from, err := build.MigrateSpec(content)
+	if err != nil {
+		f.problems = append(f.problems, Problem{f.name, errorLine(err), err.Error()})
+		return nil, f.problems
+	}
+	if from != build.SpecVersion {
+		f.report([]string{"specVersion"}, "spec version %s is outdated, run `dpm migrate` to upgrade it to %s", from, build.SpecVersion)
+	}
+
+	root := build.Root{}
+	if !f.structure(schema.Spec(), migrated, &root) || root.Spec == nil {
+		return nil, f.problems
+	}
+	spec := root.Spec
+
+	names := []string{}
+	for name := range spec.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !nameSyntax.MatchString(name) {
+			f.report([]string{"spec", "dependencies", name}, "dependency name '%s' is not valid", name)
+		}
+	}
+
+	names = []string{}
+	for name := range spec.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := spec.Parameters[name]
+		if !refSyntax.MatchString(name) {
+			f.report([]string{"spec", "parameters", name}, "parameter name '%s' is not valid", name)
+		}
+		if p.Default == "" {
+			continue
+		}
+		if p.Required {
+			f.report([]string{"spec", "parameters", name, "default"}, "parameter %s: a required parameter cannot have a default", name)
+		}
+		if err := p.Check(p.Default); err != nil {
+			f.report([]string{"spec", "parameters", name, "default"}, "parameter %s: default %s", name, err)
+		}
+	}
+
+	if err := spec.CheckParamEnvs(); err != nil {
+		f.report([]string{"spec", "parameters"}, "%s", err)
+	}
+
+	points := []struct {
+		name  string
+		hooks []build.Hook
+	}{
+		{"pre-install", spec.Hooks.PreInstall},
+		{"post-install", spec.Hooks.PostInstall},
+		{"pre-remove", spec.Hooks.PreRemove},
+		{"post-remove", spec.Hooks.PostRemove},
+		{"post-upgrade", spec.Hooks.PostUpgrade},
+	}
+	for _, point := range points {
+		for i, h := range point.hooks {
+			if _, err := h.Duration(); err != nil {
+				f.report([]string{"spec", "hooks", point.name, fmt.Sprint(i), "timeout"}, "%s", err)
+			}
+		}
+	}
+
+	for i, t := range spec.Tests {
+		if _, err := t.Duration(); err != nil {
+			f.report([]string{"spec", "tests", fmt.Sprint(i), "timeout"}, "%s", err)
+		}
+	}
+
+	if spec.Healthcheck != nil {
+		if err := spec.Healthcheck.Validate(); err != nil {
+			f.report([]string{"spec", "healthcheck"}, "%s", err)
+		}
+	}
+
+	if spec.Kubernetes != nil && spec.CompositionType != build.KubernetesType {
+		f.report([]string{"spec", "kubernetes"}, "kubernetes is only used with composition-type: kubernetes")
+	}
+
+	return spec, f.problems
+}
+
+// Provision checks content of a provision file.
+func Provision(filename string, content []byte) Problems {
+	f := &file{name: filename, content: content}
+
+	spec := &provision.Spec{}
+	if !f.structure(schema.Provision(), content, spec) {
+		return f.problems
+	}
+
+	if len(spec.MachineSpecs) == 0 {
+		f.report(nil, "at least one machine is required")
+	}
+
+	names := []string{}
+	for name := range spec.MachineSpecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	exported := []string{}
+	managers, workers := 0, 0
+	for _, name := range names {
+		ms := spec.MachineSpecs[name]
+		switch ms.SwarmMode {
+		case provision.Manager:
+			managers++
+		case provision.Worker:
+			workers++
+		}
+		path := func(p ...string) []string {
+			return append([]string{"machines", name}, p...)
+		}
+
+		if !nameSyntax.MatchString(name) {
+			f.report(path(), "machine name '%s' is not valid", name)
+		}
+
+		if ms.Export {
+			exported = append(exported, name)
+			if ms.Instances != nil && *ms.Instances != 1 {
+				f.report(path("export"), "machine %s: a machine having many instances cannot be exported", name)
+			}
+			if ms.SwarmMode == provision.Worker {
+				f.report(path("swarm-mode"), "machine %s: a swarm worker cannot be exported, export a manager", name)
+			}
+		}
+
+		if ms.Driver == provision.SSHDriver {
+			hosts, _ := ms.Options["ssh-host"].(string)
+			instances := 1
+			if ms.Instances != nil {
+				instances = *ms.Instances
+			}
+			if hosts == "" {
+				f.report(path("driver"), "machine %s: the ssh driver requires the ssh-host option", name)
+			} else if n := len(strings.Split(hosts, ",")); n != instances && !strings.Contains(hosts, "${") {
+				f.report(path("options", "ssh-host"), "machine %s: ssh-host lists %d hosts for %d instances", name, n, instances)
+			}
+		}
+
+		keys := []string{}
+		for k := range ms.Options {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			switch val := ms.Options[k].(type) {
+			case string:
+				f.references(path("options", k), val, true)
+			case bool:
+			case map[interface{}]interface{}:
+				subkeys := []string{}
+				for kk := range val {
+					subkeys = append(subkeys, fmt.Sprint(kk))
+				}
+				sort.Strings(subkeys)
+				for _, kk := range subkeys {
+					vv := val[kk]
+					s, ok := vv.(string)
+					if !ok {
+						f.report(path("options", k, kk), "machine %s: option %s.%s must be a string", name, k, kk)
+						continue
+					}
+					f.references(path("options", k, kk), s, true)
+				}
+			default:
+				f.report(path("options", k), "machine %s: option %s must be a string, a boolean or a map of strings, quote it if it is a number", name, k)
+			}
+		}
+
+		for i, cmd := range ms.PreProvision {
+			f.command(path("pre-provision", fmt.Sprint(i)), cmd)
+		}
+		for i, cmd := range ms.PostProvision {
+			f.command(path("post-provision", fmt.Sprint(i)), cmd)
+		}
+	}
+
+	switch len(exported) {
+	case 0:
+		if len(names) > 0 {
+			f.report([]string{"machines"}, "exactly one machine must be exported, none is")
+		}
+	case 1:
+	default:
+		f.report([]string{"machines", exported[1], "export"}, "exactly one machine must be exported, found %s", strings.Join(exported, ", "))
+	}
+
+	if workers > 0 && managers == 0 {
+		f.report([]string{"machines"}, "swarm workers need at least one manager")
+	}
+
+	envs := []string{}
+	for k := range spec.ExportedEnvs {
+		envs = append(envs, k)
+	}
+	sort.Strings(envs)
+	for _, k := range envs {
+		f.references([]string{"export-envs", k}, spec.ExportedEnvs[k], false)
+	}
+
+	return f.problems
+}
+
+var paramRef = regexp.MustCompile(`\$\{param\.([^}]*)\}`)
+
+// undeclaredParams reports ${param.name} references
+// to parameters the package does not have.
+func undeclaredParams(filename string, content []byte, spec *build.Spec) Problems {
+	problems := Problems{}
+	for i, l := range strings.Split(string(content), "\n") {
+		for _, m := range paramRef.FindAllStringSubmatch(l, -1) {
+			if _, exist := spec.Parameters[m[1]]; !exist {
+				problems = append(problems, Problem{filename, i + 1, fmt.Sprintf("parameter '%s' is not declared in the spec", m[1])})
+			}
+		}
+	}
+	return problems
+}
+
+func (f *file) command(path []string, cmd string) {
+	_, err := shellwords.Parse(cmd)
+	if err != nil {
+		f.report(path, "command '%s': %s", cmd, err)
+	}
+	f.references(path, cmd, true)
+}
+
+// references checks ${...} references in the value.
+// self and this refer to the current machine, so they are valid
+// only where there is one.
+func (f *file) references(path []string, value string, inMachine bool) {
+	rest := value
+	for {
+		i := strings.Index(rest, "${")
+		if i < 0 {
+			return
+		}
+		rest = rest[i+2:]
+		j := strings.Index(rest, "}")
+		if j < 0 {
+			f.report(path, "unclosed reference in '%s'", value)
+			return
+		}
+		key := rest[:j]
+		rest = rest[j+1:]
+
+		// defaults and messages can be anything
+		for _, op := range []string{":-", ":?"} {
+			if k := strings.Index(key, op); k >= 0 {
+				key = key[:k]
+			}
+		}
+
+		parts := strings.SplitN(key, " ", 2)
+		dotted := strings.Split(key, ".")
+		switch {
+		case dotted[0] == "machine" && refSyntax.MatchString(key):
+			attr := dotted[len(dotted)-1]
+			if len(dotted) < 3 || (attr != "ip" && attr != "url") {
+				f.report(path, "invalid reference ${%s}, use ${machine.<name>.ip} or ${machine.<name>.url}", key)
+			}
+		case key == "self" || key == "this":
+			if !inMachine {
+				f.report(path, "${%s} can only be used in machine definitions", key)
+			}
+		case len(parts) == 2 && parts[0] == "ip":
+			if !refSyntax.MatchString(parts[1]) {
+				f.report(path, "invalid machine name in ${%s}", key)
+			}
+		case !refSyntax.MatchString(key):
+			f.report(path, "invalid reference ${%s}", key)
+		}
+	}
+}
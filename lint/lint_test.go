@@ -0,0 +1,327 @@
+package lint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocate(t *testing.T) {
+	yml := []byte(`---
+machines:
+  # the master
+  master:
+    driver: digitalocean
+    options:
+      engine-opt:
+        cluster-store: consul://${consul}:8500
+    post-provision:
+      - docker network create a
+      - docker network create b
+  ocean:
+    driver: digitalocean
+`)
+	assert.Equal(t, locate(yml, "machines"), 2)
+	assert.Equal(t, locate(yml, "machines", "master", "driver"), 5)
+	assert.Equal(t, locate(yml, "machines", "master", "options", "engine-opt", "cluster-store"), 8)
+	assert.Equal(t, locate(yml, "machines", "master", "post-provision", "1"), 11)
+	assert.Equal(t, locate(yml, "machines", "ocean", "driver"), 13)
+	// the closest ancestor
+	assert.Equal(t, locate(yml, "machines", "ocean", "options"), 12)
+	assert.Equal(t, locate(yml, "export-envs"), 0)
+}
+
+func TestLintSpec(t *testing.T) {
+	yml := []byte(`---
+specVersion: 0.2.0
+spec:
+  name: Bad Name
+  version: 1.x-y
+  provision: provision.yml
+  compositon: composition.yml
+  dependencies:
+    consul-discovery:
+      release: 1
+`)
+	spec, problems := Spec("SPEC.yml", yml)
+	assert.NotNil(t, spec)
+	assert.Equal(t, []string{
+		"SPEC.yml:3: spec: composition is required",
+		"SPEC.yml:7: spec.compositon: unknown property 'compositon'",
+		"SPEC.yml:9: spec.dependencies.consul-discovery: version is required",
+		"SPEC.yml:10: spec.dependencies.consul-discovery.release: unknown property 'release'",
+		"SPEC.yml:4: spec.name: 'Bad Name' must match ^[a-z0-9]+([-_.][a-z0-9]+)*$",
+		"SPEC.yml:5: spec.version: '1.x-y' must match ^[0-9]+(\\.[0-9A-Za-z]+)*$",
+	}, messages(problems))
+
+	_, problems = Spec("SPEC.yml", []byte("specVersion: 0.2.0\nspec: [\n"))
+	assert.Equal(t, len(problems), 1)
+	assert.Equal(t, problems[0].Line, 2)
+
+	_, problems = Spec("SPEC.yml", []byte(`---
+specVersion: 0.2.0
+spec:
+  name: test
+  version: 0.1.0
+  provision: provision.yml
+  composition: composition.yml
+  parameters:
+    nodes:
+      type: number
+      default: many
+    token:
+      required: true
+      default: abc
+    size:
+      type: integer
+  hooks:
+    post-install:
+      - command: ./check.sh
+        timeout: 1 minute
+        on-failure: ignore
+  healthcheck:
+    tcp: ${machine.master.ip}:8500
+    http: http://${machine.master.ip}:8500/v1/status/leader
+  composition-type: helm
+  kubernetes:
+    namespace: web
+  tests:
+    - name: leader
+      command: curl -f http://$DPM_MACHINE_IP:8500/v1/status/leader
+      timeout: soon
+`))
+	assert.Equal(t, []string{
+		"SPEC.yml:25: spec.composition-type: 'helm' must be one of docker-compose, kubernetes, containerd",
+		"SPEC.yml:21: spec.hooks.post-install.0.on-failure: 'ignore' must be one of abort, warn",
+		"SPEC.yml:16: spec.parameters.size.type: 'integer' must be one of boolean, number, string",
+		"SPEC.yml:11: parameter nodes: default 'many' is not a number",
+		"SPEC.yml:14: parameter token: a required parameter cannot have a default",
+		"SPEC.yml:20: timeout '1 minute' of hook './check.sh' is not a valid duration",
+		"SPEC.yml:31: timeout 'soon' of test 'leader' is not a valid duration",
+		"SPEC.yml:22: healthcheck must have exactly one of http, tcp, command and service",
+		"SPEC.yml:26: kubernetes is only used with composition-type: kubernetes",
+	}, messages(problems))
+
+	// older versions are checked after migration
+	spec, problems = Spec("SPEC.yml", []byte(`---
+specVersion: 0.1.0
+spec:
+  name: test
+  version: 0.1.0
+  provision: provision.yml
+  composition: composition.yml
+  dependencies:
+    consul-discovery: version=v1
+`))
+	assert.NotNil(t, spec)
+	assert.Equal(t, []string{
+		"SPEC.yml:2: spec version 0.1.0 is outdated, run `dpm migrate` to upgrade it to 0.2.0",
+		"SPEC.yml:9: spec.dependencies.consul-discovery.version: 'v1' must match ^[0-9]+(\\.[0-9A-Za-z]+)*$",
+	}, messages(problems))
+
+	_, problems = Spec("SPEC.yml", []byte("specVersion: 9.9\nspec: {}\n"))
+	assert.Equal(t, []string{"SPEC.yml: Spec version '9.9' is not supported."}, messages(problems))
+
+	_, problems = Spec("SPEC.yml", []byte(`---
+specVersion: 0.2.0
+spec:
+  name: test
+  version: 0.1.0
+  provision: provision.yml
+  composition: composition.yml
+  parameters:
+    node-count: {}
+    node_count: {}
+`))
+	assert.Equal(t, []string{
+		"SPEC.yml:8: parameters node-count and node_count are both passed as NODE_COUNT",
+	}, messages(problems))
+}
+
+func TestLintProvision(t *testing.T) {
+	yml := []byte(`---
+machines:
+  master:
+    driver: digitalocean
+    export: true
+    options:
+      digitalocean-size: 512
+      engine-opt:
+        cluster-store: consul://${consul:8500
+  ocean:
+    driver: unknown
+    instances: 2
+    export: true
+    post-provision:
+      - echo "${ip ocean-1}
+export-envs:
+  MASTER: ${this}
+  URL: ${machine.master.url}
+  HOST: ${machine.master.host}
+  REGION: ${env.REGION:-nyc3}
+`)
+	problems := Provision("provision.yml", yml)
+	assert.Equal(t, []string{
+		"provision.yml:11: machines.ocean.driver: 'unknown' must be one of amazonec2, azure, digitalocean, exoscale, generic, google, hyperv, local, none, openstack, rackspace, softlayer, ssh, virtualbox, vmwarefusion, vmwarevcloudair, vmwarevsphere",
+		"provision.yml:7: machine master: option digitalocean-size must be a string, a boolean or a map of strings, quote it if it is a number",
+		"provision.yml:9: unclosed reference in 'consul://${consul:8500'",
+		"provision.yml:13: machine ocean: a machine having many instances cannot be exported",
+		"provision.yml:15: command 'echo \"${ip ocean-1}': invalid command line string",
+		"provision.yml:13: exactly one machine must be exported, found master, ocean",
+		"provision.yml:19: invalid reference ${machine.master.host}, use ${machine.<name>.ip} or ${machine.<name>.url}",
+		"provision.yml:17: ${this} can only be used in machine definitions",
+	}, messages(problems))
+
+	problems = Provision("provision.yml", []byte(`---
+machines:
+  node:
+    driver: none
+    instances: 3
+    swarm-mode: worker
+  master:
+    driver: none
+    export: true
+    swarm-mode: leader
+`))
+	assert.Equal(t, []string{
+		"provision.yml:10: machines.master.swarm-mode: 'leader' must be one of manager, worker",
+		"provision.yml:2: swarm workers need at least one manager",
+	}, messages(problems))
+
+	problems = Provision("provision.yml", []byte(`---
+machines:
+  node:
+    driver: none
+    export: true
+    swarm-mode: worker
+`))
+	assert.Equal(t, []string{
+		"provision.yml:6: machine node: a swarm worker cannot be exported, export a manager",
+		"provision.yml:2: swarm workers need at least one manager",
+	}, messages(problems))
+
+	problems = Provision("provision.yml", []byte(`---
+machines:
+  laptop:
+    driver: local
+    export: true
+  node:
+    driver: ssh
+    instances: 3
+    options:
+      ssh-host: 10.0.0.2,10.0.0.3
+  edge:
+    driver: ssh
+`))
+	assert.Equal(t, []string{
+		"provision.yml:12: machine edge: the ssh driver requires the ssh-host option",
+		"provision.yml:10: machine node: ssh-host lists 2 hosts for 3 instances",
+	}, messages(problems))
+}
+
+func TestLintDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dpm")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "SPEC.yml"), []byte(`---
+specVersion: 0.2.0
+spec:
+  name: test
+  version: 0.1.0
+  provision: provision.yml
+  composition: composition.yml
+  dirs:
+    - web
+  parameters:
+    url: {}
+`), 0644)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "provision.yml"), []byte(`---
+machines:
+  node:
+    driver: none
+    export: true
+    options:
+      url: ${param.url}
+    post-provision:
+      - echo ${param.port}
+`), 0644)
+	assert.NoError(t, err)
+
+	problems := Dir(dir)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "SPEC.yml") + ":7: composition 'composition.yml' does not exist",
+		filepath.Join(dir, "SPEC.yml") + ":9: dirs 'web' does not exist",
+		filepath.Join(dir, "provision.yml") + ":9: parameter 'port' is not declared in the spec",
+	}, messages(problems))
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "composition.yml"), []byte{}, 0644))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "web"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "provision.yml"), []byte(`---
+machines:
+  node:
+    driver: none
+    export: true
+    options:
+      url: ${param.url}
+`), 0644))
+	assert.Equal(t, len(Dir(dir)), 0)
+
+	// kubernetes compositions may be a directory of manifests
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "k8s"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "SPEC.yml"), []byte(`---
+specVersion: 0.2.0
+spec:
+  name: test
+  version: 0.1.0
+  provision: provision.yml
+  composition: k8s
+  composition-type: kubernetes
+  parameters:
+    url: {}
+`), 0644))
+	assert.Equal(t, len(Dir(dir)), 0)
+}
+
+func messages(problems Problems) []string {
+	result := []string{}
+	for _, p := range problems {
+		result = append(result, p.String())
+	}
+	return result
+}
+
+func TestLintDirTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dpm")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "SPEC.yml"), []byte(`---
+specVersion: 0.2.0
+spec:
+  name: test
+  version: 0.1.0
+  provision: provision.yml.tmpl
+  composition: composition.yml.tmpl
+  parameters:
+    driver:
+      default: unknown
+`), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "provision.yml.tmpl"), []byte(`---
+machines:
+  node:
+    driver: {{param "driver"}}
+    export: true
+`), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "composition.yml.tmpl"), []byte(`{{param "size"}}`), 0644))
+
+	problems := Dir(dir)
+	assert.Equal(t, len(problems), 2)
+	assert.Equal(t, problems[0].File, filepath.Join(dir, "composition.yml.tmpl"))
+	assert.Contains(t, problems[0].Message, "parameter size is not declared")
+	assert.Equal(t, problems[1].String(), filepath.Join(dir, "provision.yml.tmpl")+" (rendered):4: machines.node.driver: 'unknown' must be one of amazonec2, azure, digitalocean, exoscale, generic, google, hyperv, local, none, openstack, rackspace, softlayer, ssh, virtualbox, vmwarefusion, vmwarevcloudair, vmwarevsphere")
+}
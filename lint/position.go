@@ -0,0 +1,113 @@
+package lint
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// yaml.v2 does not expose positions of nodes,
+// so keys are located in the document by their indentation.
+
+type line struct {
+	no     int
+	indent int
+	text   string
+	item   bool
+}
+
+// scan splits a YAML document into lines with their indentation.
+// A sequence item is split into an item marker and its content,
+// so "- key: value" becomes a key nested in the item.
+func scan(content []byte) []line {
+	result := []line{}
+	for i, l := range strings.Split(string(content), "\n") {
+		text := strings.TrimLeft(l, " ")
+		indent := len(l) - len(text)
+		text = strings.TrimSpace(text)
+		if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+			continue
+		}
+		for text == "-" || strings.HasPrefix(text, "- ") {
+			result = append(result, line{i + 1, indent, "-", true})
+			rest := strings.TrimLeft(text[1:], " ")
+			indent += len(text) - len(rest)
+			text = rest
+		}
+		if text != "" {
+			result = append(result, line{i + 1, indent, text, false})
+		}
+	}
+	return result
+}
+
+// locate returns the line number of the node at the path,
+// made of mapping keys and sequence indexes, or the line of
+// its closest ancestor found. It returns 0 if nothing is found.
+func locate(content []byte, path ...string) int {
+	lines := scan(content)
+	found := 0
+	from, to := 0, len(lines)
+	for _, p := range path {
+		if from >= to {
+			break
+		}
+		indent := lines[from].indent
+		index, err := strconv.Atoi(p)
+		isIndex := err == nil
+
+		next := -1
+		n := 0
+		for i := from; i < to; i++ {
+			l := lines[i]
+			if l.indent != indent {
+				continue
+			}
+			if isIndex && l.item {
+				if n == index {
+					next = i
+					break
+				}
+				n++
+			} else if !isIndex && !l.item && isKey(l.text, p) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+
+		found = lines[next].no
+		// children are the following lines indented deeper,
+		// or sequence items at the same indentation as the key
+		end := next + 1
+		for end < to && (lines[end].indent > indent ||
+			!lines[next].item && lines[end].item && lines[end].indent == indent) {
+			end++
+		}
+		from, to = next+1, end
+	}
+	return found
+}
+
+func isKey(text, key string) bool {
+	for _, k := range []string{key, `"` + key + `"`, `'` + key + `'`} {
+		if strings.HasPrefix(text, k+":") {
+			return true
+		}
+	}
+	return false
+}
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// errorLine extracts the line number from a yaml.v2 error.
+func errorLine(err error) int {
+	m := yamlErrorLine.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
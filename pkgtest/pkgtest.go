@@ -0,0 +1,200 @@
+// Package pkgtest runs tests of an installed package
+// and reports their results in TAP or JUnit XML.
+package pkgtest
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/secret"
+)
+
+// Report formats.
+const (
+	TAP   = "tap"
+	JUnit = "junit"
+)
+
+var Formats = []string{TAP, JUnit}
+
+// Result is the outcome of a test.
+type Result struct {
+	Name string
+	// Failure tells why the test failed, empty if it passed.
+	Failure string
+	// Skipped is the reason the test did not run, if so.
+	Skipped  string
+	Output   string
+	Duration time.Duration
+}
+
+func (r Result) Passed() bool {
+	return r.Failure == "" && r.Skipped == ""
+}
+
+// Run runs the tests one by one with sh in the directory, adding env
+// to the environment of dpm, and returns their results.
+// Tests left once the context is done are skipped.
+func Run(ctx context.Context, tests []build.Test, dir string, env []string) []Result {
+	results := []Result{}
+	for _, t := range tests {
+		if ctx.Err() != nil {
+			results = append(results, Result{Name: t.Title(), Skipped: "interrupted"})
+			continue
+		}
+
+		fmt.Printf("  ... test '%s'\n", secret.Redact(t.Title()))
+		start := time.Now()
+		out, err := run(ctx, t, dir, env)
+		r := Result{Name: t.Title(), Output: secret.Redact(string(out)), Duration: time.Since(start)}
+		if err != nil {
+			r.Failure = secret.Redact(err.Error())
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// Skip returns results of tests which could not run for the reason.
+func Skip(tests []build.Test, reason string) []Result {
+	results := []Result{}
+	for _, t := range tests {
+		results = append(results, Result{Name: t.Title(), Skipped: reason})
+	}
+	return results
+}
+
+func run(ctx context.Context, t build.Test, dir string, env []string) ([]byte, error) {
+	timeout, err := t.Duration()
+	if err != nil {
+		return nil, err
+	}
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// as for hooks, output goes to a file rather than a pipe
+	// not to wait for processes a timed out test started
+	f, err := ioutil.TempFile("", "dpm-test")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cmd := exec.CommandContext(tctx, "sh", "-c", t.Command)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "DPM_TEST=1"), env...)
+	cmd.Stdout = f
+	cmd.Stderr = f
+	err = cmd.Run()
+
+	out, readErr := ioutil.ReadFile(f.Name())
+	if readErr != nil {
+		return nil, readErr
+	}
+	if tctx.Err() == context.DeadlineExceeded {
+		return out, fmt.Errorf("timed out after %s", timeout)
+	}
+	return out, err
+}
+
+// Write writes the results of the suite in the format.
+func Write(w io.Writer, format string, suite string, results []Result) error {
+	switch format {
+	case TAP:
+		return WriteTAP(w, results)
+	case JUnit:
+		return WriteJUnit(w, suite, results)
+	}
+	return fmt.Errorf("Unknown format '%s', use %s", format, strings.Join(Formats, " or "))
+}
+
+// WriteTAP writes the results in the Test Anything Protocol, version 13.
+// Output of failed tests is written as diagnostics.
+func WriteTAP(w io.Writer, results []Result) error {
+	lines := []string{"TAP version 13", fmt.Sprintf("1..%d", len(results))}
+	for i, r := range results {
+		status := "ok"
+		if r.Failure != "" {
+			status = "not ok"
+		}
+		line := fmt.Sprintf("%s %d - %s", status, i+1, r.Name)
+		if r.Skipped != "" {
+			line += " # SKIP " + r.Skipped
+		}
+		lines = append(lines, line)
+		if r.Failure != "" {
+			lines = append(lines, "# "+r.Failure)
+			for _, l := range strings.Split(strings.TrimSuffix(r.Output, "\n"), "\n") {
+				if l != "" {
+					lines = append(lines, "# "+l)
+				}
+			}
+		}
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+// WriteJUnit writes the results as a JUnit XML test suite.
+func WriteJUnit(w io.Writer, suite string, results []Result) error {
+	s := junitSuite{Name: suite, Tests: len(results)}
+	total := time.Duration(0)
+	for _, r := range results {
+		c := junitCase{
+			Name:      r.Name,
+			ClassName: suite,
+			Time:      fmt.Sprintf("%.3f", r.Duration.Seconds()),
+			SystemOut: r.Output,
+		}
+		if r.Failure != "" {
+			s.Failures++
+			c.Failure = &junitMessage{r.Failure}
+		}
+		if r.Skipped != "" {
+			s.Skipped++
+			c.Skipped = &junitMessage{r.Skipped}
+		}
+		total += r.Duration
+		s.Cases = append(s.Cases, c)
+	}
+	s.Time = fmt.Sprintf("%.3f", total.Seconds())
+
+	content, err := xml.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, xml.Header+string(content)+"\n")
+	return err
+}
@@ -0,0 +1,74 @@
+package pkgtest
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/build"
+)
+
+func TestRun(t *testing.T) {
+	results := Run(context.Background(), []build.Test{
+		{Name: "env", Command: `test "$DPM_TEST$SIZE" = 1large`},
+		{Command: "echo broken; exit 3"},
+		{Name: "slow", Command: "sleep 5", Timeout: "50ms"},
+	}, os.TempDir(), []string{"SIZE=large"})
+
+	assert.Equal(t, len(results), 3)
+	assert.True(t, results[0].Passed())
+	assert.Equal(t, results[1].Name, "echo broken; exit 3")
+	assert.Equal(t, results[1].Failure, "exit status 3")
+	assert.Equal(t, results[1].Output, "broken\n")
+	assert.Equal(t, results[2].Failure, "timed out after 50ms")
+}
+
+func TestRunInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := Run(ctx, []build.Test{{Command: "true"}}, os.TempDir(), nil)
+	assert.Equal(t, results, []Result{{Name: "true", Skipped: "interrupted"}})
+}
+
+var results = []Result{
+	{Name: "ping", Output: "pong\n", Duration: 1500 * time.Millisecond},
+	{Name: "curl", Failure: "exit status 7", Output: "connection refused\n"},
+	{Name: "exec", Skipped: "install failed"},
+}
+
+func TestWriteTAP(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, Write(buf, TAP, "web", results))
+	assert.Equal(t, buf.String(), `TAP version 13
+1..3
+ok 1 - ping
+not ok 2 - curl
+# exit status 7
+# connection refused
+ok 3 - exec # SKIP install failed
+`)
+}
+
+func TestWriteJUnit(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, Write(buf, JUnit, "web", results))
+	assert.Equal(t, buf.String(), `<?xml version="1.0" encoding="UTF-8"?>
+<testsuite name="web" tests="3" failures="1" skipped="1" time="1.500">
+  <testcase name="ping" classname="web" time="1.500">
+    <system-out>pong&#xA;</system-out>
+  </testcase>
+  <testcase name="curl" classname="web" time="0.000">
+    <failure message="exit status 7"></failure>
+    <system-out>connection refused&#xA;</system-out>
+  </testcase>
+  <testcase name="exec" classname="web" time="0.000">
+    <skipped message="install failed"></skipped>
+  </testcase>
+</testsuite>
+`)
+
+	assert.EqualError(t, Write(buf, "html", "web", results), "Unknown format 'html', use tap or junit")
+}
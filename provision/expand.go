@@ -0,0 +1,174 @@
+package provision
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/swasd/dpm/secret"
+)
+
+// expander resolves ${...} references in values of a provision file:
+//
+//	${VAR}                   environment variable, or IP of machine VAR if unset
+//	${ip NAME}               IP of the machine
+//	${self}, ${this}         name and IP of the current machine
+//	${machine.NAME.ip}       IP of the machine
+//	${machine.NAME.url}      Docker URL of the machine
+//	${env.VAR}               environment variable, which must be set
+//	${param.NAME}            value of the package parameter
+//	${secret.NAME}           secret from the secrets store, redacted in logs
+//	${REF:-default}          default if REF cannot be resolved or is empty
+//	${REF:?message}          fails with message if REF cannot be resolved or is empty
+type expander struct {
+	machine *Machine
+	params  map[string]string
+	source  string
+	secrets *secret.Store
+}
+
+func (m *Machine) expander() *expander {
+	return &expander{machine: m, params: m.params, source: m.source}
+}
+
+// expand resolves all references in the value found at the key.
+// The first reference that cannot be resolved is reported with the key and the file.
+func (e *expander) expand(key, value string) (string, error) {
+	var failed error
+	result := os.Expand(value, func(ref string) string {
+		if failed != nil {
+			return ""
+		}
+		val, err := e.resolve(ref)
+		if err != nil {
+			source := e.source
+			if source == "" {
+				source = "provision file"
+			}
+			failed = fmt.Errorf("%s: %s: cannot resolve ${%s}: %s", source, key, ref, err)
+		}
+		return val
+	})
+	return result, failed
+}
+
+func (e *expander) resolve(ref string) (string, error) {
+	if i := strings.Index(ref, ":-"); i >= 0 {
+		val, err := e.lookup(ref[:i])
+		if err != nil || val == "" {
+			return ref[i+2:], nil
+		}
+		return val, nil
+	}
+	if i := strings.Index(ref, ":?"); i >= 0 {
+		val, err := e.lookup(ref[:i])
+		if err != nil || val == "" {
+			message := ref[i+2:]
+			if message == "" {
+				message = ref[:i] + " is required"
+			}
+			return "", fmt.Errorf("%s", message)
+		}
+		return val, nil
+	}
+	return e.lookup(ref)
+}
+
+func (e *expander) lookup(ref string) (string, error) {
+	parts := strings.Split(ref, ".")
+	switch {
+	case ref == "self" || ref == "this":
+		if e.machine == nil {
+			return "", fmt.Errorf("%s can only be used in machine definitions", ref)
+		}
+		if ref == "self" {
+			return e.machine.name, nil
+		}
+		return IP(e.machine.name)
+
+	case parts[0] == "param" && len(parts) == 2:
+		val, exist := e.params[parts[1]]
+		if !exist {
+			return "", fmt.Errorf("parameter %s is not declared", parts[1])
+		}
+		return val, nil
+
+	case parts[0] == "secret" && len(parts) == 2:
+		if e.secrets == nil {
+			store, err := secret.Open()
+			if err != nil {
+				return "", err
+			}
+			e.secrets = store
+		}
+		return e.secrets.Get(parts[1])
+
+	case parts[0] == "env" && len(parts) == 2:
+		val, exist := os.LookupEnv(parts[1])
+		if !exist {
+			return "", fmt.Errorf("environment variable %s is not set", parts[1])
+		}
+		return val, nil
+
+	case parts[0] == "machine" && len(parts) >= 3:
+		name := strings.Join(parts[1:len(parts)-1], ".")
+		switch parts[len(parts)-1] {
+		case "ip":
+			return IP(name)
+		case "url":
+			return machineURL(name)
+		}
+		return "", fmt.Errorf("unknown machine attribute %s", parts[len(parts)-1])
+
+	case strings.HasPrefix(ref, "ip "):
+		return IP(strings.TrimPrefix(ref, "ip "))
+	}
+
+	// a bare name is an environment variable or a machine
+	if val := os.Getenv(ref); val != "" {
+		return val, nil
+	}
+	return IP(ref)
+}
+
+// Expand resolves references in a value outside of machine definitions,
+// as in export-envs. The key names the value in errors.
+func (s *Spec) Expand(key, value string) (string, error) {
+	e := &expander{params: s.Params, source: s.Source}
+	return e.expand(key, value)
+}
+
+// machineURL returns the Docker URL of the machine,
+// DOCKER_HOST of an existing host.
+func machineURL(name string) (string, error) {
+	h, err := LoadHost(name)
+	if err != nil {
+		return "", err
+	}
+	if h != nil {
+		for _, e := range h.Env() {
+			if strings.HasPrefix(e, "DOCKER_HOST=") {
+				return strings.TrimPrefix(e, "DOCKER_HOST="), nil
+			}
+		}
+	}
+	out, err := exec.Command("docker-machine", "-s", dpmHome(), "url", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot get URL of machine %s", name)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (m *Machine) postProvision() ([]string, error) {
+	e := m.expander()
+	result := []string{}
+	for i, p := range m.post {
+		expanded, err := e.expand(fmt.Sprintf("post-provision[%d]", i), p)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expanded)
+	}
+	return result, nil
+}
@@ -0,0 +1,278 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Drivers of existing hosts, which docker-machine does not create.
+const (
+	// LocalDriver targets the Docker host of dpm's environment,
+	// DOCKER_HOST or the local socket.
+	LocalDriver = "local"
+	// SSHDriver targets a Docker host reached with SSH, given by the
+	// ssh-host option, a comma separated list for many instances.
+	// Options ssh-user and ssh-port are optional.
+	SSHDriver = "ssh"
+)
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// IsHostDriver tells if machines of the driver are existing hosts.
+func IsHostDriver(driver string) bool {
+	return driver == LocalDriver || driver == SSHDriver
+}
+
+// Host is an existing host used as a machine. Instead of being created,
+// it is registered under ~/.dpm/hosts for later commands to reach it.
+type Host struct {
+	Name   string
+	Driver string
+	// Address of an SSH host, [user@]host
+	Address string `yaml:",omitempty"`
+	Port    string `yaml:",omitempty"`
+	// DockerEnv is the Docker environment of a local host when registered.
+	DockerEnv []string `yaml:"docker-env,omitempty"`
+}
+
+func hostFile(name string) string {
+	return filepath.Join(dpmHome(), "hosts", name+".yml")
+}
+
+// LoadHost returns the host registered as the machine, nil if the machine
+// is not an existing host.
+func LoadHost(name string) (*Host, error) {
+	content, err := ioutil.ReadFile(hostFile(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	h := &Host{}
+	err = yaml.Unmarshal(content, h)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", hostFile(name), err)
+	}
+	return h, nil
+}
+
+func (h *Host) save() error {
+	content, err := yaml.Marshal(h)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(hostFile(h.Name)), 0755)
+	if err != nil {
+		return err
+	}
+	// definitions may have values of parameters,
+	// WriteFile keeps permissions of an existing file
+	err = ioutil.WriteFile(hostFile(h.Name), content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(hostFile(h.Name), 0600)
+}
+
+func removeHost(name string) error {
+	err := os.Remove(hostFile(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Env returns the Docker environment reaching the host.
+func (h *Host) Env() []string {
+	if h.Driver == SSHDriver {
+		address := h.Address
+		if h.Port != "" {
+			address += ":" + h.Port
+		}
+		return []string{"DOCKER_HOST=ssh://" + address}
+	}
+	for _, e := range h.DockerEnv {
+		if strings.HasPrefix(e, "DOCKER_HOST=") {
+			return h.DockerEnv
+		}
+	}
+	return append([]string{"DOCKER_HOST=" + defaultDockerHost}, h.DockerEnv...)
+}
+
+// IP returns the address of the host, 127.0.0.1 for the local socket.
+func (h *Host) IP() (string, error) {
+	host := h.Address
+	if h.Driver == LocalDriver {
+		host = "127.0.0.1"
+		for _, e := range h.Env() {
+			if strings.HasPrefix(e, "DOCKER_HOST=") {
+				u, err := url.Parse(strings.TrimPrefix(e, "DOCKER_HOST="))
+				if err == nil && u.Host != "" {
+					host = u.Host
+				}
+			}
+		}
+	}
+	host = host[strings.LastIndex(host, "@")+1:]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil || len(addrs) == 0 {
+		return "", fmt.Errorf("cannot get IP of machine %s", h.Name)
+	}
+	return addrs[0], nil
+}
+
+// Command returns the command running the shell command line on the host.
+func (h *Host) Command(ctx context.Context, command string) *exec.Cmd {
+	if h.Driver == SSHDriver {
+		args := []string{}
+		if h.Port != "" {
+			args = append(args, "-p", h.Port)
+		}
+		return exec.CommandContext(ctx, "ssh", append(args, h.Address, command)...)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// host returns the host the machine is, from its options.
+func (m *Machine) host() (*Host, error) {
+	h := &Host{Name: m.name, Driver: m.driver}
+	if m.driver == LocalDriver {
+		for _, e := range os.Environ() {
+			if strings.HasPrefix(e, "DOCKER_") {
+				h.DockerEnv = append(h.DockerEnv, e)
+			}
+		}
+		return h, nil
+	}
+
+	option := func(key string) (string, error) {
+		v, _ := m.options[key].(string)
+		return m.expander().expand("options."+key, v)
+	}
+	hosts, err := option("ssh-host")
+	if err != nil {
+		return nil, err
+	}
+	list := strings.Split(hosts, ",")
+	index := 0
+	if m.instance > 0 {
+		index = m.instance - 1
+	}
+	if index >= len(list) || strings.TrimSpace(list[index]) == "" {
+		return nil, fmt.Errorf("machine %s: option ssh-host has no host for it", m.name)
+	}
+	h.Address = strings.TrimSpace(list[index])
+	user, err := option("ssh-user")
+	if err != nil {
+		return nil, err
+	}
+	if user != "" {
+		h.Address = user + "@" + h.Address
+	}
+	h.Port, err = option("ssh-port")
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// register checks that Docker of the host answers and registers it.
+func (m *Machine) register(ctx context.Context) error {
+	h, err := m.host()
+	if err != nil {
+		return err
+	}
+	if h.Driver == SSHDriver {
+		fmt.Printf("Registering host %s as machine %s...\n", h.Address, m.name)
+	} else {
+		fmt.Printf("Registering the local Docker host as machine %s...\n", m.name)
+	}
+	err = h.ping(ctx)
+	if err != nil {
+		return err
+	}
+	return h.save()
+}
+
+// ping checks that Docker of the host answers.
+func (h *Host) ping(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "docker", "info", "--format", "{{.ServerVersion}}")
+	cmd.Env = withDockerEnv(h.Env())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Cannot reach Docker of machine %s: %s\n%s", h.Name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// scpCommand returns the command copying files between machines:
+// docker-machine scp, unless an argument is on an existing host, then
+// scp with the address and port of SSH hosts, or cp if all are on the
+// local host. scp takes a single port, SSH hosts must share it.
+func scpCommand(args []string) ([]string, error) {
+	result := []string{}
+	local, remote := false, false
+	port, portOf := "", ""
+	for _, arg := range args[1:] {
+		parts := strings.SplitN(arg, ":", 2)
+		if len(parts) == 2 && !strings.HasPrefix(arg, "-") {
+			h, err := LoadHost(parts[0])
+			if err != nil {
+				return nil, err
+			}
+			if h != nil {
+				if h.Driver == SSHDriver {
+					if remote && h.Port != port {
+						return nil, fmt.Errorf("Cannot copy between machines %s and %s, their SSH ports differ", portOf, h.Name)
+					}
+					remote, port, portOf = true, h.Port, h.Name
+					arg = h.Address + ":" + parts[1]
+				} else {
+					local = true
+					arg = parts[1]
+				}
+			}
+		}
+		result = append(result, arg)
+	}
+
+	switch {
+	case remote:
+		if port != "" {
+			result = append([]string{"-P", port}, result...)
+		}
+		return append([]string{"scp"}, result...), nil
+	case local:
+		return append([]string{"cp"}, result...), nil
+	}
+	// it's docker-machine sub-command
+	return append([]string{"docker-machine", "-s", dpmHome()}, args...), nil
+}
+
+// withDockerEnv returns dpm's environment with its Docker variables
+// replaced by those given, for the docker CLI to reach a machine.
+func withDockerEnv(env []string) []string {
+	result := []string{}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "DOCKER_") {
+			result = append(result, e)
+		}
+	}
+	return append(result, env...)
+}
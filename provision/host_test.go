@@ -0,0 +1,131 @@
+package provision
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/dpmtest"
+)
+
+// fakeDocker puts a docker command answering with the exit code on PATH,
+// and makes HOME a temporary directory.
+func fakeDocker(t *testing.T, code string) func() {
+	h := dpmtest.NewHome(t)
+	h.Fake("docker", "exit "+code+"\n")
+
+	oldHost := os.Getenv("DOCKER_HOST")
+	return func() {
+		os.Setenv("DOCKER_HOST", oldHost)
+		h.Close()
+	}
+}
+
+func TestLocalHost(t *testing.T) {
+	defer fakeDocker(t, "0")()
+	os.Setenv("DOCKER_HOST", "tcp://192.168.99.100:2376")
+
+	spec, err := Read([]byte(`---
+machines:
+  laptop:
+    driver: local
+    export: true
+`))
+	assert.NoError(t, err)
+	m := spec.Machine("laptop")
+	assert.False(t, m.exist())
+	status, err := m.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, status, "NotFound")
+
+	assert.NoError(t, spec.create(context.Background(), m))
+	assert.True(t, m.exist())
+	assert.Equal(t, m.GetEnv(), []string{"DOCKER_HOST=tcp://192.168.99.100:2376"})
+	ip, err := IP("laptop")
+	assert.NoError(t, err)
+	assert.Equal(t, ip, "192.168.99.100")
+	url, err := spec.Expand("export-envs.URL", "${machine.laptop.url}")
+	assert.NoError(t, err)
+	assert.Equal(t, url, "tcp://192.168.99.100:2376")
+	status, err = m.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, status, "Running")
+
+	assert.NoError(t, m.Remove(context.Background()))
+	assert.False(t, m.exist())
+}
+
+func TestSSHHosts(t *testing.T) {
+	defer fakeDocker(t, "0")()
+
+	spec, err := Read([]byte(`---
+machines:
+  node:
+    driver: ssh
+    instances: 2
+    options:
+      ssh-host: 10.0.0.2, 10.0.0.3
+      ssh-user: ${param.user}
+      ssh-port: "2222"
+`))
+	assert.NoError(t, err)
+	spec.Params = map[string]string{"user": "core"}
+	for _, m := range spec.Machines() {
+		assert.NoError(t, m.create(context.Background()))
+	}
+
+	h, err := LoadHost("node-2")
+	assert.NoError(t, err)
+	assert.Equal(t, h.Env(), []string{"DOCKER_HOST=ssh://core@10.0.0.3:2222"})
+	url, err := machineURL("node-2")
+	assert.NoError(t, err)
+	assert.Equal(t, url, "ssh://core@10.0.0.3:2222")
+	ip, err := h.IP()
+	assert.NoError(t, err)
+	assert.Equal(t, ip, "10.0.0.3")
+
+	args, err := scpCommand([]string{"scp", "config.json", "node-1:/etc/app/"})
+	assert.NoError(t, err)
+	assert.Equal(t, args, []string{"scp", "-P", "2222", "config.json", "core@10.0.0.2:/etc/app/"})
+	args, err = scpCommand([]string{"scp", "-r", "node-1:/etc/app", "node-2:/etc/"})
+	assert.NoError(t, err)
+	assert.Equal(t, args, []string{"scp", "-P", "2222", "-r", "core@10.0.0.2:/etc/app", "core@10.0.0.3:/etc/"})
+	args, err = scpCommand([]string{"scp", "config.json", "other:/etc/app/"})
+	assert.NoError(t, err)
+	assert.Equal(t, args[0], "docker-machine")
+
+	// default port and user of ssh
+	assert.NoError(t, (&Host{Name: "db", Driver: SSHDriver, Address: "10.0.0.4"}).save())
+	args, err = scpCommand([]string{"scp", "dump.sql", "db:/tmp/"})
+	assert.NoError(t, err)
+	assert.Equal(t, args, []string{"scp", "dump.sql", "10.0.0.4:/tmp/"})
+	_, err = scpCommand([]string{"scp", "node-1:/etc/app", "db:/tmp/"})
+	assert.EqualError(t, err, "Cannot copy between machines node-1 and db, their SSH ports differ")
+}
+
+func TestUnreachableHost(t *testing.T) {
+	defer fakeDocker(t, "1")()
+
+	spec, err := Read([]byte(`---
+machines:
+  laptop:
+    driver: local
+`))
+	assert.NoError(t, err)
+	err = spec.Machine("laptop").create(context.Background())
+	assert.Error(t, err)
+	assert.False(t, spec.Machine("laptop").exist())
+}
+
+func TestSaveHostError(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dpmHome(), "hosts"), nil, 0644))
+
+	err := (&Host{Name: "laptop", Driver: LocalDriver}).save()
+	assert.IsType(t, err, &os.PathError{})
+	assert.Equal(t, err.(*os.PathError).Op, "mkdir")
+}
@@ -0,0 +1,53 @@
+package provision
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Machines are marked as pending before docker-machine starts creating them
+// and unmarked once their post-provision commands are done. A machine still
+// marked as pending was left behind by an interrupted run.
+
+func pendingDir() string {
+	return filepath.Join(dpmHome(), "pending")
+}
+
+func markPending(name string) error {
+	err := os.MkdirAll(pendingDir(), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(pendingDir(), name), []byte{}, 0644)
+}
+
+func clearPending(name string) error {
+	err := os.Remove(filepath.Join(pendingDir(), name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func isPending(name string) bool {
+	_, err := os.Stat(filepath.Join(pendingDir(), name))
+	return err == nil
+}
+
+// PendingMachines returns names of machines whose creation was interrupted.
+func PendingMachines() ([]string, error) {
+	infos, err := ioutil.ReadDir(pendingDir())
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, f := range infos {
+		result = append(result, f.Name())
+	}
+	return result, nil
+}
@@ -0,0 +1,38 @@
+package provision
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingMachines(t *testing.T) {
+	home, err := ioutil.TempDir("", "dpm")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", oldHome)
+
+	pending, err := PendingMachines()
+	assert.NoError(t, err)
+	assert.Equal(t, pending, []string{})
+
+	assert.NoError(t, markPending("ocean-1"))
+	assert.NoError(t, markPending("ocean-2"))
+	assert.True(t, isPending("ocean-1"))
+
+	pending, err = PendingMachines()
+	assert.NoError(t, err)
+	assert.Equal(t, pending, []string{"ocean-1", "ocean-2"})
+
+	assert.NoError(t, clearPending("ocean-1"))
+	assert.NoError(t, clearPending("ocean-1"))
+	assert.False(t, isPending("ocean-1"))
+
+	pending, err = PendingMachines()
+	assert.NoError(t, err)
+	assert.Equal(t, pending, []string{"ocean-2"})
+}
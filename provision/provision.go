@@ -1,16 +1,19 @@
 package provision
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/mattn/go-shellwords"
+	"github.com/swasd/dpm/secret"
 
 	"gopkg.in/yaml.v2"
 )
@@ -18,15 +21,41 @@ import (
 type Spec struct {
 	MachineSpecs map[string]MachineSpec `yaml:"machines,omitempty"`
 	ExportedEnvs map[string]string      `yaml:"export-envs,omitempty"`
+
+	// Params are values of the package parameters,
+	// referred as ${param.name} in options, commands and envs.
+	Params map[string]string `yaml:"-"`
+
+	// Source is the name of the file the spec is read from,
+	// for reporting references that cannot be resolved.
+	Source string `yaml:"-"`
+
+	// Journal, if set, records completed provisioning steps
+	// and makes Provision skip the steps already done.
+	Journal Journal `yaml:"-"`
 }
 
+// Journal keeps track of completed provisioning steps of machines.
+type Journal interface {
+	IsDone(action, machine string) bool
+	Done(action, machine string) error
+}
+
+const (
+	MachineCreated  = "machine-created"
+	PostProvisioned = "post-provisioned"
+)
+
 type MachineSpec struct {
-	Driver        string
-	Instances     *int
+	Driver        string `schema:"required,enum=@drivers"`
+	Instances     *int   `schema:"minimum=1"`
 	Export        bool
-	Options       map[string]interface{}
-	PreProvision  []string `yaml:"pre-provision,omitempty"`
-	PostProvision []string `yaml:"post-provision,omitempty"`
+	Options       map[string]interface{} `schema:"values=string|boolean|map"`
+	PreProvision  []string               `yaml:"pre-provision,omitempty"`
+	PostProvision []string               `yaml:"post-provision,omitempty"`
+	// SwarmMode is the role of the machine in a swarm-mode cluster,
+	// formed once all machines are provisioned.
+	SwarmMode string `yaml:"swarm-mode,omitempty" schema:"enum=@swarm-roles"`
 }
 
 type Machine struct {
@@ -36,6 +65,11 @@ type Machine struct {
 	options map[string]interface{}
 	pre     []string
 	post    []string
+	swarm   string
+	// instance is the number of the instance, 0 for a single machine
+	instance int
+	params   map[string]string
+	source   string
 }
 
 func LoadFromFile(filename string) (*Spec, error) {
@@ -43,7 +77,12 @@ func LoadFromFile(filename string) (*Spec, error) {
 	if err != nil {
 		return nil, err
 	}
-	return Read(content)
+	spec, err := Read(content)
+	if err != nil {
+		return nil, err
+	}
+	spec.Source = filepath.Base(filename)
+	return spec, nil
 }
 
 func Read(yml []byte) (*Spec, error) {
@@ -65,6 +104,29 @@ func (s *Spec) Machine(name string) *Machine {
 	return nil
 }
 
+// Drivers maps docker-machine drivers known by dpm
+// to their platform abbreviations used in package file names.
+var Drivers = map[string]string{
+	"amazonec2":       "aws",
+	"azure":           "az",
+	"exoscale":        "ex",
+	"google":          "gce",
+	"generic":         "ge",
+	"hyperv":          "hv",
+	"openstack":       "os",
+	"rackspace":       "rs",
+	"softlayer":       "sl",
+	"virtualbox":      "vbox",
+	"vmwarevcloudair": "vca",
+	"vmwarefusion":    "vf",
+	"vmwarevsphere":   "vs",
+	"digitalocean":    "do",
+	"none":            "none",
+	// existing hosts, not created by docker-machine
+	LocalDriver: "local",
+	SSHDriver:   "ssh",
+}
+
 type ExportedMachine struct {
 	Name string
 	Mode ExportedMode
@@ -73,14 +135,22 @@ type ExportedMode string
 
 const (
 	Standalone = ExportedMode("standalone")
-	Swarm      = ExportedMode("swarm")
+	// Swarm is a legacy swarm, the exported machine having the swarm-master option.
+	Swarm = ExportedMode("swarm")
+	// SwarmMode is a swarm-mode cluster, the exported machine being a manager.
+	SwarmMode = ExportedMode("swarm-mode")
 )
 
 func (s *Spec) ExportedMachine() ExportedMachine {
 	for _, m := range s.Machines() {
 		if m.export {
 			_, exist := m.options["swarm-master"]
-			if exist {
+			if m.swarm == Manager {
+				return ExportedMachine{
+					m.name,
+					SwarmMode,
+				}
+			} else if exist {
 				return ExportedMachine{
 					m.name,
 					Swarm,
@@ -111,17 +181,24 @@ func (s *Spec) Machines() []*Machine {
 				export:  v.Export,
 				pre:     v.PreProvision,
 				post:    v.PostProvision,
+				swarm:   v.SwarmMode,
+				params:  s.Params,
+				source:  s.Source,
 			}
 			result = append(result, machine)
 		} else {
 			for i := 1; i <= *v.Instances; i++ {
 				machine := &Machine{
-					name:    fmt.Sprintf("%s-%d", k, i),
-					driver:  v.Driver,
-					options: v.Options,
-					export:  false,
-					pre:     v.PreProvision,
-					post:    v.PostProvision,
+					name:     fmt.Sprintf("%s-%d", k, i),
+					driver:   v.Driver,
+					options:  v.Options,
+					export:   false,
+					pre:      v.PreProvision,
+					post:     v.PostProvision,
+					swarm:    v.SwarmMode,
+					instance: i,
+					params:   s.Params,
+					source:   s.Source,
 				}
 				result = append(result, machine)
 			}
@@ -130,65 +207,202 @@ func (s *Spec) Machines() []*Machine {
 	return result
 }
 
-func (s *Spec) Provision() error {
+// definition is what a machine is created from.
+type definition struct {
+	driver string
+	// options are the command line of docker-machine create,
+	// or options as written if they cannot be expanded
+	options  interface{}
+	export   bool
+	pre      []string
+	post     []string
+	swarm    string
+	instance int
+}
+
+func (m *Machine) definition() definition {
+	var options interface{} = m.options
+	if cmdLine, err := m.cmdLine(); err == nil {
+		options = cmdLine
+	}
+	return definition{m.driver, options, m.export, m.pre, m.post, m.swarm, m.instance}
+}
+
+// Changed returns machines of the old spec which are not in the new spec,
+// or are defined differently there. Parameters only matter as far as
+// options of the machine refer to them.
+func Changed(old, new *Spec) []*Machine {
+	result := []*Machine{}
+	for _, m := range old.Machines() {
+		nm := new.Machine(m.name)
+		if nm == nil || !reflect.DeepEqual(m.definition(), nm.definition()) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func (s *Spec) Provision(ctx context.Context) error {
 	for _, m := range s.Machines() {
-		// TODO force delete and re-create
-		if m.exist() {
-			continue
+		// stop launching new work once interrupted
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		err := m.create()
-		if err != nil {
-			times := 0
-		loop:
-			time.Sleep(2 * time.Second)
-			err = m.reprovision()
-			if err != nil {
-				times++
-				if times < 3 {
-					goto loop
-				}
 
-				for m.doDelete() != nil {
-					time.Sleep(1 * time.Second)
+		if !(s.isDone(MachineCreated, m.name) && m.exist()) {
+			// TODO force delete and re-create
+			if m.exist() {
+				if !isPending(m.name) {
+					continue
 				}
+				// a previous run was interrupted while creating this machine
+				fmt.Printf("Machine %s was not completely provisioned, re-creating...\n", m.name)
+				err := m.forceDelete(ctx)
+				if err != nil {
+					return err
+				}
+			}
+
+			err := s.create(ctx, m)
+			if err != nil {
 				return err
 			}
 		}
 
-		// TODO logging outputs
-		_, err = m.executePostProvision()
+		if !s.isDone(PostProvisioned, m.name) {
+			// TODO logging outputs
+			_, err := m.executePostProvision(ctx)
+			if err != nil {
+				return err
+			}
+			err = s.done(PostProvisioned, m.name)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := clearPending(m.name)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return s.formSwarm(ctx)
+}
+
+// create creates the machine, retrying to provision it on failures.
+// The machine stays marked as pending until its post-provision is done.
+func (s *Spec) create(ctx context.Context, m *Machine) error {
+	err := m.executePreProvision(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = markPending(m.name)
+	if err != nil {
+		return err
+	}
+
+	err = m.create(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			// keep the pending mark, so the next run will clean it up
+			return ctx.Err()
+		}
+
+		times := 0
+	loop:
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+		err = m.reprovision(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			times++
+			if times < 3 {
+				goto loop
+			}
+
+			for m.doDelete(ctx) != nil {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(1 * time.Second):
+				}
+			}
+			clearPending(m.name)
+			return err
+		}
+	}
+
+	return s.done(MachineCreated, m.name)
+}
+
+func (s *Spec) isDone(action, machine string) bool {
+	if s.Journal == nil {
+		return false
+	}
+	return s.Journal.IsDone(action, machine)
+}
+
+func (s *Spec) done(action, machine string) error {
+	if s.Journal == nil {
+		return nil
+	}
+	return s.Journal.Done(action, machine)
 }
 
 func (s *Spec) ExportEnvsToFile(filename string) error {
+	keys := []string{}
+	for k := range s.ExportedEnvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	e := &expander{params: s.Params, source: s.Source}
 	envs := []string{}
-	for k, v := range s.ExportedEnvs {
-		val := os.Expand(v, func(key string) string { return expand(key) })
+	for _, k := range keys {
+		val, err := e.expand("export-envs."+k, s.ExportedEnvs[k])
+		if err != nil {
+			return err
+		}
 		envs = append(envs, k+"="+val)
 	}
 
-	content := strings.Join(envs, "\n")
-	return ioutil.WriteFile(filename, []byte(content), 0644)
+	// values may come from parameters and secrets,
+	// and WriteFile keeps permissions of an existing file
+	err := os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(filename, []byte(strings.Join(envs, "\n")), 0600)
 }
 
-func (s *Spec) RemoveMachines() error {
+func (s *Spec) RemoveMachines(ctx context.Context) error {
 	for _, m := range s.Machines() {
-		// TODO force delete and re-create
-		if m.exist() {
-			err := m.doDelete()
+		err := m.Remove(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes the machine if it exists.
+func (m *Machine) Remove(ctx context.Context) error {
+	if m.exist() {
+		err := m.doDelete(ctx)
+		if err != nil {
+			err = m.forceDelete(ctx)
 			if err != nil {
-				err = m.forceDelete()
-				if err != nil {
-					return err
-				}
+				return err
 			}
 		}
 	}
-	return nil
+	return clearPending(m.name)
 }
 
 func (m *Machine) Name() string {
@@ -199,7 +413,8 @@ func (m *Machine) Driver() string {
 	return m.driver
 }
 
-func (m *Machine) cmdLine() []string {
+func (m *Machine) cmdLine() ([]string, error) {
+	e := m.expander()
 	result := []string{"--driver", m.driver}
 	keys := []string{}
 	for k := range m.options {
@@ -210,9 +425,11 @@ func (m *Machine) cmdLine() []string {
 		v := m.options[k]
 		switch val := v.(type) {
 		case string:
-			result = append(result, "--"+k)
-			val = os.Expand(val, func(key string) string { return m.expand(key) })
-			result = append(result, val)
+			val, err := e.expand("options."+k, val)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, "--"+k, val)
 		case map[interface{}]interface{}:
 			keys := []string{}
 			for kk := range val {
@@ -220,10 +437,11 @@ func (m *Machine) cmdLine() []string {
 			}
 			sort.Strings(keys)
 			for _, kk := range keys {
-				vv := val[kk]
-				result = append(result, "--"+k)
-				evv := os.Expand(vv.(string), func(key string) string { return m.expand(key) })
-				result = append(result, kk+"="+evv)
+				evv, err := e.expand("options."+k+"."+kk, val[kk].(string))
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, "--"+k, kk+"="+evv)
 			}
 		case bool:
 			if val {
@@ -232,7 +450,7 @@ func (m *Machine) cmdLine() []string {
 		}
 	}
 	result = append(result, m.name)
-	return result
+	return result, nil
 }
 
 func dpmHome() string {
@@ -240,7 +458,35 @@ func dpmHome() string {
 	return filepath.Join(home, ".dpm")
 }
 
+// Status returns the state of the machine reported by docker-machine,
+// like Running or Stopped.
+// Existing hosts are Running when their Docker answers, Unreachable otherwise.
+func (m *Machine) Status() (string, error) {
+	if IsHostDriver(m.driver) {
+		h, err := LoadHost(m.name)
+		if err != nil || h == nil {
+			return "NotFound", err
+		}
+		if h.ping(context.Background()) != nil {
+			return "Unreachable", nil
+		}
+		return "Running", nil
+	}
+	out, err := exec.Command("docker-machine", "-s", dpmHome(), "status", m.name).CombinedOutput()
+	if err != nil {
+		if !m.exist() {
+			return "NotFound", nil
+		}
+		return "", fmt.Errorf("cannot get status of machine %s: %s", m.name, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 func (m *Machine) exist() bool {
+	if IsHostDriver(m.driver) {
+		h, err := LoadHost(m.name)
+		return err == nil && h != nil
+	}
 	cmd := exec.Command("docker-machine", "-s", dpmHome(), "ls", "-f", "{{.Name}}", "--filter=name="+m.name)
 	out, err := cmd.Output()
 	if err != nil {
@@ -252,93 +498,68 @@ func (m *Machine) exist() bool {
 	return false
 }
 
-func (m *Machine) create() error {
-	args := append([]string{"-s", dpmHome(), "create"}, m.cmdLine()...)
-	cmd := exec.Command("docker-machine", args...)
+func (m *Machine) create(ctx context.Context) error {
+	if IsHostDriver(m.driver) {
+		return m.register(ctx)
+	}
+	cmdLine, err := m.cmdLine()
+	if err != nil {
+		return err
+	}
+	args := append([]string{"-s", dpmHome(), "create"}, cmdLine...)
+	cmd := exec.CommandContext(ctx, "docker-machine", args...)
 	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// drivers may print options given, as in debug logs
+	cmd.Stdout = secret.NewRedactor(os.Stdout)
+	cmd.Stderr = secret.NewRedactor(os.Stderr)
 	return cmd.Run()
 }
 
-func (m *Machine) forceDelete() error {
+func (m *Machine) forceDelete(ctx context.Context) error {
+	if IsHostDriver(m.driver) {
+		return removeHost(m.name)
+	}
 	args := append([]string{"-s", dpmHome(), "rm", "-f"}, m.name)
-	cmd := exec.Command("docker-machine", args...)
+	cmd := exec.CommandContext(ctx, "docker-machine", args...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
-func (m *Machine) doDelete() error {
+// doDelete deletes the machine. Existing hosts are only unregistered.
+func (m *Machine) doDelete(ctx context.Context) error {
+	if IsHostDriver(m.driver) {
+		return removeHost(m.name)
+	}
 	args := append([]string{"-s", dpmHome(), "rm", "-y"}, m.name)
-	cmd := exec.Command("docker-machine", args...)
+	cmd := exec.CommandContext(ctx, "docker-machine", args...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
-func (m *Machine) reprovision() error {
+func (m *Machine) reprovision(ctx context.Context) error {
+	if IsHostDriver(m.driver) {
+		return m.register(ctx)
+	}
 	args := append([]string{"-s", dpmHome(), "provision"}, m.name)
-	cmd := exec.Command("docker-machine", args...)
+	cmd := exec.CommandContext(ctx, "docker-machine", args...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
-func expand(key string) string {
-	val := os.Getenv(key)
-	if val == "" {
-		parts := strings.SplitN(key, " ", 2)
-		cmd := ""
-		arg := ""
-		if len(parts) == 1 {
-			cmd = "ip"
-			arg = parts[0]
-		} else if len(parts) == 2 && parts[0] == "ip" {
-			cmd = "ip"
-			arg = parts[1]
-		}
-		out, err := exec.Command("docker-machine", "-s", dpmHome(), cmd, arg).Output()
-		if err != nil {
-			val = ""
-		}
-
-		val = strings.TrimSpace(string(out))
-		if cmd == "ip" {
-			parts := strings.SplitN(val, ":", 2)
-			val = parts[0]
+func (m *Machine) GetEnv() []string {
+	if IsHostDriver(m.driver) {
+		h, err := LoadHost(m.name)
+		if err != nil || h == nil {
+			return []string{}
 		}
+		return h.Env()
 	}
-	return val
-}
-
-func (m *Machine) expand(key string) string {
-
-	if key == "self" {
-		return m.name
-	}
-	if key == "this" {
-		return expand(m.name)
-	}
-
-	return expand(key)
-}
-
-func (m *Machine) postProvision() []string {
-	result := []string{}
-	for _, p := range m.post {
-		expanded := os.Expand(p, func(key string) string {
-			return m.expand(key)
-		})
-		result = append(result, expanded)
-	}
-	return result
-}
-
-func (m *Machine) GetEnv() []string {
 	home := os.Getenv("HOME")
 	result := []string{}
 	cmd := exec.Command("docker-machine",
@@ -361,36 +582,78 @@ func (m *Machine) GetEnv() []string {
 	return result
 }
 
-func (m *Machine) executePostProvision() ([]string, error) {
+// executePreProvision runs pre-provision commands on the host
+// before the machine is created. A failing command stops the creation.
+func (m *Machine) executePreProvision(ctx context.Context) error {
+	if len(m.pre) == 0 {
+		return nil
+	}
+	fmt.Println("Executing pre-provision commands...")
+
+	e := m.expander()
+	for i, p := range m.pre {
+		p, err := e.expand(fmt.Sprintf("pre-provision[%d]", i), p)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("  ... '%s'\n", secret.Redact(p))
+		args, err := shellwords.Parse(p)
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("Pre-provision command '%s' of machine %s failed: %s\n%s",
+				secret.Redact(p), m.name, err, secret.Redact(string(out)))
+		}
+	}
+	return nil
+}
+
+func (m *Machine) executePostProvision(ctx context.Context) ([]string, error) {
 
 	fmt.Println("Executing post-provision commands...")
 
+	commands, err := m.postProvision()
+	if err != nil {
+		return []string{}, err
+	}
+
 	out := []string{}
-	for _, p := range m.postProvision() {
+	for _, p := range commands {
 
-		fmt.Printf("  ... '%s'\n", p)
+		fmt.Printf("  ... '%s'\n", secret.Redact(p))
 		args, err := shellwords.Parse(p)
 		if err != nil {
 			return []string{}, err
 		}
 
 		if args[0] == "scp" {
-			// it's docker-machine sub-command
-			args = append([]string{"docker-machine", "-s", dpmHome()}, args...)
-		}
-
-		for i := range args {
-			args[i] = os.Expand(args[i], func(key string) string { return m.expand(key) })
+			args, err = scpCommand(args)
+			if err != nil {
+				return out, err
+			}
 		}
 
-		cmd := exec.Command(args[0], args[1:]...)
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 
 		if args[0] == "docker" {
-			cmd.Env = m.GetEnv()
+			cmd.Env = withDockerEnv(m.GetEnv())
 		}
 
 		o, err := cmd.CombinedOutput()
 		out = append(out, string(o))
+		if ctx.Err() != nil {
+			return out, ctx.Err()
+		}
 	}
 	return out, nil
 }
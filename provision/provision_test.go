@@ -1,9 +1,14 @@
 package provision
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/dpmtest"
 )
 
 func TestReadSpec(t *testing.T) {
@@ -65,7 +70,7 @@ machines:
 
 	m := spec.Machine("ocean-1")
 	assert.NotNil(t, m)
-	assert.Equal(t, m.cmdLine(), []string{
+	assert.Equal(t, cmdLine(t, m), []string{
 		"--driver", "digitalocean",
 		"ocean-1"})
 }
@@ -86,7 +91,7 @@ machines:
 
 	m := spec.Machine("ocean-1")
 	assert.NotNil(t, m)
-	assert.Equal(t, m.cmdLine(), []string{
+	assert.Equal(t, cmdLine(t, m), []string{
 		"--driver", "digitalocean",
 		"--engine-install-url", "https://test.docker.com",
 		"ocean-1"})
@@ -111,7 +116,7 @@ machines:
 
 	m := spec.Machine("ocean-1")
 	assert.NotNil(t, m)
-	assert.Equal(t, m.cmdLine(), []string{
+	assert.Equal(t, cmdLine(t, m), []string{
 		"--driver", "digitalocean",
 		"--engine-install-url", "https://test.docker.com",
 		"--engine-opt", "cluster-advertise=eth0:2376",
@@ -140,7 +145,7 @@ machines:
 
 	m := spec.Machine("ocean-1")
 	assert.NotNil(t, m)
-	assert.Equal(t, m.cmdLine(), []string{
+	assert.Equal(t, cmdLine(t, m), []string{
 		"--driver", "digitalocean",
 		"--engine-install-url", "https://test.docker.com",
 		"--engine-opt", "cluster-advertise=eth0:2376",
@@ -151,6 +156,10 @@ machines:
 }
 
 func TestCreate(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+
 	yml := `---
 machines:
   fake:
@@ -170,14 +179,18 @@ machines:
 
 	m := spec.Machine("fake-1")
 	assert.NotNil(t, m)
-	err = m.create()
+	err = m.create(context.Background())
 	assert.NoError(t, err)
 
-	err = m.doDelete()
+	err = m.doDelete(context.Background())
 	assert.NoError(t, err)
 }
 
 func TestExpadingProvision(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+
 	yml := `---
 machines:
   fake:
@@ -198,16 +211,20 @@ machines:
 	assert.Equal(t, len(machines), 2)
 
 	m := spec.Machine("fake-1")
-	err = m.create()
+	err = m.create(context.Background())
 	assert.NoError(t, err)
-	for _, p := range m.postProvision() {
+	for _, p := range postProvision(t, m) {
 		assert.Equal(t, p, "bash -c echo 1.2.3.4 1.2.3.4")
 	}
-	err = m.doDelete()
+	err = m.doDelete(context.Background())
 	assert.NoError(t, err)
 }
 
 func TestPostProvision(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+
 	yml := `---
 machines:
   fake:
@@ -228,15 +245,262 @@ machines:
 	assert.Equal(t, len(machines), 2)
 
 	m := spec.Machine("fake-1")
-	err = m.create()
+	err = m.create(context.Background())
 	assert.NoError(t, err)
-	for _, p := range m.postProvision() {
+	for _, p := range postProvision(t, m) {
 		assert.Equal(t, p, "bash -c \"echo 1.2.3.4 1.2.3.4 fake-1\"")
 	}
-	out, err := m.executePostProvision()
+	out, err := m.executePostProvision(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, out[0], "1.2.3.4 1.2.3.4 fake-1\n")
 
-	err = m.doDelete()
+	err = m.doDelete(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestProvisionAndRemove(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	h.FakeMachine()
+	h.FakeDocker()
+
+	spec, err := Read([]byte(`---
+machines:
+  node:
+    instances: 2
+    driver: none
+    options:
+      url: tcp://10.0.0.1:2376
+    post-provision:
+      - docker run -d --name agent-${self} consul
+`))
+	assert.NoError(t, err)
+	journal := memoryJournal{}
+	spec.Journal = journal
+	assert.NoError(t, spec.Provision(context.Background()))
+	assert.Equal(t, h.Calls("docker-machine"), []string{
+		"ls -f {{.Name}} --filter=name=node-1",
+		"create --driver none --url tcp://10.0.0.1:2376 node-1",
+		"env --shell sh node-1",
+		"ls -f {{.Name}} --filter=name=node-2",
+		"create --driver none --url tcp://10.0.0.1:2376 node-2",
+		"env --shell sh node-2",
+	})
+	assert.Equal(t, h.Calls("docker"), []string{
+		"run -d --name agent-node-1 consul",
+		"run -d --name agent-node-2 consul",
+	})
+
+	// journaled steps are not done again
+	assert.NoError(t, spec.Provision(context.Background()))
+	assert.Equal(t, len(h.Calls("docker-machine")), 8)
+	assert.Equal(t, len(h.Calls("docker")), 2)
+
+	ip, err := IP("node-2")
+	assert.NoError(t, err)
+	assert.Equal(t, ip, "10.0.0.1")
+	status, err := spec.Machine("node-2").Status()
+	assert.NoError(t, err)
+	assert.Equal(t, status, "Running")
+
+	assert.NoError(t, spec.RemoveMachines(context.Background()))
+	assert.Equal(t, h.Calls("docker-machine")[10:], []string{
+		"ls -f {{.Name}} --filter=name=node-1",
+		"rm -y node-1",
+		"ls -f {{.Name}} --filter=name=node-2",
+		"rm -y node-2",
+	})
+	status, err = spec.Machine("node-2").Status()
+	assert.NoError(t, err)
+	assert.Equal(t, status, "NotFound")
+}
+
+func TestChangedMachines(t *testing.T) {
+	old, err := Read([]byte(`---
+machines:
+  master:
+    driver: digitalocean
+    export: true
+  ocean:
+    instances: 3
+    driver: digitalocean
+    options:
+      digitalocean-image: debian-8-x64
+  consul:
+    driver: digitalocean
+`))
+	assert.NoError(t, err)
+
+	new, err := Read([]byte(`---
+machines:
+  master:
+    driver: digitalocean
+    export: true
+  ocean:
+    instances: 2
+    driver: digitalocean
+    options:
+      digitalocean-image: debian-9-x64
+`))
+	assert.NoError(t, err)
+
+	names := []string{}
+	for _, m := range Changed(old, new) {
+		names = append(names, m.Name())
+	}
+	sort.Strings(names)
+	assert.Equal(t, names, []string{"consul", "ocean-1", "ocean-2", "ocean-3"})
+	assert.Equal(t, len(Changed(new, new)), 0)
+
+	// parameters matter only where options refer to them
+	withParams := func(params map[string]string) *Spec {
+		spec, err := Read([]byte(`---
+machines:
+  ocean:
+    driver: digitalocean
+    options:
+      digitalocean-size: ${param.size}
+`))
+		assert.NoError(t, err)
+		spec.Params = params
+		return spec
+	}
+	small := withParams(map[string]string{"size": "512mb", "replicas": "1"})
+	assert.Equal(t, len(Changed(small, withParams(map[string]string{"size": "512mb", "replicas": "3"}))), 0)
+	assert.Equal(t, len(Changed(small, withParams(map[string]string{"size": "1gb", "replicas": "1"}))), 1)
+}
+
+func TestParams(t *testing.T) {
+	yml := `---
+machines:
+  ocean:
+    driver: digitalocean
+    options:
+      digitalocean-region: ${param.region}
+    post-provision:
+      - echo ${param.token} ${self}
+export-envs:
+  REGION: ${param.region}
+`
+	spec, err := Read([]byte(yml))
+	assert.NoError(t, err)
+	spec.Params = map[string]string{"region": "sgp1", "token": "abc"}
+
+	m := spec.Machine("ocean")
+	assert.Equal(t, cmdLine(t, m), []string{"--driver", "digitalocean", "--digitalocean-region", "sgp1", "ocean"})
+	assert.Equal(t, postProvision(t, m), []string{"echo abc ocean"})
+
+	f, err := ioutil.TempFile("", "dpm")
+	assert.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	assert.NoError(t, os.Chmod(f.Name(), 0644))
+	assert.NoError(t, spec.ExportEnvsToFile(f.Name()))
+	content, err := ioutil.ReadFile(f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, string(content), "REGION=sgp1")
+	// values of parameters are private, even in an existing file
+	info, err := os.Stat(f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0600))
+}
+
+func TestRenderTemplate(t *testing.T) {
+	yml := `---
+machines:
+  consul:
+    driver: {{param "driver"}}
+    instances: 3
+    post-provision:
+      - docker run -d consul agent {{range instances "consul"}} -join {{ip .}}{{end}}
+`
+	content, err := RenderTemplate("provision.yml.tmpl", []byte(yml), map[string]string{"driver": "none"})
+	assert.NoError(t, err)
+
+	spec, err := Read(content)
+	assert.NoError(t, err)
+	m := spec.Machine("consul-2")
+	assert.Equal(t, m.Driver(), "none")
+	assert.Equal(t, m.post, []string{"docker run -d consul agent  -join ${ip consul-1} -join ${ip consul-2} -join ${ip consul-3}"})
+}
+
+func cmdLine(t *testing.T, m *Machine) []string {
+	result, err := m.cmdLine()
+	assert.NoError(t, err)
+	return result
+}
+
+func postProvision(t *testing.T, m *Machine) []string {
+	result, err := m.postProvision()
+	assert.NoError(t, err)
+	return result
+}
+
+func TestExpandReferences(t *testing.T) {
+	os.Setenv("DPM_TEST_TOKEN", "secret")
+	defer os.Unsetenv("DPM_TEST_TOKEN")
+
+	yml := `---
+machines:
+  ocean:
+    driver: digitalocean
+    options:
+      digitalocean-size: ${param.size:-512mb}
+      digitalocean-access-token: ${env.DPM_TEST_TOKEN}
+      digitalocean-region: ${DPM_TEST_REGION:-nyc3}
+    post-provision:
+      - echo ${self} ${param.size:?size is not set}
+  plain:
+    driver: none
+    options:
+      url: ${env.DPM_TEST_UNSET}
+export-envs:
+  SIZE: ${param.size}
+`
+	spec, err := Read([]byte(yml))
+	assert.NoError(t, err)
+	spec.Params = map[string]string{"size": ""}
+	spec.Source = "provision.yml"
+
+	m := spec.Machine("ocean")
+	assert.Equal(t, cmdLine(t, m), []string{"--driver", "digitalocean",
+		"--digitalocean-access-token", "secret",
+		"--digitalocean-region", "nyc3",
+		"--digitalocean-size", "512mb",
+		"ocean"})
+
+	_, err = m.postProvision()
+	assert.EqualError(t, err, "provision.yml: post-provision[0]: cannot resolve ${param.size:?size is not set}: size is not set")
+
+	_, err = spec.Machine("plain").cmdLine()
+	assert.EqualError(t, err, "provision.yml: options.url: cannot resolve ${env.DPM_TEST_UNSET}: environment variable DPM_TEST_UNSET is not set")
+
+	e := &expander{params: spec.Params, source: "provision.yml"}
+	_, err = e.expand("export-envs.X", "${param.unknown}")
+	assert.EqualError(t, err, "provision.yml: export-envs.X: cannot resolve ${param.unknown}: parameter unknown is not declared")
+	_, err = e.expand("export-envs.X", "${self}")
+	assert.EqualError(t, err, "provision.yml: export-envs.X: cannot resolve ${self}: self can only be used in machine definitions")
+	_, err = e.expand("export-envs.X", "${machine.ocean.name}")
+	assert.EqualError(t, err, "provision.yml: export-envs.X: cannot resolve ${machine.ocean.name}: unknown machine attribute name")
+}
+
+func TestPreProvision(t *testing.T) {
+	yml := `---
+machines:
+  ok:
+    driver: none
+    pre-provision:
+      - echo ${self}
+      - "true"
+  failing:
+    driver: none
+    pre-provision:
+      - sh -c "echo no quota; exit 1"
+`
+	spec, err := Read([]byte(yml))
 	assert.NoError(t, err)
+
+	assert.NoError(t, spec.Machine("ok").executePreProvision(context.Background()))
+	err = spec.Machine("failing").executePreProvision(context.Background())
+	assert.EqualError(t, err, "Pre-provision command 'sh -c \"echo no quota; exit 1\"' of machine failing failed: exit status 1\nno quota\n")
 }
@@ -0,0 +1,140 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Roles of machines in a swarm-mode cluster.
+const (
+	Manager = "manager"
+	Worker  = "worker"
+)
+
+var SwarmRoles = []string{Manager, Worker}
+
+// SwarmJoined is the journal action of a machine initializing or joining the swarm.
+const SwarmJoined = "swarm-joined"
+
+// docker runs the docker CLI against the engine of the machine.
+// Tests replace it.
+var docker = func(ctx context.Context, m *Machine, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Env = withDockerEnv(m.GetEnv())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker %s on machine %s failed: %s\n%s",
+			strings.Join(args, " "), m.name, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// machineIP returns the IP of a machine. Tests replace it.
+var machineIP = IP
+
+// swarmMembers returns managers and workers of the swarm, ordered by name.
+// The first manager initializes the swarm.
+func (s *Spec) swarmMembers() ([]*Machine, []*Machine) {
+	managers, workers := []*Machine{}, []*Machine{}
+	for _, m := range s.Machines() {
+		switch m.swarm {
+		case Manager:
+			managers = append(managers, m)
+		case Worker:
+			workers = append(workers, m)
+		}
+	}
+	sort.Sort(byName(managers))
+	sort.Sort(byName(workers))
+	return managers, workers
+}
+
+type byName []*Machine
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].name < b[j].name }
+
+// swarmActive tells if the engine of the machine is part of a swarm.
+func swarmActive(ctx context.Context, m *Machine) (bool, error) {
+	state, err := docker(ctx, m, "info", "--format", "{{.Swarm.LocalNodeState}}")
+	if err != nil {
+		return false, err
+	}
+	return state == "active", nil
+}
+
+// formSwarm initializes swarm mode on the first manager and joins
+// other machines to it, with the join tokens of the first manager.
+// Machines already in the swarm are skipped.
+func (s *Spec) formSwarm(ctx context.Context) error {
+	managers, workers := s.swarmMembers()
+	if len(managers) == 0 {
+		if len(workers) > 0 {
+			return fmt.Errorf("Swarm of %s has workers but no manager", s.Source)
+		}
+		return nil
+	}
+
+	leader := managers[0]
+	leaderIP, err := machineIP(leader.name)
+	if err != nil {
+		return err
+	}
+	if !s.isDone(SwarmJoined, leader.name) {
+		active, err := swarmActive(ctx, leader)
+		if err != nil {
+			return err
+		}
+		if !active {
+			fmt.Printf("Initializing swarm on machine %s...\n", leader.name)
+			_, err = docker(ctx, leader, "swarm", "init", "--advertise-addr", leaderIP)
+			if err != nil {
+				return err
+			}
+		}
+		err = s.done(SwarmJoined, leader.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	tokens := map[string]string{}
+	join := func(m *Machine, role string) error {
+		if s.isDone(SwarmJoined, m.name) {
+			return nil
+		}
+		active, err := swarmActive(ctx, m)
+		if err != nil {
+			return err
+		}
+		if !active {
+			if tokens[role] == "" {
+				tokens[role], err = docker(ctx, leader, "swarm", "join-token", "-q", role)
+				if err != nil {
+					return err
+				}
+			}
+			fmt.Printf("Joining machine %s to the swarm as a %s...\n", m.name, role)
+			_, err = docker(ctx, m, "swarm", "join", "--token", tokens[role], leaderIP+":2377")
+			if err != nil {
+				return err
+			}
+		}
+		return s.done(SwarmJoined, m.name)
+	}
+	for _, m := range managers[1:] {
+		if err := join(m, Manager); err != nil {
+			return err
+		}
+	}
+	for _, m := range workers {
+		if err := join(m, Worker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
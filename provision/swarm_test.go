@@ -0,0 +1,71 @@
+package provision
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryJournal map[string]bool
+
+func (j memoryJournal) IsDone(action, machine string) bool { return j[action+" "+machine] }
+func (j memoryJournal) Done(action, machine string) error {
+	j[action+" "+machine] = true
+	return nil
+}
+
+func TestFormSwarm(t *testing.T) {
+	spec, err := Read([]byte(`---
+machines:
+  master:
+    driver: none
+    export: true
+    swarm-mode: manager
+  node:
+    driver: none
+    instances: 2
+    swarm-mode: worker
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, spec.ExportedMachine(), ExportedMachine{"master", SwarmMode})
+
+	active := map[string]bool{"node-2": true}
+	calls := []string{}
+	oldDocker, oldIP := docker, machineIP
+	defer func() { docker, machineIP = oldDocker, oldIP }()
+	machineIP = func(name string) (string, error) { return "10.0.0.1", nil }
+	docker = func(ctx context.Context, m *Machine, args ...string) (string, error) {
+		call := m.name + ": " + strings.Join(args, " ")
+		calls = append(calls, call)
+		switch args[1] {
+		case "--format":
+			if active[m.name] {
+				return "active", nil
+			}
+			return "inactive", nil
+		case "join-token":
+			return "SWMTKN-" + args[3], nil
+		}
+		return "", nil
+	}
+
+	journal := memoryJournal{}
+	spec.Journal = journal
+	assert.NoError(t, spec.formSwarm(context.Background()))
+	assert.Equal(t, calls, []string{
+		"master: info --format {{.Swarm.LocalNodeState}}",
+		"master: swarm init --advertise-addr 10.0.0.1",
+		"node-1: info --format {{.Swarm.LocalNodeState}}",
+		"master: swarm join-token -q worker",
+		"node-1: swarm join --token SWMTKN-worker 10.0.0.1:2377",
+		"node-2: info --format {{.Swarm.LocalNodeState}}",
+	})
+	assert.True(t, journal.IsDone(SwarmJoined, "node-2"))
+
+	// all joined, nothing to do again
+	calls = nil
+	assert.NoError(t, spec.formSwarm(context.Background()))
+	assert.Empty(t, calls)
+}
@@ -0,0 +1,88 @@
+package provision
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/swasd/dpm/render"
+)
+
+// Groups returns instance names of machines by their name in the spec.
+func (s *Spec) Groups() map[string][]string {
+	result := map[string][]string{}
+	for k, v := range s.MachineSpecs {
+		if v.Instances == nil || *v.Instances == 1 {
+			result[k] = []string{k}
+			continue
+		}
+		for i := 1; i <= *v.Instances; i++ {
+			result[k] = append(result[k], k+"-"+strconv.Itoa(i))
+		}
+	}
+	return result
+}
+
+// IP returns the IP address of the machine.
+func IP(machine string) (string, error) {
+	h, err := LoadHost(machine)
+	if err != nil {
+		return "", err
+	}
+	if h != nil {
+		return h.IP()
+	}
+	out, err := exec.Command("docker-machine", "-s", dpmHome(), "ip", machine).Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot get IP of machine %s", machine)
+	}
+	return strings.SplitN(strings.TrimSpace(string(out)), ":", 2)[0], nil
+}
+
+// RenderTemplate renders a provision template.
+// Machines do not exist yet when it is rendered, so ip turns into
+// a ${ip name} reference expanded at provisioning. Instances are
+// known only after a first rendering, hence the template is rendered twice.
+func RenderTemplate(name string, content []byte, params map[string]string) ([]byte, error) {
+	ctx := &render.Context{
+		Params: params,
+		IP: func(machine string) (string, error) {
+			return "${ip " + machine + "}", nil
+		},
+	}
+	first, err := render.Render(name, content, ctx)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := Read(first)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Groups = spec.Groups()
+	return render.Render(name, content, ctx)
+}
+
+// Load reads the provision file with the values of the package parameters,
+// rendering it first if it is a template.
+func Load(filename string, params map[string]string) (*Spec, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if render.IsTemplate(filename) {
+		content, err = RenderTemplate(filename, content, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	spec, err := Read(content)
+	if err != nil {
+		return nil, err
+	}
+	spec.Params = params
+	spec.Source = filepath.Base(filename)
+	return spec, nil
+}
@@ -0,0 +1,86 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Suffix marks files rendered as templates before use.
+const Suffix = ".tmpl"
+
+// Context is what templates can look up.
+type Context struct {
+	// Params are values of the package parameters.
+	Params map[string]string
+	// Groups are instance names of machines by their name in the provision file.
+	Groups map[string][]string
+	// IP returns the IP address of the machine.
+	IP func(machine string) (string, error)
+}
+
+// IsTemplate tells if the file is a template.
+func IsTemplate(filename string) bool {
+	return strings.HasSuffix(filename, Suffix)
+}
+
+// Target returns the name of the file rendered from the template.
+func Target(filename string) string {
+	return strings.TrimSuffix(filename, Suffix)
+}
+
+// Render executes the template content with the functions:
+//
+//	ip NAME               IP address of the machine
+//	instances NAME        instance names of the machine
+//	param NAME            value of the package parameter
+//	env NAME              value of the environment variable
+//	default DEFAULT VALUE VALUE if not empty, otherwise DEFAULT
+//	join SEP LIST         elements of the list joined by SEP
+func Render(name string, content []byte, ctx *Context) ([]byte, error) {
+	funcs := template.FuncMap{
+		"ip": func(machine string) (string, error) {
+			if ctx.IP == nil {
+				return "", fmt.Errorf("IP of machine %s is not available", machine)
+			}
+			return ctx.IP(machine)
+		},
+		"instances": func(machine string) []string {
+			return ctx.Groups[machine]
+		},
+		"param": func(key string) (string, error) {
+			value, exist := ctx.Params[key]
+			if !exist {
+				return "", fmt.Errorf("parameter %s is not declared", key)
+			}
+			return value, nil
+		},
+		"env": os.Getenv,
+		"default": func(def string, value interface{}) string {
+			s := ""
+			if value != nil {
+				s = fmt.Sprint(value)
+			}
+			if s == "" {
+				return def
+			}
+			return s
+		},
+		"join": func(sep string, list []string) string {
+			return strings.Join(list, sep)
+		},
+	}
+
+	t, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	err = t.Execute(buf, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
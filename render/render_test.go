@@ -0,0 +1,43 @@
+package render
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRender(t *testing.T) {
+	os.Setenv("DPM_TEST_ZONE", "east")
+	defer os.Unsetenv("DPM_TEST_ZONE")
+
+	ctx := &Context{
+		Params: map[string]string{"size": "", "name": "web"},
+		Groups: map[string][]string{"consul": {"consul-1", "consul-2"}},
+		IP: func(machine string) (string, error) {
+			return "10.0.0." + machine[len(machine)-1:], nil
+		},
+	}
+	out, err := Render("test", []byte(`name: {{param "name"}}
+size: {{param "size" | default "512mb"}}
+zone: {{env "DPM_TEST_ZONE"}}
+join: {{instances "consul" | join ","}}
+ips:{{range instances "consul"}} {{ip .}}{{end}}
+`), ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, string(out), `name: web
+size: 512mb
+zone: east
+join: consul-1,consul-2
+ips: 10.0.0.1 10.0.0.2
+`)
+
+	_, err = Render("test", []byte(`{{param "unknown"}}`), ctx)
+	assert.Error(t, err)
+}
+
+func TestTarget(t *testing.T) {
+	assert.True(t, IsTemplate("composition.yml.tmpl"))
+	assert.False(t, IsTemplate("composition.yml"))
+	assert.Equal(t, Target("composition.yml.tmpl"), "composition.yml")
+}
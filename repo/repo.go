@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v2"
@@ -21,6 +22,30 @@ func Get(nameOrId string, version string) (*Entry, error) {
 	return getRemote(nameOrId, version)
 }
 
+// Latest returns the entry of the newest version of the package
+// found in the local and remote indexes.
+func Latest(packageName string) (*Entry, error) {
+	candidates := make(Entries, 0)
+	local, err := getLocalIndex()
+	if err == nil {
+		if e := local.FindLatest(packageName); e != nil {
+			candidates = append(candidates, e)
+		}
+	}
+	remote, err := getRemoteIndex()
+	if err == nil {
+		if e := remote.FindLatest(packageName); e != nil {
+			candidates = append(candidates, e)
+		}
+	}
+
+	latest := candidates.FindLatest(packageName)
+	if latest == nil {
+		return nil, fmt.Errorf("Entry not found")
+	}
+	return Get(latest.PackageName, latest.Version)
+}
+
 func getLocal(nameOrId string, version string) (*Entry, error) {
 	entries, err := getLocalIndex()
 	if err != nil {
@@ -99,6 +124,51 @@ func (e Entries) FindByName(packageName string) *Entry {
 	return nil
 }
 
+// FindLatest returns the entry having the highest version of the package.
+func (e Entries) FindLatest(packageName string) *Entry {
+	var result *Entry
+	for _, ee := range e {
+		if ee.PackageName != packageName {
+			continue
+		}
+		if result == nil || CompareVersions(ee.Version, result.Version) > 0 {
+			result = ee
+		}
+	}
+	return result
+}
+
+// CompareVersions compares dot separated versions, part by part.
+// Numeric parts are compared as numbers, others as strings.
+// It returns -1, 0 or 1 when a is lower than, equal to, or higher than b.
+func CompareVersions(a, b string) int {
+	pa := strings.Split(a, ".")
+	pb := strings.Split(b, ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.Atoi(pa[i])
+		nb, errB := strconv.Atoi(pb[i])
+		switch {
+		case errA == nil && errB == nil:
+			if na < nb {
+				return -1
+			} else if na > nb {
+				return 1
+			}
+		case pa[i] < pb[i]:
+			return -1
+		case pa[i] > pb[i]:
+			return 1
+		}
+	}
+	switch {
+	case len(pa) < len(pb):
+		return -1
+	case len(pa) > len(pb):
+		return 1
+	}
+	return 0
+}
+
 func (e Entries) findByNameAndVersion(name string, version string) *Entry {
 	for _, ee := range e {
 		if ee.PackageName == name && ee.Version == version {
@@ -108,7 +178,7 @@ func (e Entries) findByNameAndVersion(name string, version string) *Entry {
 	return nil
 }
 
-func (e Entries) findByHash(id string) *Entry {
+func (e Entries) FindByHash(id string) *Entry {
 	if _, err := hex.DecodeString(id); err != nil {
 		return nil
 	}
@@ -156,9 +226,9 @@ func LoadIndex(filename string) (Entries, error) {
 	return e, nil
 }
 
-const (
-	Repo = "https://raw.githubusercontent.com/swasd/dpm-repo/master/"
-)
+// Repo is the base URL of the remote repository,
+// a variable for tests to serve their own.
+var Repo = "https://raw.githubusercontent.com/swasd/dpm-repo/master/"
 
 func getLocalIndex() (Entries, error) {
 	home := os.Getenv("HOME")
@@ -1,9 +1,12 @@
 package repo
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/swasd/dpm/dpmtest"
 )
 
 func TestLoadEntries(t *testing.T) {
@@ -21,3 +24,59 @@ func TestLoadEntries(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, len(e2), 1)
 }
+
+func TestFindLatest(t *testing.T) {
+	e := Entries{
+		&Entry{PackageName: "consul-discovery", Version: "0.2.0"},
+		&Entry{PackageName: "consul-discovery", Version: "0.10.0"},
+		&Entry{PackageName: "base-cluster", Version: "1.0.0"},
+		&Entry{PackageName: "consul-discovery", Version: "0.9.1"},
+	}
+	assert.Equal(t, e.FindLatest("consul-discovery").Version, "0.10.0")
+	assert.Equal(t, e.FindLatest("base-cluster").Version, "1.0.0")
+	assert.Nil(t, e.FindLatest("swarm"))
+}
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, CompareVersions("1.0", "1.0"), 0)
+	assert.Equal(t, CompareVersions("1.0", "1.1"), -1)
+	assert.Equal(t, CompareVersions("1.10", "1.9"), 1)
+	assert.Equal(t, CompareVersions("1.0", "1.0.1"), -1)
+	assert.Equal(t, CompareVersions("0.1.0.dev", "0.1.0"), 1)
+	assert.Equal(t, CompareVersions("0.1.0.alpha", "0.1.0.beta"), -1)
+}
+
+func TestGet(t *testing.T) {
+	h := dpmtest.NewHome(t)
+	defer h.Close()
+	r := dpmtest.NewRepo(t)
+	defer r.Close()
+	oldRepo := Repo
+	defer func() { Repo = oldRepo }()
+	Repo = r.URL()
+
+	local := h.AddPackage("consul-discovery", "1.0.0", dpmtest.Package(map[string]string{"SPEC.yml": "local"}))
+	remote := r.AddPackage("consul-discovery", "1.1.0", dpmtest.Package(map[string]string{"SPEC.yml": "remote"}))
+
+	e, err := Get("consul-discovery", "")
+	assert.NoError(t, err)
+	assert.Equal(t, e.Hash, local)
+	e, err = Get(local, "")
+	assert.NoError(t, err)
+	assert.Equal(t, e.Version, "1.0.0")
+
+	// not in the local index, downloaded to the cache
+	e, err = Get("consul-discovery", "1.1.0")
+	assert.NoError(t, err)
+	assert.Equal(t, e.Hash, remote)
+	content, err := ioutil.ReadFile(filepath.Join(h.Dir, ".dpm", "cache", e.Filename))
+	assert.NoError(t, err)
+	assert.Equal(t, content, dpmtest.Package(map[string]string{"SPEC.yml": "remote"}))
+
+	e, err = Latest("consul-discovery")
+	assert.NoError(t, err)
+	assert.Equal(t, e.Version, "1.1.0")
+
+	_, err = Get("swarm", "")
+	assert.EqualError(t, err, "Entry not found")
+}
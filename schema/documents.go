@@ -0,0 +1,43 @@
+package schema
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/swasd/dpm/build"
+	"github.com/swasd/dpm/provision"
+)
+
+const base = "https://github.com/swasd/dpm/schema/"
+
+// Spec returns the schema of SPEC.yml.
+func Spec() *Schema {
+	s := Generate(reflect.TypeOf(build.Root{}), map[string][]string{
+		"versions":          []string{build.SpecVersion},
+		"parameter-types":   build.ParameterTypes,
+		"hook-failures":     build.HookFailures,
+		"composition-types": build.CompositionTypes,
+	})
+	s.Schema = draft
+	s.ID = base + build.SpecVersion + "/spec.json"
+	s.Title = "dpm package spec " + build.SpecVersion
+	return s
+}
+
+// Provision returns the schema of provision files.
+func Provision() *Schema {
+	drivers := []string{}
+	for d := range provision.Drivers {
+		drivers = append(drivers, d)
+	}
+	sort.Strings(drivers)
+
+	s := Generate(reflect.TypeOf(provision.Spec{}), map[string][]string{
+		"drivers":     drivers,
+		"swarm-roles": provision.SwarmRoles,
+	})
+	s.Schema = draft
+	s.ID = base + build.SpecVersion + "/provision.json"
+	s.Title = "dpm provision spec " + build.SpecVersion
+	return s
+}
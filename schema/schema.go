@@ -0,0 +1,128 @@
+package schema
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema is a JSON Schema document, limited to keywords dpm uses.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	ID                   string             `json:"$id,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Minimum              *int               `json:"minimum,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+const draft = "http://json-schema.org/draft-07/schema#"
+
+// Generate builds the schema of values of the type as yaml.v2 reads them.
+// Property names follow yaml tags, or lowercased field names.
+// Fields may have a `schema` tag with comma separated directives:
+//
+//	required        the property is required
+//	pattern=re      string values must match the regular expression
+//	enum=@name      values must be one of enums[name]
+//	minimum=n       numbers must be at least n
+//	values=a|b      values of a map of interface{} are one of the types,
+//	                where map means a map of strings
+func Generate(t reflect.Type, enums map[string][]string) *Schema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return Generate(t.Elem(), enums)
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: Generate(t.Elem(), enums)}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: Generate(t.Elem(), enums)}
+	case reflect.Struct:
+		s := &Schema{
+			Type:                 "object",
+			Properties:           map[string]*Schema{},
+			AdditionalProperties: false,
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				// unexported
+				continue
+			}
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			prop := Generate(f.Type, enums)
+			if apply(prop, f.Tag.Get("schema"), enums) {
+				s.Required = append(s.Required, name)
+			}
+			s.Properties[name] = prop
+		}
+		sort.Strings(s.Required)
+		return s
+	}
+	// interface{} accepts anything
+	return &Schema{}
+}
+
+// apply applies directives of the schema tag,
+// and tells if the property is required.
+func apply(s *Schema, tag string, enums map[string][]string) bool {
+	required := false
+	if tag == "" {
+		return required
+	}
+	for _, d := range strings.Split(tag, ",") {
+		parts := strings.SplitN(d, "=", 2)
+		arg := ""
+		if len(parts) == 2 {
+			arg = parts[1]
+		}
+		switch parts[0] {
+		case "required":
+			required = true
+		case "pattern":
+			s.Pattern = arg
+		case "enum":
+			s.Enum = enums[strings.TrimPrefix(arg, "@")]
+		case "minimum":
+			n, err := strconv.Atoi(arg)
+			if err == nil {
+				s.Minimum = &n
+			}
+		case "values":
+			values := &Schema{}
+			for _, v := range strings.Split(arg, "|") {
+				if v == "map" {
+					values.OneOf = append(values.OneOf, &Schema{
+						Type:                 "object",
+						AdditionalProperties: &Schema{Type: "string"},
+					})
+				} else {
+					values.OneOf = append(values.OneOf, &Schema{Type: v})
+				}
+			}
+			s.AdditionalProperties = values
+		}
+	}
+	return required
+}
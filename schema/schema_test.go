@@ -0,0 +1,87 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+type machine struct {
+	Driver    string `schema:"required,enum=@drivers"`
+	Instances *int   `schema:"minimum=1"`
+	Tags      []string
+	Options   map[string]interface{} `schema:"values=string|boolean|map"`
+	Post      []string               `yaml:"post-provision,omitempty"`
+	Journal   interface{}            `yaml:"-"`
+	internal  string
+}
+
+func TestGenerate(t *testing.T) {
+	s := Generate(reflect.TypeOf(machine{}), map[string][]string{
+		"drivers": []string{"none", "virtualbox"},
+	})
+	content, err := json.Marshal(s)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"type": "object",
+		"properties": {
+			"driver": {"type": "string", "enum": ["none", "virtualbox"]},
+			"instances": {"type": "integer", "minimum": 1},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"options": {
+				"type": "object",
+				"additionalProperties": {"oneOf": [
+					{"type": "string"},
+					{"type": "boolean"},
+					{"type": "object", "additionalProperties": {"type": "string"}}
+				]}
+			},
+			"post-provision": {"type": "array", "items": {"type": "string"}}
+		},
+		"required": ["driver"],
+		"additionalProperties": false
+	}`, string(content))
+}
+
+func TestValidate(t *testing.T) {
+	s := Generate(reflect.TypeOf(machine{}), map[string][]string{
+		"drivers": []string{"none", "virtualbox"},
+	})
+
+	var doc interface{}
+	err := yaml.Unmarshal([]byte(`
+driver: digitalocean
+instances: 0
+tags: single
+options:
+  size: 512
+  swarm: true
+  engine-opt:
+    cluster-store: consul://1.2.3.4:8500
+  labels: [a, b]
+pre-provision:
+  - echo
+`), &doc)
+	assert.NoError(t, err)
+
+	messages := []string{}
+	for _, v := range s.Validate(doc) {
+		messages = append(messages, v.String())
+	}
+	assert.Equal(t, []string{
+		"driver: 'digitalocean' must be one of none, virtualbox",
+		"instances: must be at least 1",
+		"options.labels: must be a string or a boolean or a map of strings",
+		"pre-provision: unknown property 'pre-provision'",
+		"tags: must be a list",
+	}, messages)
+
+	err = yaml.Unmarshal([]byte("instances: 2\n"), &doc)
+	assert.NoError(t, err)
+	violations := s.Validate(doc)
+	assert.Equal(t, len(violations), 1)
+	assert.Equal(t, violations[0].String(), "driver is required")
+}
@@ -0,0 +1,167 @@
+package schema
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Violation is a value not conforming to a schema.
+// Path is made of mapping keys and sequence indexes leading to the value.
+type Violation struct {
+	Path    []string
+	Message string
+}
+
+func (v Violation) String() string {
+	if len(v.Path) == 0 {
+		return v.Message
+	}
+	return strings.Join(v.Path, ".") + ": " + v.Message
+}
+
+// Validate checks a document decoded by yaml.v2 into an interface{}.
+// As yaml.v2 decodes any scalar into a string field,
+// all scalars are accepted where a string is expected.
+func (s *Schema) Validate(doc interface{}) []Violation {
+	v := &validator{[]Violation{}}
+	v.validate(s, doc, []string{})
+	return v.violations
+}
+
+type validator struct {
+	violations []Violation
+}
+
+func (v *validator) report(path []string, format string, args ...interface{}) {
+	v.violations = append(v.violations, Violation{
+		Path:    append([]string{}, path...),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func describe(s *Schema) string {
+	switch s.Type {
+	case "object":
+		if as, ok := s.AdditionalProperties.(*Schema); ok && s.Properties == nil && as.Type == "string" {
+			return "a map of strings"
+		}
+		return "a map"
+	case "array":
+		return "a list"
+	case "integer":
+		return "an integer"
+	}
+	return "a " + s.Type
+}
+
+func matches(s *Schema, value interface{}) bool {
+	switch value.(type) {
+	case map[interface{}]interface{}:
+		return s.Type == "" || s.Type == "object"
+	case []interface{}:
+		return s.Type == "" || s.Type == "array"
+	case bool:
+		return s.Type == "" || s.Type == "boolean" || s.Type == "string"
+	case int, int64, uint64:
+		return s.Type != "object" && s.Type != "array" && s.Type != "boolean"
+	case float64:
+		return s.Type == "" || s.Type == "number" || s.Type == "string"
+	}
+	return s.Type == "" || s.Type == "string"
+}
+
+func (v *validator) validate(s *Schema, value interface{}, path []string) {
+	if value == nil {
+		// an empty value decodes to the zero value
+		return
+	}
+
+	if len(s.OneOf) > 0 {
+		for _, alt := range s.OneOf {
+			if matches(alt, value) {
+				v.validate(alt, value, path)
+				return
+			}
+		}
+		alts := []string{}
+		for _, alt := range s.OneOf {
+			alts = append(alts, describe(alt))
+		}
+		v.report(path, "must be %s", strings.Join(alts, " or "))
+		return
+	}
+
+	if !matches(s, value) {
+		v.report(path, "must be %s", describe(s))
+		return
+	}
+
+	switch val := value.(type) {
+	case map[interface{}]interface{}:
+		keys := []string{}
+		for k := range val {
+			keys = append(keys, fmt.Sprint(k))
+		}
+		sort.Strings(keys)
+		for _, r := range s.Required {
+			if _, exist := s.Properties[r]; exist && !contains(keys, r) {
+				v.report(path, "%s is required", r)
+			}
+		}
+		for _, k := range keys {
+			child := append(path, k)
+			item := lookup(val, k)
+			if prop, exist := s.Properties[k]; exist {
+				v.validate(prop, item, child)
+				continue
+			}
+			switch as := s.AdditionalProperties.(type) {
+			case bool:
+				if !as {
+					v.report(child, "unknown property '%s'", k)
+				}
+			case *Schema:
+				v.validate(as, item, child)
+			}
+		}
+
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range val {
+				v.validate(s.Items, item, append(path, fmt.Sprint(i)))
+			}
+		}
+
+	default:
+		str := fmt.Sprint(val)
+		if len(s.Enum) > 0 && !contains(s.Enum, str) {
+			v.report(path, "'%s' must be one of %s", str, strings.Join(s.Enum, ", "))
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(str) {
+			v.report(path, "'%s' must match %s", str, s.Pattern)
+		}
+		if n, ok := val.(int); ok && s.Minimum != nil && n < *s.Minimum {
+			v.report(path, "must be at least %d", *s.Minimum)
+		}
+	}
+}
+
+func lookup(m map[interface{}]interface{}, key string) interface{} {
+	for k, v := range m {
+		if fmt.Sprint(k) == key {
+			return v
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// PassphraseEnv is the environment variable holding the passphrase
+// the key of the store is derived from.
+const PassphraseEnv = "DPM_SECRET_PASSPHRASE"
+
+// iterations of PBKDF2 deriving the key from the passphrase
+var iterations = 100000
+
+// Store keeps secrets encrypted with AES-GCM in ~/.dpm/secrets.yml.
+// The key is derived from the passphrase in DPM_SECRET_PASSPHRASE
+// and never written, so the file alone does not reveal the secrets.
+type Store struct {
+	filename string
+	gcm      cipher.AEAD
+	data     storeFile
+}
+
+// storeFile is the content of secrets.yml. Check is a value sealed
+// with the key, telling a wrong passphrase from a corrupted secret.
+type storeFile struct {
+	Salt    string
+	Check   string
+	Secrets map[string]string
+}
+
+// checkName is the additional data of the check value,
+// not a valid secret name.
+const checkName = "dpm:check"
+
+func dpmHome() string {
+	home := os.Getenv("HOME")
+	return filepath.Join(home, ".dpm")
+}
+
+// deriveKey is PBKDF2 with HMAC-SHA256 (RFC 8018) for a 32 bytes key.
+func deriveKey(passphrase string, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, []byte(passphrase))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// Open opens the secrets store with the passphrase in DPM_SECRET_PASSPHRASE,
+// creating the store if there is none.
+func Open() (*Store, error) {
+	passphrase := os.Getenv(PassphraseEnv)
+	if passphrase == "" {
+		return nil, fmt.Errorf("Secrets are encrypted with a passphrase, set %s to it", PassphraseEnv)
+	}
+
+	s := &Store{
+		filename: filepath.Join(dpmHome(), "secrets.yml"),
+		data:     storeFile{Secrets: map[string]string{}},
+	}
+	content, err := ioutil.ReadFile(s.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = yaml.Unmarshal(content, &s.data)
+		if err != nil {
+			return nil, err
+		}
+		if s.data.Secrets == nil {
+			s.data.Secrets = map[string]string{}
+		}
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(s.data.Salt)
+	if err != nil || (s.data.Salt != "" && len(salt) != 16) {
+		return nil, fmt.Errorf("Secrets store %s is corrupted", s.filename)
+	}
+	if s.data.Salt == "" {
+		salt = make([]byte, 16)
+		_, err = io.ReadFull(rand.Reader, salt)
+		if err != nil {
+			return nil, err
+		}
+		s.data.Salt = base64.StdEncoding.EncodeToString(salt)
+	}
+
+	block, err := aes.NewCipher(deriveKey(passphrase, salt, iterations))
+	if err != nil {
+		return nil, err
+	}
+	s.gcm, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// a new store is saved at once, its salt deriving the key from then on
+	if s.data.Check == "" {
+		s.data.Check, err = s.seal(checkName, s.data.Salt)
+		if err != nil {
+			return nil, err
+		}
+		return s, s.save()
+	}
+	if _, err := s.open(checkName, s.data.Check); err != nil {
+		return nil, fmt.Errorf("Wrong passphrase in %s for secrets store %s", PassphraseEnv, s.filename)
+	}
+	return s, nil
+}
+
+// Names returns names of all secrets, sorted.
+func (s *Store) Names() []string {
+	result := []string{}
+	for name := range s.data.Secrets {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// seal encrypts the value, authenticating the name with it.
+func (s *Store) seal(name, value string) (string, error) {
+	nonce := make([]byte, s.gcm.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := s.gcm.Seal(nonce, nonce, []byte(value), []byte(name))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *Store) open(name, encrypted string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(data) < s.gcm.NonceSize() {
+		return "", fmt.Errorf("Secret %s is corrupted", name)
+	}
+	nonce, sealed := data[:s.gcm.NonceSize()], data[s.gcm.NonceSize():]
+	plain, err := s.gcm.Open(nil, nonce, sealed, []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("Secret %s cannot be decrypted", name)
+	}
+	return string(plain), nil
+}
+
+// Get decrypts the secret. The value gets redacted from then on.
+func (s *Store) Get(name string) (string, error) {
+	encrypted, exist := s.data.Secrets[name]
+	if !exist {
+		return "", fmt.Errorf("Secret %s is not set, run `dpm secret set %s` to set it", name, name)
+	}
+	return s.Decrypt(name, encrypted)
+}
+
+// Set encrypts the secret and saves the store.
+func (s *Store) Set(name, value string) error {
+	encrypted, err := s.Encrypt(name, value)
+	if err != nil {
+		return err
+	}
+	s.data.Secrets[name] = encrypted
+	return s.save()
+}
+
+// Encrypt encrypts a value kept outside of the store, as in state files.
+// The name must be given again to decrypt it.
+func (s *Store) Encrypt(name, value string) (string, error) {
+	return s.seal(name, value)
+}
+
+// Decrypt decrypts a value encrypted under the name.
+// The value gets redacted from then on.
+func (s *Store) Decrypt(name, encrypted string) (string, error) {
+	value, err := s.open(name, encrypted)
+	if err != nil {
+		return "", err
+	}
+	reveal(value)
+	return value, nil
+}
+
+// Remove deletes the secret and saves the store.
+func (s *Store) Remove(name string) error {
+	if _, exist := s.data.Secrets[name]; !exist {
+		return fmt.Errorf("Secret %s is not set", name)
+	}
+	delete(s.data.Secrets, name)
+	return s.save()
+}
+
+func (s *Store) save() error {
+	content, err := yaml.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dpmHome(), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.filename, content, 0600)
+}
+
+// Mask replaces secret values in redacted text.
+const Mask = "******"
+
+var (
+	mu       sync.Mutex
+	revealed = map[string]bool{}
+)
+
+func reveal(value string) {
+	if value == "" {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	revealed[value] = true
+}
+
+// Redact replaces values of the secrets read so far in the text.
+func Redact(text string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	// longer values first, in case one contains another
+	values := []string{}
+	for v := range revealed {
+		values = append(values, v)
+	}
+	sort.Sort(byLength(values))
+	for _, v := range values {
+		text = strings.Replace(text, v, Mask, -1)
+	}
+	return text
+}
+
+type byLength []string
+
+func (b byLength) Len() int           { return len(b) }
+func (b byLength) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLength) Less(i, j int) bool { return len(b[i]) > len(b[j]) }
+
+// Contains tells if the text has a value of the secrets read so far.
+func Contains(text string) bool {
+	return Redact(text) != text
+}
+
+type redactor struct {
+	w io.Writer
+}
+
+// NewRedactor returns a writer redacting secrets written to w.
+// A secret split across writes is not redacted.
+func NewRedactor(w io.Writer) io.Writer {
+	return &redactor{w}
+}
+
+func (r *redactor) Write(p []byte) (int, error) {
+	_, err := io.WriteString(r.w, Redact(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
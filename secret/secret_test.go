@@ -0,0 +1,84 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	home, err := ioutil.TempDir("", "dpm")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", oldHome)
+	defer os.Unsetenv(PassphraseEnv)
+	iterations = 10
+
+	_, err = Open()
+	assert.EqualError(t, err, "Secrets are encrypted with a passphrase, set DPM_SECRET_PASSPHRASE to it")
+
+	os.Setenv(PassphraseEnv, "open sesame")
+	s, err := Open()
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set("do-token", "abcdef123456"))
+	assert.NoError(t, s.Set("aws-key", "AKIA0000"))
+
+	// nothing but the encrypted secrets is written
+	infos, err := ioutil.ReadDir(filepath.Join(home, ".dpm"))
+	assert.NoError(t, err)
+	assert.Equal(t, len(infos), 1)
+	assert.Equal(t, infos[0].Mode().Perm(), os.FileMode(0600))
+	content, err := ioutil.ReadFile(filepath.Join(home, ".dpm", "secrets.yml"))
+	assert.NoError(t, err)
+	assert.False(t, strings.Contains(string(content), "abcdef123456"))
+
+	os.Setenv(PassphraseEnv, "guess")
+	_, err = Open()
+	assert.EqualError(t, err, "Wrong passphrase in DPM_SECRET_PASSPHRASE for secrets store "+filepath.Join(home, ".dpm", "secrets.yml"))
+	os.Setenv(PassphraseEnv, "open sesame")
+
+	s, err = Open()
+	assert.NoError(t, err)
+	assert.Equal(t, s.Names(), []string{"aws-key", "do-token"})
+	assert.Equal(t, Redact("--token abcdef123456"), "--token abcdef123456")
+	value, err := s.Get("do-token")
+	assert.NoError(t, err)
+	assert.Equal(t, value, "abcdef123456")
+	assert.Equal(t, Redact("--token abcdef123456"), "--token "+Mask)
+	assert.True(t, Contains("TOKEN=abcdef123456"))
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(NewRedactor(buf), "creating with abcdef123456\n")
+	assert.Equal(t, buf.String(), "creating with "+Mask+"\n")
+
+	_, err = s.Get("unknown")
+	assert.EqualError(t, err, "Secret unknown is not set, run `dpm secret set unknown` to set it")
+	assert.NoError(t, s.Remove("aws-key"))
+	assert.Equal(t, s.Names(), []string{"do-token"})
+
+	encrypted, err := s.Encrypt("web.token", "xyz789")
+	assert.NoError(t, err)
+	assert.False(t, strings.Contains(encrypted, "xyz789"))
+	_, err = s.Decrypt("web.other", encrypted)
+	assert.EqualError(t, err, "Secret web.other cannot be decrypted")
+	value, err = s.Decrypt("web.token", encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, value, "xyz789")
+	assert.Equal(t, Redact("token xyz789"), "token "+Mask)
+}
+
+func TestDeriveKey(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 test vector of RFC 7914
+	assert.Equal(t, hex.EncodeToString(deriveKey("passwd", []byte("salt"), 1)),
+		"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc")
+	assert.Equal(t, hex.EncodeToString(deriveKey("Password", []byte("NaCl"), 80000)),
+		"4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56")
+}
@@ -0,0 +1,92 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Installation is a package installed by dpm.
+type Installation struct {
+	Name    string
+	Version string
+	Hash    string
+	// Order lists hashes of the package and its dependencies
+	// in the order they were installed.
+	Order []string
+	// Machine is the name of the machine exported by the package.
+	Machine string
+	// Params are values supplied for parameters of the package.
+	Params map[string]string `yaml:",omitempty"`
+	// Secrets are values of secret parameters, encrypted
+	// by the secrets store under name.parameter.
+	Secrets map[string]string `yaml:",omitempty"`
+}
+
+type Installations []*Installation
+
+func installedFile() string {
+	return filepath.Join(dpmHome(), "installed.yml")
+}
+
+// LoadInstallations loads the packages recorded as installed.
+func LoadInstallations() (Installations, error) {
+	result := make(Installations, 0)
+	content, err := ioutil.ReadFile(installedFile())
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(content, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (i Installations) FindByName(name string) *Installation {
+	for _, ii := range i {
+		if ii.Name == name {
+			return ii
+		}
+	}
+	return nil
+}
+
+// Put adds the installation, replacing the one of the same package name.
+func (i Installations) Put(installation *Installation) Installations {
+	return append(i.Remove(installation.Name), installation)
+}
+
+func (i Installations) Remove(name string) Installations {
+	result := make(Installations, 0)
+	for _, ii := range i {
+		if ii.Name != name {
+			result = append(result, ii)
+		}
+	}
+	return result
+}
+
+func (i Installations) Save() error {
+	content, err := yaml.Marshal(i)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dpmHome(), 0755)
+	if err != nil {
+		return err
+	}
+	// values of parameters are private to the user,
+	// WriteFile keeps permissions of an existing file
+	err = ioutil.WriteFile(installedFile(), content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(installedFile(), 0600)
+}
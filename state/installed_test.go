@@ -0,0 +1,43 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstallations(t *testing.T) {
+	home, err := ioutil.TempDir("", "dpm")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", oldHome)
+
+	i, err := LoadInstallations()
+	assert.NoError(t, err)
+	assert.Equal(t, len(i), 0)
+
+	i = i.Put(&Installation{
+		Name:    "consul-discovery",
+		Version: "0.1.0",
+		Hash:    "1234",
+		Order:   []string{"1234"},
+		Machine: "consul",
+	})
+	i = i.Put(&Installation{Name: "base-cluster", Version: "0.1.0", Hash: "5678"})
+	i = i.Put(&Installation{Name: "consul-discovery", Version: "0.2.0", Hash: "abcd"})
+	assert.NoError(t, i.Save())
+
+	i2, err := LoadInstallations()
+	assert.NoError(t, err)
+	assert.Equal(t, len(i2), 2)
+	assert.Equal(t, i2.FindByName("consul-discovery").Version, "0.2.0")
+	assert.Nil(t, i2.FindByName("swarm"))
+
+	i2 = i2.Remove("base-cluster")
+	assert.Equal(t, len(i2), 1)
+	assert.Nil(t, i2.FindByName("base-cluster"))
+}
@@ -0,0 +1,126 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	EnvExported = "env-exported"
+	ComposeUp   = "compose-up"
+
+	// ProjectCreated marks a compose project not running before the install
+	ProjectCreated = "project-created"
+
+	// HookRun marks hooks of the lifecycle point in Target as run
+	HookRun = "hook-run"
+
+	// MachineRemoved marks a machine removed by an upgrade, to be re-created
+	MachineRemoved = "machine-removed"
+)
+
+// Step is a completed step of an install.
+// Package is the hash of the package the step belongs to.
+type Step struct {
+	Package string `yaml:"package"`
+	Action  string `yaml:"action"`
+	Target  string `yaml:"target,omitempty"`
+}
+
+// Journal records steps completed by an install of a package,
+// in the order they were done.
+type Journal struct {
+	filename string
+	Steps    []Step `yaml:"steps"`
+}
+
+func dpmHome() string {
+	home := os.Getenv("HOME")
+	return filepath.Join(home, ".dpm")
+}
+
+// LoadJournal loads the journal of installing the package of the hash.
+// An empty journal is returned if there is none.
+func LoadJournal(hash string) (*Journal, error) {
+	j := &Journal{
+		filename: filepath.Join(dpmHome(), "journal", hash+".yml"),
+		Steps:    []Step{},
+	}
+	content, err := ioutil.ReadFile(j.filename)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(content, j)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) Empty() bool {
+	return len(j.Steps) == 0
+}
+
+func (j *Journal) IsDone(pkg, action, target string) bool {
+	for _, s := range j.Steps {
+		if s.Package == pkg && s.Action == action && s.Target == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *Journal) Done(pkg, action, target string) error {
+	if j.IsDone(pkg, action, target) {
+		return nil
+	}
+	j.Steps = append(j.Steps, Step{pkg, action, target})
+	return j.save()
+}
+
+// Reset forgets all recorded steps and removes the journal file.
+func (j *Journal) Reset() error {
+	j.Steps = []Step{}
+	err := os.Remove(j.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (j *Journal) save() error {
+	content, err := yaml.Marshal(j)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(j.filename), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(j.filename, content, 0644)
+}
+
+// For returns the journal scoped to steps of a single package.
+func (j *Journal) For(pkg string) *PackageJournal {
+	return &PackageJournal{j, pkg}
+}
+
+type PackageJournal struct {
+	journal *Journal
+	pkg     string
+}
+
+func (p *PackageJournal) IsDone(action, target string) bool {
+	return p.journal.IsDone(p.pkg, action, target)
+}
+
+func (p *PackageJournal) Done(action, target string) error {
+	return p.journal.Done(p.pkg, action, target)
+}
@@ -0,0 +1,41 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	home, err := ioutil.TempDir("", "dpm")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", oldHome)
+
+	j, err := LoadJournal("abcd")
+	assert.NoError(t, err)
+	assert.True(t, j.Empty())
+
+	assert.NoError(t, j.For("1234").Done("machine-created", "ocean-1"))
+	assert.NoError(t, j.Done("1234", EnvExported, ""))
+	assert.NoError(t, j.Done("1234", EnvExported, ""))
+
+	j2, err := LoadJournal("abcd")
+	assert.NoError(t, err)
+	assert.Equal(t, len(j2.Steps), 2)
+	assert.True(t, j2.IsDone("1234", "machine-created", "ocean-1"))
+	assert.True(t, j2.For("1234").IsDone(EnvExported, ""))
+	assert.False(t, j2.IsDone("5678", EnvExported, ""))
+	assert.False(t, j2.IsDone("1234", ComposeUp, "test"))
+
+	assert.NoError(t, j2.Reset())
+	assert.True(t, j2.Empty())
+
+	j3, err := LoadJournal("abcd")
+	assert.NoError(t, err)
+	assert.True(t, j3.Empty())
+}